@@ -0,0 +1,63 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// adminHandler requires requests to present an API key which may call every query.
+// Admin endpoints are only served when API keys are configured.
+func adminHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, ok := findAPIKey(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "missing or invalid API key", nil)
+			return
+		}
+		if len(key.Queries) > 0 {
+			writeError(w, http.StatusForbidden, "API key is limited to some queries", nil)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// adminQueriesHandler writes the effective configuration of the query named by the rest of the
+// URL path after --admin_path, or of every query at --admin_path itself, as YAML. The result
+// shows defaults and normalized values as the proxy uses them. SQL is only included with --debug.
+func adminQueriesHandler(w http.ResponseWriter, r *http.Request) {
+	var view []SQLQuery
+	if name := strings.TrimPrefix(r.URL.Path, *adminPath); name != "" {
+		query, ok := lookupQuery(name)
+		if !ok {
+			writeError(w, http.StatusNotFound, "query not found", nil)
+			return
+		}
+		view = []SQLQuery{query}
+	} else {
+		for name, query := range allQueries() {
+			// Aliases are shown as part of the query they refer to.
+			if name == query.Name {
+				view = append(view, query)
+			}
+		}
+		sort.Slice(view, func(i, j int) bool { return view[i].Name < view[j].Name })
+	}
+	if !*debug {
+		for i := range view {
+			view[i].SQL = ""
+		}
+	}
+
+	out, err := yaml.Marshal(view)
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "encoding queries failed", err)
+		return
+	}
+	w.Header().Set("Content-Type", "application/yaml")
+	w.Write(out)
+}
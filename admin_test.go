@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"gopkg.in/yaml.v2"
+)
+
+func TestAdminQueriesHandler(t *testing.T) {
+	defer func(keys []APIKey) { apiKeys = keys }(apiKeys)
+	defer func(path string, d bool) { *adminPath, *debug = path, d }(*adminPath, *debug)
+	apiKeys = []APIKey{{Key: "admin"}, {Key: "scoped", Queries: []string{"users"}}}
+	*adminPath = "/admin/queries/"
+	serveQueries(t,
+		SQLQuery{Name: "users", SQL: "SELECT * FROM users WHERE id = @id", Parameters: map[string]Parameter{"id": {Type: "int64"}}},
+		SQLQuery{Name: "orders", SQL: "SELECT * FROM orders"},
+	)
+	h := adminHandler(adminQueriesHandler)
+
+	// get requests path with key, returning the response and the queries it lists.
+	get := func(path, key string) (*httptest.ResponseRecorder, []SQLQuery) {
+		r := httptest.NewRequest(http.MethodGet, path, nil)
+		if key != "" {
+			r.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		var view []SQLQuery
+		if w.Code == http.StatusOK {
+			if err := yaml.Unmarshal(w.Body.Bytes(), &view); err != nil {
+				t.Fatalf("%s: decoding %s: %v", path, w.Body.String(), err)
+			}
+		}
+		return w, view
+	}
+
+	for key, want := range map[string]int{"": http.StatusUnauthorized, "wrong": http.StatusUnauthorized, "scoped": http.StatusForbidden} {
+		if w, _ := get("/admin/queries/users", key); w.Code != want {
+			t.Errorf("key %q: status = %d, want %d", key, w.Code, want)
+		}
+	}
+
+	w, view := get("/admin/queries/users", "admin")
+	if w.Code != http.StatusOK || len(view) != 1 {
+		t.Fatalf("status = %d with %d queries, want 200 with the query: %s", w.Code, len(view), w.Body.String())
+	}
+	// The configuration is shown as it was loaded, with normalized types and default methods.
+	if got := view[0]; got.Name != "users" || got.Parameters["id"].Type != "INTEGER" || !reflect.DeepEqual(got.Methods, []string{"GET", "POST"}) {
+		t.Errorf("query = %+v, want users with an INTEGER id and the default methods", got)
+	}
+	if view[0].SQL != "" {
+		t.Errorf("SQL = %q, want it left out without --debug", view[0].SQL)
+	}
+
+	*debug = true
+	if _, view := get("/admin/queries/users", "admin"); len(view) != 1 || view[0].SQL != "SELECT * FROM users WHERE id = @id" {
+		t.Errorf("with --debug: queries = %+v, want the SQL included", view)
+	}
+
+	if _, view := get("/admin/queries/", "admin"); len(view) != 2 || view[0].Name != "orders" || view[1].Name != "users" {
+		t.Errorf("every query = %+v, want orders and users", view)
+	}
+	if w, _ := get("/admin/queries/missing", "admin"); w.Code != http.StatusNotFound {
+		t.Errorf("unknown query: status = %d, want 404", w.Code)
+	}
+}
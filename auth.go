@@ -0,0 +1,120 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// APIKey is a key clients present to call queries.
+type APIKey struct {
+	// The secret key value.
+	Key string `yaml:"key"`
+	// Names of the queries the key may call, or all queries when empty.
+	Queries []string `yaml:"queries"`
+}
+
+// apiKeyKey is the context key for the APIKey presented with a request.
+type apiKeyKey struct{}
+
+// apiKeys holds the accepted API keys. Authentication is disabled when it is empty.
+var apiKeys []APIKey
+
+// loadAPIKeys combines the comma-separated keys from --api_keys, which may call any query,
+// with the scoped keys listed in the YAML file at path, if any.
+func loadAPIKeys(list, path string) ([]APIKey, error) {
+	keys := []APIKey{}
+	for _, k := range strings.Split(list, ",") {
+		if k = strings.TrimSpace(k); k != "" {
+			keys = append(keys, APIKey{Key: k})
+		}
+	}
+	if path == "" {
+		return keys, nil
+	}
+
+	dat, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	scoped := []APIKey{}
+	if err := yaml.Unmarshal(dat, &scoped); err != nil {
+		return nil, err
+	}
+	for i, k := range scoped {
+		if k.Key == "" {
+			return nil, fmt.Errorf("API key %d is empty", i)
+		}
+	}
+	return append(keys, scoped...), nil
+}
+
+// allows reports whether the key may call the named query.
+func (k APIKey) allows(query string) bool {
+	if len(k.Queries) == 0 {
+		return true
+	}
+	for _, q := range k.Queries {
+		if q == query {
+			return true
+		}
+	}
+	return false
+}
+
+// allowsQuery reports whether the key may call the query at the URL name,
+// which keys allowing a query may also call by any of its aliases.
+func (k APIKey) allowsQuery(name string) bool {
+	if k.allows(name) {
+		return true
+	}
+	query, ok := lookupQuery(name)
+	return ok && k.allows(query.Name)
+}
+
+// findAPIKey returns the configured key matching the one presented by r, if any.
+func findAPIKey(r *http.Request) (APIKey, bool) {
+	presented := r.Header.Get("X-API-Key")
+	if auth := r.Header.Get("Authorization"); presented == "" && strings.HasPrefix(auth, "Bearer ") {
+		presented = strings.TrimPrefix(auth, "Bearer ")
+	}
+	if presented == "" {
+		return APIKey{}, false
+	}
+
+	for _, k := range apiKeys {
+		if subtle.ConstantTimeCompare([]byte(k.Key), []byte(presented)) == 1 {
+			return k, true
+		}
+	}
+	return APIKey{}, false
+}
+
+// authHandler requires requests to present an API key allowed to call the requested query,
+// when any keys are configured.
+func authHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if len(apiKeys) == 0 {
+			h(w, r)
+			return
+		}
+
+		key, ok := findAPIKey(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, http.StatusUnauthorized, "missing or invalid API key", nil)
+			return
+		}
+		// Any valid key may list queries or fetch the OpenAPI document, which only show the queries it may call.
+		if name := strings.TrimPrefix(r.URL.Path, *urlPath); name != "" && r.URL.Path != *openAPIPath && !key.allowsQuery(name) {
+			writeError(w, http.StatusForbidden, "API key may not call this query", nil)
+			return
+		}
+		h(w, r.WithContext(context.WithValue(r.Context(), apiKeyKey{}, key)))
+	}
+}
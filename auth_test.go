@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadAPIKeys(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.yaml")
+	if err := ioutil.WriteFile(path, []byte("- key: scoped\n  queries: [public]\n- key: other\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	got, err := loadAPIKeys(" a, ,b ", path)
+	if err != nil {
+		t.Fatalf("loadAPIKeys() error: %v", err)
+	}
+	want := []APIKey{{Key: "a"}, {Key: "b"}, {Key: "scoped", Queries: []string{"public"}}, {Key: "other"}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("loadAPIKeys() = %+v, want %+v", got, want)
+	}
+
+	if err := ioutil.WriteFile(path, []byte("- queries: [public]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadAPIKeys("", path); err == nil {
+		t.Error("loadAPIKeys() with an empty key succeeded, want an error")
+	}
+	if got, err := loadAPIKeys("", ""); err != nil || len(got) != 0 {
+		t.Errorf("loadAPIKeys() without keys = %v, %v, want none", got, err)
+	}
+}
+
+func TestAuthHandler(t *testing.T) {
+	serveQueries(t, SQLQuery{Name: "public", SQL: "SELECT 1"}, SQLQuery{Name: "private", SQL: "SELECT 1"})
+	defer func(keys []APIKey) { apiKeys = keys }(apiKeys)
+	h := authHandler(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := r.Context().Value(apiKeyKey{}).(APIKey); !ok && len(apiKeys) > 0 {
+			t.Errorf("%s: no API key in the request context", r.URL.Path)
+		}
+	})
+
+	// Without keys, authentication is disabled.
+	apiKeys = nil
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest(http.MethodGet, "/private", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("response without keys configured = %d, want 200", w.Code)
+	}
+
+	apiKeys = []APIKey{{Key: "all"}, {Key: "scoped", Queries: []string{"public"}}}
+	tests := []struct {
+		path, header, value string
+		want                int
+	}{
+		{"/public", "", "", http.StatusUnauthorized},
+		{"/public", "X-API-Key", "wrong", http.StatusUnauthorized},
+		{"/private", "X-API-Key", "all", http.StatusOK},
+		{"/private", "Authorization", "Bearer all", http.StatusOK},
+		{"/private", "Authorization", "Basic all", http.StatusUnauthorized},
+		{"/public", "X-API-Key", "scoped", http.StatusOK},
+		{"/private", "X-API-Key", "scoped", http.StatusForbidden},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.header != "" {
+			r.Header.Set(tc.header, tc.value)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != tc.want {
+			t.Errorf("%s with %s %q: status = %d, want %d", tc.path, tc.header, tc.value, w.Code, tc.want)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") != "Bearer" {
+			t.Errorf("%s with %s %q: WWW-Authenticate = %q, want Bearer", tc.path, tc.header, tc.value, w.Header().Get("WWW-Authenticate"))
+		}
+	}
+}
@@ -0,0 +1,208 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// cacheEntry is a serialized response stored in the cache.
+type cacheEntry struct {
+	header  http.Header
+	body    []byte
+	etag    string
+	expires time.Time
+
+	// The key the entry is stored under and its approximate size in memory, set when it is added.
+	key  string
+	size int64
+}
+
+// resultCache is a concurrency-safe cache of serialized query responses,
+// bounded to a maximum number of entries and total size. When full,
+// the least recently used entries are evicted.
+type resultCache struct {
+	mu         sync.Mutex
+	maxEntries int
+	maxBytes   int64
+	bytes      int64
+	// Entries from most to least recently used, with the map pointing into the list.
+	lru     *list.List
+	entries map[string]*list.Element
+}
+
+func newResultCache(maxEntries int, maxBytes int64) *resultCache {
+	return &resultCache{
+		maxEntries: maxEntries,
+		maxBytes:   maxBytes,
+		lru:        list.New(),
+		entries:    map[string]*list.Element{},
+	}
+}
+
+// get returns the unexpired entry for key, if there is one, marking it as recently used.
+func (c *resultCache) get(key string) (*cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := elem.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.remove(elem)
+		return nil, false
+	}
+	c.lru.MoveToFront(elem)
+	return e, true
+}
+
+// add stores an entry, evicting the least recently used entries until the cache is within its bounds.
+// Entries larger than the whole byte budget are not stored.
+func (c *resultCache) add(key string, e *cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e.key = key
+	e.size = entrySize(key, e)
+	if c.maxEntries <= 0 || (c.maxBytes > 0 && e.size > c.maxBytes) {
+		return
+	}
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+	c.entries[key] = c.lru.PushFront(e)
+	c.bytes += e.size
+
+	for c.lru.Len() > c.maxEntries || (c.maxBytes > 0 && c.bytes > c.maxBytes) {
+		c.remove(c.lru.Back())
+	}
+}
+
+// remove deletes an element of the LRU list, and its entry, from the cache.
+func (c *resultCache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*cacheEntry)
+	delete(c.entries, e.key)
+	c.bytes -= e.size
+}
+
+// clear removes all entries.
+func (c *resultCache) clear() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.entries = map[string]*list.Element{}
+	c.bytes = 0
+}
+
+// entrySize approximates the memory used by an entry: its key, body and headers.
+func entrySize(key string, e *cacheEntry) int64 {
+	size := len(key) + len(e.body) + len(e.etag)
+	for k, values := range e.header {
+		size += len(k)
+		for _, v := range values {
+			size += len(v)
+		}
+	}
+	return int64(size)
+}
+
+// cacheKey identifies a response by query name, output format, URL parameters and body parameters.
+func cacheKey(name string, r *http.Request, values url.Values, body map[string]interface{}) string {
+	// Both url.Values.Encode and json.Marshal sort by key, so equivalent requests share a key.
+	bodyJSON, _ := json.Marshal(body)
+	return name + "\x00" + requestFormat(r, values) + "\x00" + values.Encode() + "\x00" + string(bodyJSON)
+}
+
+// cacheControl returns the Cache-Control header value for a response which stays fresh for ttl.
+func cacheControl(ttl time.Duration) string {
+	if ttl <= 0 {
+		return "no-store"
+	}
+	return fmt.Sprintf("max-age=%d", int(ttl.Seconds()))
+}
+
+// serveCached writes a cached response, or 304 Not Modified if the client already has it.
+func serveCached(w http.ResponseWriter, r *http.Request, e *cacheEntry) {
+	if etagMatches(r, e.etag) {
+		w.Header().Set("ETag", e.etag)
+		w.Header().Set("Cache-Control", cacheControl(time.Until(e.expires)))
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	// Trailer values were recorded alongside the headers, so they are sent as headers.
+	for k, v := range e.header {
+		w.Header()[k] = v
+	}
+	// Downstream caches may only keep the response for as long as it remains in this cache.
+	w.Header().Set("Cache-Control", cacheControl(time.Until(e.expires)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(e.body)
+}
+
+// cacheRecorder passes a response through while keeping a copy of it for the cache.
+type cacheRecorder struct {
+	statusRecorder
+	body bytes.Buffer
+}
+
+func (c *cacheRecorder) Write(b []byte) (int, error) {
+	c.body.Write(b)
+	return c.statusRecorder.Write(b)
+}
+
+// entry returns a cache entry for the recorded response. Only the headers describing the
+// response itself are kept; those set by middleware, like Content-Encoding, X-Request-ID
+// and the CORS headers, depend on the request and are set again for each one.
+func (c *cacheRecorder) entry(ttl time.Duration) *cacheEntry {
+	header := http.Header{}
+	for k, v := range c.Header() {
+		if cachedHeader(k) {
+			header[k] = append([]string(nil), v...)
+		}
+	}
+	// Streamed responses could not set an ETag before their body was sent.
+	if header.Get("ETag") == "" {
+		header.Set("ETag", etag(c.body.Bytes()))
+	}
+	return &cacheEntry{
+		header:  header,
+		body:    c.body.Bytes(),
+		etag:    header.Get("ETag"),
+		expires: time.Now().Add(ttl),
+	}
+}
+
+// cachedHeader reports whether a response header is stored with cached responses.
+func cachedHeader(name string) bool {
+	switch name = http.CanonicalHeaderKey(name); name {
+	case "Content-Type", "Etag", "X-Content-Type-Options", "X-Next-Page-Token", "X-Query-Elapsed-Ms":
+		return true
+	}
+	return strings.HasPrefix(name, "X-Result-") || strings.HasPrefix(name, "X-Bigquery-")
+}
+
+// etag returns a strong entity tag for a response body.
+func etag(body []byte) string {
+	return fmt.Sprintf(`"%x"`, sha256.Sum256(body))
+}
+
+// etagMatches reports whether the If-None-Match header of r lists tag.
+// Weak tags match their strong equivalents, as the comparison is only used for GET requests.
+func etagMatches(r *http.Request, tag string) bool {
+	for _, candidate := range strings.Split(r.Header.Get("If-None-Match"), ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == tag {
+			return true
+		}
+	}
+	return false
+}
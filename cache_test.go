@@ -0,0 +1,237 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCacheRecorderHeaders(t *testing.T) {
+	w := httptest.NewRecorder()
+	// Headers set by middleware before the query handler runs.
+	w.Header().Set("X-Request-ID", "first")
+	w.Header().Set("Content-Encoding", "gzip")
+	w.Header().Set("Access-Control-Allow-Origin", "https://a.example")
+	w.Header().Add("Vary", "Origin")
+
+	rec := &cacheRecorder{statusRecorder: statusRecorder{ResponseWriter: w}}
+	rec.Header().Set("Content-Type", "application/json")
+	rec.Header().Set("X-BigQuery-Job-ID", "job")
+	rec.Header().Set("X-Result-Truncated", "true")
+	rec.Write([]byte(`[]`))
+	e := rec.entry(time.Minute)
+
+	for _, name := range []string{"X-Request-ID", "Content-Encoding", "Access-Control-Allow-Origin", "Vary"} {
+		if v := e.header.Get(name); v != "" {
+			t.Errorf("cached %s = %q, want it left out", name, v)
+		}
+	}
+	for _, name := range []string{"Content-Type", "X-BigQuery-Job-ID", "X-Result-Truncated", "ETag"} {
+		if e.header.Get(name) == "" {
+			t.Errorf("cached %s is missing", name)
+		}
+	}
+
+	replay := httptest.NewRecorder()
+	replay.Header().Set("X-Request-ID", "second")
+	serveCached(replay, httptest.NewRequest(http.MethodGet, "/", nil), e)
+	if got := replay.Header().Get("X-Request-ID"); got != "second" {
+		t.Errorf("replayed X-Request-ID = %q, want %q", got, "second")
+	}
+	if got := replay.Header().Get("Content-Encoding"); got != "" {
+		t.Errorf("replayed Content-Encoding = %q, want none", got)
+	}
+	if got := replay.Body.String(); got != `[]` {
+		t.Errorf("replayed body = %q, want %q", got, `[]`)
+	}
+}
+
+// testEntry returns an unexpired cache entry with a body of size bytes.
+func testEntry(size int) *cacheEntry {
+	return &cacheEntry{header: http.Header{}, body: make([]byte, size), expires: time.Now().Add(time.Minute)}
+}
+
+// cachedKeys returns which of keys are in the cache, without changing how recently they were used.
+func cachedKeys(c *resultCache, keys ...string) []string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	found := []string{}
+	for _, key := range keys {
+		if _, ok := c.entries[key]; ok {
+			found = append(found, key)
+		}
+	}
+	return found
+}
+
+func TestResultCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	c := newResultCache(2, 0)
+	c.add("a", testEntry(1))
+	c.add("b", testEntry(1))
+	// Reading a makes b the least recently used entry.
+	if _, ok := c.get("a"); !ok {
+		t.Fatal("get(a) missed")
+	}
+	c.add("c", testEntry(1))
+
+	if got, want := cachedKeys(c, "a", "b", "c"), []string{"a", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cached keys = %v, want %v", got, want)
+	}
+}
+
+func TestResultCacheByteBound(t *testing.T) {
+	// Entry sizes include the key, so each of these is 101 bytes.
+	c := newResultCache(10, 250)
+	c.add("a", testEntry(100))
+	c.add("b", testEntry(100))
+	c.add("c", testEntry(100))
+	if got, want := cachedKeys(c, "a", "b", "c"), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cached keys = %v, want %v", got, want)
+	}
+	if c.bytes != 202 {
+		t.Errorf("bytes = %d, want 202", c.bytes)
+	}
+
+	// An entry larger than the whole budget is not stored, and evicts nothing.
+	c.add("huge", testEntry(1000))
+	if got, want := cachedKeys(c, "b", "c", "huge"), []string{"b", "c"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("cached keys = %v, want %v", got, want)
+	}
+}
+
+func TestResultCacheReplace(t *testing.T) {
+	c := newResultCache(10, 0)
+	c.add("a", testEntry(100))
+	c.add("a", testEntry(10))
+	if c.lru.Len() != 1 || c.bytes != 11 {
+		t.Errorf("after replacing an entry: %d entries, %d bytes, want 1 entry of 11 bytes", c.lru.Len(), c.bytes)
+	}
+}
+
+func TestResultCacheExpiry(t *testing.T) {
+	c := newResultCache(10, 0)
+	e := testEntry(1)
+	e.expires = time.Now().Add(-time.Second)
+	c.add("old", e)
+	if _, ok := c.get("old"); ok {
+		t.Error("get() returned an expired entry")
+	}
+	if c.lru.Len() != 0 || c.bytes != 0 {
+		t.Errorf("expired entry was not removed: %d entries, %d bytes", c.lru.Len(), c.bytes)
+	}
+}
+
+func TestResultCacheDisabled(t *testing.T) {
+	c := newResultCache(0, 0)
+	c.add("a", testEntry(1))
+	if _, ok := c.get("a"); ok {
+		t.Error("a cache with no entries stored an entry")
+	}
+}
+
+func TestResultCacheClear(t *testing.T) {
+	c := newResultCache(10, 0)
+	c.add("a", testEntry(1))
+	c.add("b", testEntry(1))
+	c.clear()
+	if got := cachedKeys(c, "a", "b"); len(got) != 0 || c.bytes != 0 {
+		t.Errorf("after clear: keys %v, %d bytes, want none", got, c.bytes)
+	}
+}
+
+func TestResultCacheConcurrent(t *testing.T) {
+	c := newResultCache(8, 1<<10)
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				key := strconv.Itoa((i + j) % 16)
+				if _, ok := c.get(key); !ok {
+					c.add(key, testEntry(j))
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.lru.Len() > 8 || c.bytes > 1<<10 || c.lru.Len() != len(c.entries) {
+		t.Errorf("cache out of bounds: %d entries in the list, %d in the map, %d bytes", c.lru.Len(), len(c.entries), c.bytes)
+	}
+}
+
+func TestQueryHandlerETag(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	useResultCache(t)
+	serveQueries(t,
+		SQLQuery{Name: "cached", SQL: "SELECT 1 AS n", CacheTTL: time.Minute},
+		SQLQuery{Name: "uncached", SQL: "SELECT 1 AS n"},
+	)
+
+	for _, name := range []string{"cached", "uncached"} {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+		tag := w.Header().Get("ETag")
+		if w.Code != http.StatusOK || tag == "" {
+			t.Fatalf("%s: response = %d with ETag %q, want 200 with an ETag", name, w.Code, tag)
+		}
+
+		tests := []struct {
+			ifNoneMatch string
+			wantCode    int
+		}{
+			{tag, http.StatusNotModified},
+			{`"other", W/` + tag, http.StatusNotModified},
+			{`"other"`, http.StatusOK},
+		}
+		for _, tc := range tests {
+			r := httptest.NewRequest(http.MethodGet, "/"+name, nil)
+			r.Header.Set("If-None-Match", tc.ifNoneMatch)
+			w := httptest.NewRecorder()
+			queryHandler(w, r)
+			if w.Code != tc.wantCode || w.Header().Get("ETag") != tag {
+				t.Errorf("%s with If-None-Match %s: response = %d with ETag %s, want %d with ETag %s", name, tc.ifNoneMatch, w.Code, w.Header().Get("ETag"), tc.wantCode, tag)
+			}
+			if tc.wantCode == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("%s with If-None-Match %s: body = %q, want none", name, tc.ifNoneMatch, w.Body.String())
+			}
+		}
+	}
+	// The cached query only ran once; the uncached one runs for every request.
+	if got := fake.queryRuns(); got != 5 {
+		t.Errorf("queries run = %d, want 5", got)
+	}
+}
+
+func TestQueryHandlerCacheControl(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	useResultCache(t)
+	serveQueries(t,
+		SQLQuery{Name: "cached", SQL: "SELECT 1 AS n", CacheTTL: 5 * time.Minute},
+		SQLQuery{Name: "uncached", SQL: "SELECT 1 AS n"},
+	)
+
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"cached", "max-age=300"},
+		// Cached responses are only fresh for as long as they remain in the cache.
+		{"cached", "max-age=299"},
+		{"uncached", "no-store"},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/"+tc.name, nil))
+		if got := w.Header().Get("Cache-Control"); got != tc.want {
+			t.Errorf("%s: Cache-Control = %q, want %q", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/option"
+)
+
+// bqClients holds a BigQuery client for each project queries run in, including the --project flag.
+var (
+	clientsMu sync.Mutex
+	bqClients = map[string]*bigquery.Client{}
+)
+
+// clientFor returns the client for project, creating it on first use.
+func clientFor(ctx context.Context, project string) (*bigquery.Client, error) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	if c, ok := bqClients[project]; ok {
+		return c, nil
+	}
+	var opts []option.ClientOption
+	if *credentials != "" {
+		opts = append(opts, option.WithAuthCredentialsFile(option.ServiceAccount, *credentials))
+	}
+	c, err := bigquery.NewClient(ctx, project, opts...)
+	if err != nil {
+		return nil, err
+	}
+	bqClients[project] = c
+	return c, nil
+}
+
+// createClients creates the clients for every project used by queries.
+func createClients(ctx context.Context, queries map[string]SQLQuery) error {
+	for _, q := range queries {
+		if q.Project == "" {
+			continue
+		}
+		if _, err := clientFor(ctx, q.Project); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// queryClient returns the client for the project of query, defaulting to the --project flag.
+func queryClient(query SQLQuery) *bigquery.Client {
+	if query.Project == "" {
+		return bqClient
+	}
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	return bqClients[query.Project]
+}
+
+// closeClients closes every client.
+func closeClients() {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+
+	for project, c := range bqClients {
+		if err := c.Close(); err != nil {
+			slog.Error("Error closing BigQuery client", "project", project, "error", err)
+		}
+	}
+}
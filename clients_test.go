@@ -0,0 +1,39 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestQueryProject(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	// Clients are created on first use, so one already made for the project is used.
+	clientsMu.Lock()
+	bqClients["other"] = fake.client(t, "other")
+	clientsMu.Unlock()
+	defer func() {
+		clientsMu.Lock()
+		delete(bqClients, "other")
+		clientsMu.Unlock()
+	}()
+	serveQueries(t,
+		SQLQuery{Name: "default", SQL: "SELECT 1 AS n"},
+		SQLQuery{Name: "other", SQL: "SELECT 1 AS n", Project: "other"},
+	)
+	if err := createClients(context.Background(), allQueries()); err != nil {
+		t.Fatalf("createClients() error: %v", err)
+	}
+
+	for name, want := range map[string]string{"default": "project", "other": "other"} {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: response = %d %s, want 200", name, w.Code, w.Body.String())
+		}
+		if got := fake.lastRequest()["project"]; got != want {
+			t.Errorf("%s: ran in project %v, want %s", name, got, want)
+		}
+	}
+}
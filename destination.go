@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Destination materializes the results of a query into a table, which later requests read
+// instead of running the query again.
+type Destination struct {
+	// The table, as dataset.table or project.dataset.table. It is created if needed.
+	Table string `yaml:"table"`
+	// How the results are written when the query runs: truncate (the default) overwrites the table,
+	// append adds to it, and empty only writes to an empty table.
+	WriteDisposition string `yaml:"write_disposition"`
+	// How long the table is served before the query runs again, 0 to serve it for as long as it exists.
+	MaxAge time.Duration `yaml:"max_age"`
+
+	// The parsed Table, set when the query is loaded.
+	project, dataset, table string
+}
+
+// writeDispositions maps the write dispositions accepted in the queries file to BigQuery's.
+var writeDispositions = map[string]bigquery.TableWriteDisposition{
+	"":         bigquery.WriteTruncate,
+	"truncate": bigquery.WriteTruncate,
+	"append":   bigquery.WriteAppend,
+	"empty":    bigquery.WriteEmpty,
+}
+
+// prepareDestination validates and parses the destination of q, if it has one.
+func prepareDestination(q *SQLQuery) error {
+	d := q.Destination
+	if d == nil {
+		return nil
+	}
+	// The table holds a single result, which cannot vary between requests.
+	if len(q.Parameters) > 0 || len(q.Identifiers) > 0 || q.MaxLimit > 0 {
+		return fmt.Errorf("queries with a destination cannot have parameters, identifiers or limits")
+	}
+	if _, ok := writeDispositions[d.WriteDisposition]; !ok {
+		return fmt.Errorf("invalid write_disposition %q, must be truncate, append or empty", d.WriteDisposition)
+	}
+
+	parts := strings.Split(d.Table, ".")
+	switch {
+	case len(parts) == 2:
+		d.dataset, d.table = parts[0], parts[1]
+	case len(parts) == 3:
+		d.project, d.dataset, d.table = parts[0], parts[1], parts[2]
+	default:
+		return fmt.Errorf("invalid destination table %q, must be dataset.table or project.dataset.table", d.Table)
+	}
+	for _, part := range parts {
+		if part == "" {
+			return fmt.Errorf("invalid destination table %q, must be dataset.table or project.dataset.table", d.Table)
+		}
+	}
+	return nil
+}
+
+// destinationTable returns the destination table of query, in the query's project unless it names its own.
+func destinationTable(query SQLQuery) *bigquery.Table {
+	client := queryClient(query)
+	d := query.Destination
+	if d.project == "" {
+		return client.Dataset(d.dataset).Table(d.table)
+	}
+	return client.DatasetInProject(d.project, d.dataset).Table(d.table)
+}
+
+// setDestination configures q to write its results to the destination table of query.
+func setDestination(q *bigquery.Query, query SQLQuery) {
+	q.Dst = destinationTable(query)
+	q.CreateDisposition = bigquery.CreateIfNeeded
+	q.WriteDisposition = writeDispositions[query.Destination.WriteDisposition]
+}
+
+// readDestination returns an iterator over the destination table of query, if the table
+// exists and is recent enough to serve. Otherwise, the query should be run to refresh it.
+func readDestination(ctx context.Context, query SQLQuery) (*bigquery.RowIterator, bool) {
+	table := destinationTable(query)
+	md, err := table.Metadata(ctx)
+	if err != nil {
+		if !hasErrorReason(err, "notFound") {
+			slog.WarnContext(ctx, "Error reading destination table, running query", "table", query.Destination.Table, "error", err)
+		}
+		return nil, false
+	}
+	if query.Destination.MaxAge > 0 && time.Since(md.LastModifiedTime) > query.Destination.MaxAge {
+		return nil, false
+	}
+	return table.Read(ctx), true
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestPrepareDestination(t *testing.T) {
+	tests := []struct {
+		query   SQLQuery
+		want    [3]string
+		wantErr string
+	}{
+		{SQLQuery{Destination: &Destination{Table: "reports.daily"}}, [3]string{"", "reports", "daily"}, ""},
+		{SQLQuery{Destination: &Destination{Table: "other.reports.daily", WriteDisposition: "append"}}, [3]string{"other", "reports", "daily"}, ""},
+		{SQLQuery{Destination: &Destination{Table: "daily"}}, [3]string{}, `invalid destination table "daily", must be dataset.table or project.dataset.table`},
+		{SQLQuery{Destination: &Destination{Table: "reports."}}, [3]string{}, `invalid destination table "reports.", must be dataset.table or project.dataset.table`},
+		{SQLQuery{Destination: &Destination{Table: "reports.daily", WriteDisposition: "replace"}}, [3]string{}, `invalid write_disposition "replace", must be truncate, append or empty`},
+		{SQLQuery{Destination: &Destination{Table: "reports.daily"}, Parameters: map[string]Parameter{"id": {}}}, [3]string{}, "queries with a destination cannot have parameters, identifiers or limits"},
+	}
+	for _, tc := range tests {
+		err := prepareDestination(&tc.query)
+		if got := errString(err); got != tc.wantErr {
+			t.Errorf("prepareDestination(%+v) error = %q, want %q", *tc.query.Destination, got, tc.wantErr)
+			continue
+		}
+		d := tc.query.Destination
+		if got := [3]string{d.project, d.dataset, d.table}; err == nil && got != tc.want {
+			t.Errorf("prepareDestination(%q) = %q, want %q", d.Table, got, tc.want)
+		}
+	}
+}
+
+func TestSetDestination(t *testing.T) {
+	newFakeBigQuery(t, nil, nil)
+	for disposition, want := range map[string]bigquery.TableWriteDisposition{
+		"":         bigquery.WriteTruncate,
+		"append":   bigquery.WriteAppend,
+		"empty":    bigquery.WriteEmpty,
+		"truncate": bigquery.WriteTruncate,
+	} {
+		query := SQLQuery{Destination: &Destination{Table: "other.reports.daily", WriteDisposition: disposition}}
+		if err := prepareDestination(&query); err != nil {
+			t.Fatal(err)
+		}
+		q := bqClient.Query("SELECT 1")
+		setDestination(q, query)
+		if q.Dst.ProjectID != "other" || q.Dst.DatasetID != "reports" || q.Dst.TableID != "daily" {
+			t.Errorf("destination = %s.%s.%s, want other.reports.daily", q.Dst.ProjectID, q.Dst.DatasetID, q.Dst.TableID)
+		}
+		if q.CreateDisposition != bigquery.CreateIfNeeded || q.WriteDisposition != want {
+			t.Errorf("write_disposition %q: dispositions = %s, %s, want %s, %s", disposition, q.CreateDisposition, q.WriteDisposition, bigquery.CreateIfNeeded, want)
+		}
+	}
+}
+
+func TestQueryHandlerDestination(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{Name: "daily", SQL: "SELECT 1 AS n", Destination: &Destination{Table: "reports.daily", MaxAge: time.Hour}})
+
+	// The table doesn't exist yet, so the query runs to create it.
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/daily", nil))
+	if w.Code != http.StatusOK || fake.queryRuns() != 1 {
+		t.Fatalf("response = %d %s after %d queries, want 200 after running the query", w.Code, w.Body.String(), fake.queryRuns())
+	}
+	req := fake.lastRequest()
+	want := map[string]interface{}{"projectId": "project", "datasetId": "reports", "tableId": "daily"}
+	if got := req["destinationTable"]; !reflect.DeepEqual(got, want) {
+		t.Errorf("destinationTable = %v, want %v", got, want)
+	}
+	if req["createDisposition"] != "CREATE_IF_NEEDED" || req["writeDisposition"] != "WRITE_TRUNCATE" {
+		t.Errorf("dispositions = %v, %v, want CREATE_IF_NEEDED, WRITE_TRUNCATE", req["createDisposition"], req["writeDisposition"])
+	}
+}
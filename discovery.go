@@ -0,0 +1,325 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// queryInfo describes a query in the query listing, without its SQL.
+type queryInfo struct {
+	Name        string           `json:"name"`
+	Aliases     []string         `json:"aliases,omitempty"`
+	Parameters  []parameterInfo  `json:"parameters"`
+	Identifiers []identifierInfo `json:"identifiers,omitempty"`
+	Schema      []SchemaField    `json:"schema,omitempty"`
+	Session     bool             `json:"session,omitempty"`
+}
+
+// identifierInfo describes a query identifier in the query listing.
+type identifierInfo struct {
+	Name    string   `json:"name"`
+	Allowed []string `json:"allowed"`
+	Default string   `json:"default,omitempty"`
+}
+
+// parameterInfo describes a query parameter in the query listing.
+type parameterInfo struct {
+	Name      string             `json:"name"`
+	Type      bigquery.FieldType `json:"type"`
+	Required  bool               `json:"required"`
+	Repeated  bool               `json:"repeated"`
+	Nullable  bool               `json:"nullable"`
+	Default   *string            `json:"default,omitempty"`
+	Pattern   string             `json:"pattern,omitempty"`
+	Min       *float64           `json:"min,omitempty"`
+	Max       *float64           `json:"max,omitempty"`
+	Transform string             `json:"transform,omitempty"`
+	Fields    []parameterInfo    `json:"fields,omitempty"`
+}
+
+// proxyHandler serves the query listing at the URL path root and queries below it.
+// The listing is not found when --disable_discovery is set.
+func proxyHandler(w http.ResponseWriter, r *http.Request) {
+	if strings.TrimPrefix(r.URL.Path, *urlPath) == "" {
+		if *noDiscovery {
+			writeError(w, http.StatusNotFound, "not found", nil)
+			return
+		}
+		listHandler(w, r)
+		return
+	}
+	queryHandler(w, r)
+}
+
+// listHandler writes a JSON description of the queries the caller may run.
+func listHandler(w http.ResponseWriter, r *http.Request) {
+	key, hasKey := r.Context().Value(apiKeyKey{}).(APIKey)
+
+	infos := []queryInfo{}
+	for name, query := range allQueries() {
+		// Aliases are listed with the query they refer to.
+		if name != query.Name {
+			continue
+		}
+		if hasKey && !key.allows(name) {
+			continue
+		}
+		infos = append(infos, describeQuery(query))
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(infos)
+}
+
+// describeQuery returns the listing entry for query.
+func describeQuery(query SQLQuery) queryInfo {
+	info := queryInfo{Name: query.Name, Aliases: query.Aliases, Parameters: []parameterInfo{}, Session: query.Session}
+	info.Parameters = describeParameters(query.Parameters)
+	for name, ident := range query.Identifiers {
+		info.Identifiers = append(info.Identifiers, identifierInfo{
+			Name:    name,
+			Allowed: ident.Allowed,
+			Default: ident.Default,
+		})
+	}
+	sort.Slice(info.Identifiers, func(i, j int) bool { return info.Identifiers[i].Name < info.Identifiers[j].Name })
+	for _, field := range query.Schema {
+		// Clients see fields under the names they are written with.
+		field.Name = fieldKey(field.Name)
+		info.Schema = append(info.Schema, field)
+	}
+	return info
+}
+
+// describeParameters returns the listing entries for params, sorted by name.
+func describeParameters(params map[string]Parameter) []parameterInfo {
+	infos := []parameterInfo{}
+	for name, param := range params {
+		info := parameterInfo{
+			Name:      name,
+			Type:      param.Type,
+			Required:  param.Required,
+			Repeated:  param.Repeated,
+			Nullable:  param.Nullable,
+			Default:   param.Default,
+			Pattern:   param.Pattern,
+			Min:       param.Min,
+			Max:       param.Max,
+			Transform: param.Transform,
+		}
+		if len(param.Fields) > 0 {
+			info.Fields = describeParameters(param.Fields)
+		}
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+// openAPIParameter is an OpenAPI 3.0 parameter object.
+type openAPIParameter struct {
+	Name     string                 `json:"name"`
+	In       string                 `json:"in"`
+	Required bool                   `json:"required"`
+	Schema   map[string]interface{} `json:"schema"`
+}
+
+// openAPIOperation is an OpenAPI 3.0 operation object.
+type openAPIOperation struct {
+	OperationID string                 `json:"operationId"`
+	Parameters  []openAPIParameter     `json:"parameters"`
+	Responses   map[string]interface{} `json:"responses"`
+}
+
+// openAPIHandler writes an OpenAPI 3.0 document describing the queries the caller may run.
+func openAPIHandler(w http.ResponseWriter, r *http.Request) {
+	key, hasKey := r.Context().Value(apiKeyKey{}).(APIKey)
+
+	queries := map[string]SQLQuery{}
+	for name, query := range allQueries() {
+		if hasKey && !key.allows(query.Name) {
+			continue
+		}
+		queries[name] = query
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(openAPIDocument(queries))
+}
+
+// openAPIDocument builds an OpenAPI 3.0 document with a GET operation for each query.
+func openAPIDocument(queries map[string]SQLQuery) map[string]interface{} {
+	paths := map[string]interface{}{}
+	for name, query := range queries {
+		info := describeQuery(query)
+		op := openAPIOperation{
+			OperationID: name,
+			Parameters:  []openAPIParameter{},
+			Responses:   openAPIResponses(info.Schema),
+		}
+		if query.ContentType != "" {
+			op.Responses = map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "The text of the query result.",
+					"content": map[string]interface{}{
+						query.ContentType: map[string]interface{}{"schema": map[string]interface{}{"type": "string"}},
+					},
+				},
+			}
+		}
+		for _, param := range info.Parameters {
+			op.Parameters = append(op.Parameters, openAPIParameter{
+				Name:     param.Name,
+				In:       "query",
+				Required: param.Required,
+				Schema:   openAPIParameterSchema(param),
+			})
+		}
+		for _, ident := range info.Identifiers {
+			schema := map[string]interface{}{"type": "string", "enum": ident.Allowed}
+			if ident.Default != "" {
+				schema["default"] = ident.Default
+			}
+			op.Parameters = append(op.Parameters, openAPIParameter{
+				Name:     ident.Name,
+				In:       "query",
+				Required: ident.Default == "",
+				Schema:   schema,
+			})
+		}
+		if query.MaxLimit > 0 {
+			limit := map[string]interface{}{"type": "integer", "minimum": 0, "maximum": query.MaxLimit}
+			if query.DefaultLimit > 0 {
+				limit["default"] = query.DefaultLimit
+			}
+			offset := map[string]interface{}{"type": "integer", "minimum": 0}
+			if query.MaxOffset > 0 {
+				offset["maximum"] = query.MaxOffset
+			}
+			op.Parameters = append(op.Parameters,
+				openAPIParameter{Name: limitParam, In: "query", Schema: limit},
+				openAPIParameter{Name: offsetParam, In: "query", Schema: offset},
+			)
+		}
+		ops := map[string]interface{}{}
+		for _, method := range query.Methods {
+			methodOp := op
+			// Operation IDs must be unique across the document.
+			if method != http.MethodGet {
+				methodOp.OperationID = name + "-" + strings.ToLower(method)
+			}
+			ops[strings.ToLower(method)] = methodOp
+		}
+		paths[*urlPath+name] = ops
+	}
+
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info": map[string]interface{}{
+			"title":   "bqproxy",
+			"version": "1.0",
+		},
+		"paths": paths,
+	}
+}
+
+// openAPIResponses returns the OpenAPI responses of a query, describing its rows if it declares a schema.
+func openAPIResponses(schema []SchemaField) map[string]interface{} {
+	row := map[string]interface{}{"type": "object"}
+	if len(schema) > 0 {
+		properties := map[string]interface{}{}
+		for _, field := range schema {
+			prop := openAPISchema(field.Type)
+			switch {
+			case field.Type == bigquery.RecordFieldType:
+				prop = map[string]interface{}{"type": "object"}
+			case field.Type == bigquery.IntegerFieldType && *int64AsString:
+				prop = map[string]interface{}{"type": "string", "format": "int64"}
+			}
+			if field.Repeated {
+				prop = map[string]interface{}{"type": "array", "items": prop}
+			}
+			properties[field.Name] = prop
+		}
+		row["properties"] = properties
+	}
+	return map[string]interface{}{
+		"200": map[string]interface{}{
+			"description": "Query results, one object per row.",
+			"content": map[string]interface{}{
+				"application/json": map[string]interface{}{
+					"schema": map[string]interface{}{
+						"type":  "array",
+						"items": row,
+					},
+				},
+			},
+		},
+	}
+}
+
+// openAPIParameterSchema returns the OpenAPI schema for a parameter, including its options and fields.
+func openAPIParameterSchema(param parameterInfo) map[string]interface{} {
+	schema := openAPISchema(param.Type)
+	if len(param.Fields) > 0 {
+		properties := map[string]interface{}{}
+		required := []string{}
+		for _, field := range param.Fields {
+			properties[field.Name] = openAPIParameterSchema(field)
+			if field.Required {
+				required = append(required, field.Name)
+			}
+		}
+		schema = map[string]interface{}{"type": "object", "properties": properties}
+		if len(required) > 0 {
+			schema["required"] = required
+		}
+	}
+	if param.Default != nil {
+		schema["default"] = *param.Default
+	}
+	if param.Pattern != "" {
+		schema["pattern"] = param.Pattern
+	}
+	if param.Nullable {
+		schema["nullable"] = true
+	}
+	if param.Min != nil {
+		schema["minimum"] = *param.Min
+	}
+	if param.Max != nil {
+		schema["maximum"] = *param.Max
+	}
+	if param.Repeated {
+		schema = map[string]interface{}{"type": "array", "items": schema}
+	}
+	return schema
+}
+
+// openAPISchema returns the OpenAPI schema for a parameter of the given BigQuery type.
+func openAPISchema(fieldType bigquery.FieldType) map[string]interface{} {
+	switch fieldType {
+	case bigquery.IntegerFieldType:
+		return map[string]interface{}{"type": "integer", "format": "int64"}
+	case bigquery.FloatFieldType:
+		return map[string]interface{}{"type": "number", "format": "double"}
+	case bigquery.BooleanFieldType:
+		return map[string]interface{}{"type": "boolean"}
+	case bigquery.TimestampFieldType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case bigquery.DateFieldType:
+		return map[string]interface{}{"type": "string", "format": "date"}
+	case bigquery.BytesFieldType:
+		return map[string]interface{}{"type": "string", "format": "byte"}
+	case bigquery.NumericFieldType:
+		return map[string]interface{}{"type": "string", "format": "decimal"}
+	case bigquery.IntervalFieldType:
+		return map[string]interface{}{"type": "string", "format": "duration"}
+	}
+	return map[string]interface{}{"type": "string"}
+}
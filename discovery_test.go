@@ -0,0 +1,120 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestListHandler(t *testing.T) {
+	defer setQueries(allQueries())
+	setQueries(map[string]SQLQuery{
+		"users": {
+			Name: "users",
+			SQL:  "SELECT * FROM secret.users WHERE id = @id",
+			Parameters: map[string]Parameter{
+				"id":   {Type: "INTEGER", Required: true},
+				"name": {Type: "STRING"},
+			},
+		},
+	})
+
+	w := httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest(http.MethodGet, *urlPath, nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "secret.users") {
+		t.Errorf("listing %s contains the query's SQL", w.Body.String())
+	}
+	var got []queryInfo
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding listing: %v", err)
+	}
+	want := []queryInfo{{
+		Name: "users",
+		Parameters: []parameterInfo{
+			{Name: "id", Type: "INTEGER", Required: true},
+			{Name: "name", Type: "STRING"},
+		},
+	}}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("listing = %+v, want %+v", got, want)
+	}
+}
+
+func TestListHandlerDisabled(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{Name: "numbers", SQL: "SELECT n"})
+	defer func(v bool) { *noDiscovery = v }(*noDiscovery)
+	*noDiscovery = true
+
+	w := httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest(http.MethodGet, *urlPath, nil))
+	if w.Code != http.StatusNotFound || strings.Contains(w.Body.String(), "numbers") {
+		t.Errorf("listing: response = %d %s, want 404 without the queries", w.Code, w.Body.String())
+	}
+	// Queries are still served.
+	w = httptest.NewRecorder()
+	proxyHandler(w, httptest.NewRequest(http.MethodGet, *urlPath+"numbers", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("query: status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+}
+
+func TestOpenAPIHandlerScopedKey(t *testing.T) {
+	defer setQueries(allQueries())
+	defer func(keys []APIKey) { apiKeys = keys }(apiKeys)
+
+	setQueries(map[string]SQLQuery{
+		"public":  {Name: "public", Methods: []string{http.MethodGet}},
+		"p":       {Name: "public", Methods: []string{http.MethodGet}},
+		"private": {Name: "private", Methods: []string{http.MethodGet}},
+	})
+	apiKeys = []APIKey{{Key: "all"}, {Key: "scoped", Queries: []string{"public"}}}
+	h := authHandler(openAPIHandler)
+
+	tests := []struct {
+		key       string
+		wantCode  int
+		wantPaths []string
+	}{
+		{"", http.StatusUnauthorized, nil},
+		{"all", http.StatusOK, []string{"/p", "/private", "/public"}},
+		{"scoped", http.StatusOK, []string{"/p", "/public"}},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, *openAPIPath, nil)
+		if tc.key != "" {
+			r.Header.Set("X-API-Key", tc.key)
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		if w.Code != tc.wantCode {
+			t.Errorf("key %q: status = %d, want %d", tc.key, w.Code, tc.wantCode)
+			continue
+		}
+		if tc.wantCode != http.StatusOK {
+			continue
+		}
+		var doc struct {
+			Paths map[string]interface{} `json:"paths"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+			t.Fatalf("key %q: decoding document: %v", tc.key, err)
+		}
+		paths := []string{}
+		for path := range doc.Paths {
+			paths = append(paths, path)
+		}
+		sort.Strings(paths)
+		if !reflect.DeepEqual(paths, tc.wantPaths) {
+			t.Errorf("key %q: paths = %v, want %v", tc.key, paths, tc.wantPaths)
+		}
+	}
+}
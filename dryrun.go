@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// dryRunResponse is the JSON body written for dry run requests.
+type dryRunResponse struct {
+	TotalBytesProcessed int64 `json:"totalBytesProcessed"`
+}
+
+// dryRun validates q without executing it, writing the number of bytes it would process.
+// Any error has already been written to the response when it is returned.
+func dryRun(ctx context.Context, w http.ResponseWriter, q *bigquery.Query) error {
+	q.DryRun = true
+	job, err := q.Run(ctx)
+	if err != nil {
+		writeQueryError(ctx, w, "dry run failed", err)
+		return err
+	}
+
+	resp := dryRunResponse{}
+	if status := job.LastStatus(); status != nil && status.Statistics != nil {
+		resp.TotalBytesProcessed = status.Statistics.TotalBytesProcessed
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestDryRun(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{Name: "estimate", SQL: "SELECT 1 AS n"})
+
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/estimate?dryRun=true", nil))
+	// The fake BigQuery API reports 10 bytes processed for every query.
+	if want := "{\"totalBytesProcessed\":10}\n"; w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("response = %d %q, want 200 %q", w.Code, w.Body.String(), want)
+	}
+	if got := fake.lastRequest()["dryRun"]; got != true {
+		t.Errorf("dryRun = %v, want true", got)
+	}
+	if got := fake.queryRuns(); got != 0 {
+		t.Errorf("queries run = %d, want 0", got)
+	}
+
+	fake.fail(1, fakeError{code: http.StatusBadRequest, reason: "invalidQuery", message: "Syntax error"})
+	w = httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/estimate?dryRun=true", nil))
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), "dry run failed") {
+		t.Errorf("response to a failed dry run = %d %s, want 500 dry run failed", w.Code, w.Body.String())
+	}
+}
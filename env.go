@@ -0,0 +1,30 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+// envFlags maps flags to the environment variables they fall back to when not set on the command line.
+var envFlags = map[string]string{
+	"project": "GOOGLE_CLOUD_PROJECT",
+}
+
+// applyEnv sets the flags of fs which weren't given on the command line from their environment
+// variables, looked up with lookup, so flags take precedence over the environment and the
+// environment over the flags' defaults. Empty variables are ignored.
+func applyEnv(fs *flag.FlagSet, lookup func(string) (string, bool)) error {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) { set[f.Name] = true })
+	for name, env := range envFlags {
+		if set[name] {
+			continue
+		}
+		if value, ok := lookup(env); ok && value != "" {
+			if err := fs.Set(name, value); err != nil {
+				return fmt.Errorf("invalid $%s for --%s: %v", env, name, err)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"flag"
+	"testing"
+)
+
+func TestApplyEnv(t *testing.T) {
+	tests := []struct {
+		args []string
+		env  map[string]string
+		want string
+	}{
+		{nil, nil, "default"},
+		{nil, map[string]string{"GOOGLE_CLOUD_PROJECT": ""}, "default"},
+		{nil, map[string]string{"GOOGLE_CLOUD_PROJECT": "from-env"}, "from-env"},
+		{[]string{"--project=from-flag"}, map[string]string{"GOOGLE_CLOUD_PROJECT": "from-env"}, "from-flag"},
+		// A flag set on the command line wins even when it is empty.
+		{[]string{"--project="}, map[string]string{"GOOGLE_CLOUD_PROJECT": "from-env"}, ""},
+	}
+	for _, tc := range tests {
+		fs := flag.NewFlagSet("test", flag.ContinueOnError)
+		project := fs.String("project", "default", "")
+		if err := fs.Parse(tc.args); err != nil {
+			t.Fatalf("Parse(%q) error: %v", tc.args, err)
+		}
+		lookup := func(key string) (string, bool) {
+			v, ok := tc.env[key]
+			return v, ok
+		}
+		if err := applyEnv(fs, lookup); err != nil {
+			t.Errorf("applyEnv(%q, %v) error: %v", tc.args, tc.env, err)
+			continue
+		}
+		if *project != tc.want {
+			t.Errorf("applyEnv(%q, %v): project = %q, want %q", tc.args, tc.env, *project, tc.want)
+		}
+	}
+}
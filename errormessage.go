@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"text/template"
+)
+
+// errorMessageData is the data available to a query's error_message template.
+type errorMessageData struct {
+	// The name of the query.
+	Query string
+	// The HTTP status of the response.
+	Status int
+	// The message which would otherwise have been written.
+	Message string
+	// The name of the first invalid parameter, for responses to invalid parameters.
+	Param string
+}
+
+// prepareErrorMessage compiles the error_message template of q, checking it can be executed.
+func prepareErrorMessage(q *SQLQuery) error {
+	if q.ErrorMessage == "" {
+		return nil
+	}
+	tmpl, err := template.New(q.Name).Option("missingkey=error").Parse(q.ErrorMessage)
+	if err != nil {
+		return fmt.Errorf("invalid error_message: %v", err)
+	}
+	if err := tmpl.Execute(&strings.Builder{}, errorMessageData{}); err != nil {
+		return fmt.Errorf("invalid error_message: %v", err)
+	}
+	q.errorTemplate = tmpl
+	return nil
+}
+
+// errorMessageWriter replaces the messages of error responses for a query with its error_message.
+type errorMessageWriter struct {
+	http.ResponseWriter
+	query SQLQuery
+}
+
+func (e *errorMessageWriter) Unwrap() http.ResponseWriter { return e.ResponseWriter }
+
+func (e *errorMessageWriter) Flush() {
+	if f, ok := e.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// message returns the query's error message for a response, or msg if it can't be rendered.
+func (e *errorMessageWriter) message(status int, msg, param string) string {
+	var b strings.Builder
+	data := errorMessageData{Query: e.query.Name, Status: status, Message: msg, Param: param}
+	if err := e.query.errorTemplate.Execute(&b, data); err != nil {
+		return msg
+	}
+	return b.String()
+}
+
+// errorMessage returns the message for an error response written to w, which is msg unless
+// w wraps an errorMessageWriter.
+func errorMessage(w http.ResponseWriter, status int, msg, param string) string {
+	for w != nil {
+		if e, ok := w.(*errorMessageWriter); ok {
+			return e.message(status, msg, param)
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			break
+		}
+		w = u.Unwrap()
+	}
+	return msg
+}
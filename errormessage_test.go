@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestErrorMessageStreaming(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}, {"2"}})
+	serveQueries(t, SQLQuery{
+		Name:         "numbers",
+		SQL:          "SELECT n FROM UNNEST(GENERATE_ARRAY(1, 2)) AS n",
+		ErrorMessage: "{{.Query}} is unavailable",
+	})
+
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/numbers?format=ndjson", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if !w.Flushed {
+		t.Error("ndjson rows were not flushed through the error message writer")
+	}
+	if got := strings.Count(w.Body.String(), "\n"); got != 2 {
+		t.Errorf("body = %q, want 2 rows", w.Body.String())
+	}
+}
+
+func TestErrorMessage(t *testing.T) {
+	q := SQLQuery{Name: "lookup", ErrorMessage: "{{.Query}} failed with {{.Status}}{{if .Param}} on {{.Param}}{{end}}"}
+	if err := prepareErrorMessage(&q); err != nil {
+		t.Fatal(err)
+	}
+	w := &statusRecorder{ResponseWriter: &errorMessageWriter{ResponseWriter: httptest.NewRecorder(), query: q}}
+
+	tests := []struct {
+		status int
+		msg    string
+		param  string
+		want   string
+	}{
+		{http.StatusBadRequest, "bad id", "id", "lookup failed with 400 on id"},
+		{http.StatusInternalServerError, "query failed", "", "lookup failed with 500"},
+	}
+	for _, tc := range tests {
+		if got := errorMessage(w, tc.status, tc.msg, tc.param); got != tc.want {
+			t.Errorf("errorMessage(%d, %q, %q) = %q, want %q", tc.status, tc.msg, tc.param, got, tc.want)
+		}
+	}
+	if got := errorMessage(httptest.NewRecorder(), http.StatusBadRequest, "bad id", "id"); got != "bad id" {
+		t.Errorf("errorMessage() without a template = %q, want the message unchanged", got)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// explainResponse is the JSON body written for explain requests.
+type explainResponse struct {
+	JobID               string         `json:"jobId"`
+	TotalBytesProcessed int64          `json:"totalBytesProcessed"`
+	SlotMs              int64          `json:"slotMs"`
+	CacheHit            bool           `json:"cacheHit"`
+	Stages              []explainStage `json:"stages"`
+}
+
+// explainStage describes a stage of a query plan, with the time its workers spent in each phase.
+type explainStage struct {
+	ID                 int64         `json:"id"`
+	Name               string        `json:"name"`
+	Status             string        `json:"status"`
+	InputStages        []int64       `json:"inputStages,omitempty"`
+	DurationMs         int64         `json:"durationMs"`
+	WaitMsAvg          int64         `json:"waitMsAvg"`
+	WaitMsMax          int64         `json:"waitMsMax"`
+	ReadMsAvg          int64         `json:"readMsAvg"`
+	ReadMsMax          int64         `json:"readMsMax"`
+	ComputeMsAvg       int64         `json:"computeMsAvg"`
+	ComputeMsMax       int64         `json:"computeMsMax"`
+	WriteMsAvg         int64         `json:"writeMsAvg"`
+	WriteMsMax         int64         `json:"writeMsMax"`
+	RecordsRead        int64         `json:"recordsRead"`
+	RecordsWritten     int64         `json:"recordsWritten"`
+	ShuffleOutputBytes int64         `json:"shuffleOutputBytes"`
+	Steps              []explainStep `json:"steps"`
+}
+
+// explainStep is one of the operations run by a query plan stage.
+type explainStep struct {
+	Kind     string   `json:"kind"`
+	Substeps []string `json:"substeps"`
+}
+
+// explain runs q and writes its query plan instead of its results.
+// Any error has already been written to the response when it is returned.
+func explain(ctx context.Context, w http.ResponseWriter, q *bigquery.Query) error {
+	var status *bigquery.JobStatus
+	var job *bigquery.Job
+	err := withRetry(ctx, func() error {
+		var err error
+		if job, err = q.Run(ctx); err != nil {
+			return err
+		}
+		if status, err = job.Wait(ctx); err != nil {
+			return err
+		}
+		// Wait succeeds even if the job failed.
+		return status.Err()
+	})
+	if err != nil {
+		writeQueryError(ctx, w, "query failed", err)
+		return err
+	}
+
+	resp := explainResponse{JobID: job.ID(), Stages: []explainStage{}}
+	if status.Statistics != nil {
+		resp.TotalBytesProcessed = status.Statistics.TotalBytesProcessed
+		if details, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok {
+			resp.SlotMs = details.SlotMillis
+			resp.CacheHit = details.CacheHit
+			for _, stage := range details.QueryPlan {
+				resp.Stages = append(resp.Stages, describeStage(stage))
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	return json.NewEncoder(w).Encode(resp)
+}
+
+// describeStage converts a query plan stage from the job statistics.
+func describeStage(stage *bigquery.ExplainQueryStage) explainStage {
+	s := explainStage{
+		ID:                 stage.ID,
+		Name:               stage.Name,
+		Status:             stage.Status,
+		InputStages:        stage.InputStages,
+		WaitMsAvg:          stage.WaitAvg.Milliseconds(),
+		WaitMsMax:          stage.WaitMax.Milliseconds(),
+		ReadMsAvg:          stage.ReadAvg.Milliseconds(),
+		ReadMsMax:          stage.ReadMax.Milliseconds(),
+		ComputeMsAvg:       stage.ComputeAvg.Milliseconds(),
+		ComputeMsMax:       stage.ComputeMax.Milliseconds(),
+		WriteMsAvg:         stage.WriteAvg.Milliseconds(),
+		WriteMsMax:         stage.WriteMax.Milliseconds(),
+		RecordsRead:        stage.RecordsRead,
+		RecordsWritten:     stage.RecordsWritten,
+		ShuffleOutputBytes: stage.ShuffleOutputBytes,
+		Steps:              []explainStep{},
+	}
+	if !stage.StartTime.IsZero() && !stage.EndTime.IsZero() {
+		s.DurationMs = stage.EndTime.Sub(stage.StartTime).Milliseconds()
+	}
+	for _, step := range stage.Steps {
+		s.Steps = append(s.Steps, explainStep{Kind: step.Kind, Substeps: step.Substeps})
+	}
+	return s
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useResultCache gives the test an empty result cache, restoring the previous one when it ends.
+func useResultCache(tb testing.TB) {
+	prev := results
+	results = newResultCache(10, 0)
+	tb.Cleanup(func() { results = prev })
+}
+
+func TestDryRunAndExplainNotCached(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	useResultCache(t)
+	serveQueries(t, SQLQuery{Name: "cached", SQL: "SELECT 1 AS n", CacheTTL: time.Minute})
+
+	for _, url := range []string{"/cached?dryRun=true", "/cached?explain=true"} {
+		for i := 0; i < 2; i++ {
+			w := httptest.NewRecorder()
+			queryHandler(w, httptest.NewRequest(http.MethodGet, url, nil))
+			if w.Code != http.StatusOK {
+				t.Fatalf("%s: status = %d, want 200: %s", url, w.Code, w.Body.String())
+			}
+			if got := w.Header().Get("Cache-Control"); got != "no-store" {
+				t.Errorf("%s: Cache-Control = %q, want no-store", url, got)
+			}
+		}
+	}
+	if got := results.lru.Len(); got != 0 {
+		t.Errorf("cached responses = %d, want none", got)
+	}
+	// Both explain requests ran the query, as neither was served from the cache.
+	if got := fake.queryRuns(); got != 2 {
+		t.Errorf("queries run = %d, want 2", got)
+	}
+
+	// Results are still cached.
+	for i := 0; i < 2; i++ {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/cached", nil))
+		if got := w.Header().Get("Cache-Control"); !strings.HasPrefix(got, "max-age=") {
+			t.Errorf("results: Cache-Control = %q, want a max-age", got)
+		}
+	}
+	if got := fake.queryRuns(); got != 3 {
+		t.Errorf("queries run = %d, want 3 after requesting the results twice", got)
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/option"
+)
+
+// fakeBigQuery serves the parts of the BigQuery REST API used to run a query and read its results,
+// answering every query with the same rows. It counts the queries it runs, not including dry runs,
+// and records the labels of those run through jobs.query.
+type fakeBigQuery struct {
+	server *httptest.Server
+	// The schema of every result, in the REST API's JSON form, and its rows. Cells are strings,
+	// nil for NULL, or []interface{} for the elements of a repeated field.
+	schema []map[string]string
+	rows   [][]interface{}
+
+	mu     sync.Mutex
+	runs   int
+	labels []map[string]string
+	// The queries run, most recent last, as the bodies of jobs.query requests with the project from
+	// the URL added. Those of jobs.insert requests are flattened to the same form: their query
+	// configuration with the labels, dryRun and location.
+	requests []map[string]interface{}
+	// How long queries take to run, or until the request is cancelled.
+	delay time.Duration
+	// How many of the next queries fail, -1 for all of them, and the error they fail with.
+	failures int
+	failure  fakeError
+	// The most rows returned in a page of results, or 0 for no limit.
+	pageSize int
+	// The error reading pages of results after the first fails with, if any.
+	readFailure *fakeError
+}
+
+// fakeError is an error response of the BigQuery API.
+type fakeError struct {
+	code            int
+	reason, message string
+}
+
+// newFakeBigQuery starts a fake BigQuery API and points the default client at it until the test ends.
+func newFakeBigQuery(tb testing.TB, schema []map[string]string, rows [][]interface{}) *fakeBigQuery {
+	f := &fakeBigQuery{schema: schema, rows: rows}
+	f.server = httptest.NewServer(http.HandlerFunc(f.serve))
+
+	tb.Cleanup(f.server.Close)
+	prev := bqClient
+	bqClient = f.client(tb, "project")
+	tb.Cleanup(func() { bqClient = prev })
+	return f
+}
+
+// client returns a client of the fake API which runs queries in project, closed when the test ends.
+func (f *fakeBigQuery) client(tb testing.TB, project string) *bigquery.Client {
+	client, err := bigquery.NewClient(context.Background(), project,
+		option.WithEndpoint(f.server.URL), option.WithoutAuthentication(), option.WithHTTPClient(f.server.Client()))
+	if err != nil {
+		tb.Fatalf("bigquery.NewClient() error: %v", err)
+	}
+	tb.Cleanup(func() { client.Close() })
+	return client
+}
+
+// setDelay makes queries take d to run, or until the request is cancelled.
+func (f *fakeBigQuery) setDelay(d time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.delay = d
+}
+
+// setPageSize limits pages of results to n rows.
+func (f *fakeBigQuery) setPageSize(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.pageSize = n
+}
+
+// failReads makes reading pages of results after the first fail with err.
+func (f *fakeBigQuery) failReads(err fakeError) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.readFailure = &err
+}
+
+// fail makes the next times queries, including dry runs, and job lookups fail with an error response.
+// A times of -1 fails them all.
+func (f *fakeBigQuery) fail(times int, err fakeError) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.failures, f.failure = times, err
+}
+
+// writeFailure writes an error response if the query being run should fail, reporting whether it did.
+func (f *fakeBigQuery) writeFailure(w http.ResponseWriter) bool {
+	f.mu.Lock()
+	if f.failures == 0 {
+		f.mu.Unlock()
+		return false
+	}
+	if f.failures > 0 {
+		f.failures--
+	}
+	e := f.failure
+	f.mu.Unlock()
+
+	writeFakeError(w, e)
+	return true
+}
+
+// writeFakeError writes e as an error response of the BigQuery API.
+func writeFakeError(w http.ResponseWriter, e fakeError) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(e.code)
+	json.NewEncoder(w).Encode(map[string]interface{}{"error": map[string]interface{}{
+		"code":    e.code,
+		"message": e.message,
+		"errors":  []map[string]string{{"reason": e.reason, "message": e.message}},
+	}})
+}
+
+// record adds the query run by r to the requests made, returning the body of r.
+func (f *fakeBigQuery) record(r *http.Request) []byte {
+	body, _ := ioutil.ReadAll(r.Body)
+	var req map[string]interface{}
+	json.Unmarshal(body, &req)
+	if config, ok := req["configuration"].(map[string]interface{}); ok {
+		query, _ := config["query"].(map[string]interface{})
+		if query == nil {
+			query = map[string]interface{}{}
+		}
+		query["labels"], query["dryRun"] = config["labels"], config["dryRun"]
+		if ref, ok := req["jobReference"].(map[string]interface{}); ok {
+			query["location"] = ref["location"]
+		}
+		req = query
+	}
+	if req == nil {
+		req = map[string]interface{}{}
+	}
+	// Paths are like /projects/{project}/queries.
+	if parts := strings.Split(r.URL.Path, "/"); len(parts) > 2 {
+		req["project"] = parts[len(parts)-2]
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.requests = append(f.requests, req)
+	return body
+}
+
+// lastRequest returns the most recent query run, in the form of a jobs.query request.
+func (f *fakeBigQuery) lastRequest() map[string]interface{} {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.requests) == 0 {
+		return nil
+	}
+	return f.requests[len(f.requests)-1]
+}
+
+// queryRuns returns the number of queries run so far.
+func (f *fakeBigQuery) queryRuns() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.runs
+}
+
+func (f *fakeBigQuery) serve(w http.ResponseWriter, r *http.Request) {
+	path := r.URL.Path
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/queries"):
+		// jobs.query, which runs the query and returns its first page.
+		var req struct {
+			Labels     map[string]string `json:"labels"`
+			MaxResults int               `json:"maxResults"`
+		}
+		body := f.record(r)
+		json.Unmarshal(body, &req)
+		f.mu.Lock()
+		f.runs++
+		f.labels = append(f.labels, req.Labels)
+		delay := f.delay
+		f.mu.Unlock()
+		if f.writeFailure(w) {
+			return
+		}
+		select {
+		case <-time.After(delay):
+		case <-r.Context().Done():
+			return
+		}
+		f.writeJSON(w, f.results(0, req.MaxResults))
+	case r.Method == http.MethodPost && strings.HasSuffix(path, "/jobs"):
+		// jobs.insert, used for dry runs and queries which can't go through jobs.query.
+		var req struct {
+			Configuration struct {
+				DryRun bool `json:"dryRun"`
+			} `json:"configuration"`
+		}
+		json.Unmarshal(f.record(r), &req)
+		if !req.Configuration.DryRun {
+			f.mu.Lock()
+			f.runs++
+			f.mu.Unlock()
+		}
+		if f.writeFailure(w) {
+			return
+		}
+		f.writeJSON(w, f.job())
+	case r.Method == http.MethodGet && strings.Contains(path, "/queries/"):
+		// jobs.getQueryResults, whose page tokens are the index of the page's first row.
+		values := r.URL.Query()
+		start, _ := strconv.Atoi(values.Get("startIndex"))
+		if token := values.Get("pageToken"); token != "" {
+			start, _ = strconv.Atoi(token)
+		}
+		max, _ := strconv.Atoi(values.Get("maxResults"))
+		f.mu.Lock()
+		readFailure := f.readFailure
+		f.mu.Unlock()
+		if readFailure != nil && start > 0 {
+			writeFakeError(w, *readFailure)
+			return
+		}
+		f.writeJSON(w, f.results(start, max))
+	case r.Method == http.MethodGet && strings.Contains(path, "/tables/"):
+		// tables.get, for tables which never exist.
+		writeFakeError(w, fakeError{code: http.StatusNotFound, reason: "notFound", message: "Not found: Table " + path})
+	case r.Method == http.MethodGet && strings.Contains(path, "/jobs/"):
+		// jobs.get, which fails along with queries so that jobs can appear to have expired.
+		if f.writeFailure(w) {
+			return
+		}
+		f.writeJSON(w, f.job())
+	default:
+		http.Error(w, "unexpected request "+r.Method+" "+path, http.StatusNotFound)
+	}
+}
+
+func (f *fakeBigQuery) jobReference() map[string]interface{} {
+	return map[string]interface{}{"projectId": "project", "jobId": "job", "location": "US"}
+}
+
+func (f *fakeBigQuery) job() map[string]interface{} {
+	return map[string]interface{}{
+		"jobReference":  f.jobReference(),
+		"configuration": map[string]interface{}{"query": map[string]interface{}{"query": "SELECT"}},
+		"status":        map[string]interface{}{"state": "DONE"},
+		"statistics": map[string]interface{}{
+			"totalBytesProcessed": "10",
+			"query": map[string]interface{}{
+				"totalBytesProcessed": "10",
+				"cacheHit":            false,
+				"schema":              map[string]interface{}{"fields": f.schema},
+			},
+		},
+	}
+}
+
+// results returns the page of results from start with up to max rows, or all of them if max is 0,
+// limited to the page size.
+func (f *fakeBigQuery) results(start, max int) map[string]interface{} {
+	f.mu.Lock()
+	if f.pageSize > 0 && (max == 0 || f.pageSize < max) {
+		max = f.pageSize
+	}
+	f.mu.Unlock()
+	end := len(f.rows)
+	if start > end {
+		start = end
+	}
+	if max > 0 && start+max < end {
+		end = start + max
+	}
+	rows := []interface{}{}
+	for _, row := range f.rows[start:end] {
+		cells := []interface{}{}
+		for _, v := range row {
+			cells = append(cells, cell(v))
+		}
+		rows = append(rows, map[string]interface{}{"f": cells})
+	}
+	results := map[string]interface{}{
+		"jobReference":        f.jobReference(),
+		"jobComplete":         true,
+		"schema":              map[string]interface{}{"fields": f.schema},
+		"rows":                rows,
+		"totalRows":           strconv.Itoa(len(f.rows)),
+		"totalBytesProcessed": "10",
+	}
+	if end < len(f.rows) {
+		results["pageToken"] = strconv.Itoa(end)
+	}
+	return results
+}
+
+// cell returns the REST API's JSON form of a cell of the fake's rows.
+func cell(v interface{}) map[string]interface{} {
+	elems, ok := v.([]interface{})
+	if !ok {
+		return map[string]interface{}{"v": v}
+	}
+	values := []interface{}{}
+	for _, e := range elems {
+		values = append(values, cell(e))
+	}
+	return map[string]interface{}{"v": values}
+}
+
+func (f *fakeBigQuery) writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
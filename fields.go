@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Field name cases which can be chosen with --field_case.
+const (
+	caseNone  = "none"
+	caseCamel = "camel"
+	caseSnake = "snake"
+)
+
+// checkFieldCase reports whether fieldCase is a supported value of --field_case.
+func checkFieldCase(fieldCase string) error {
+	switch fieldCase {
+	case caseNone, caseCamel, caseSnake:
+		return nil
+	}
+	return fmt.Errorf("invalid field case %q, must be none, camel or snake", fieldCase)
+}
+
+// fieldKey returns the name a result field is written with, according to --field_case.
+func fieldKey(name string) string {
+	switch *fieldCase {
+	case caseCamel:
+		return camelCase(name)
+	case caseSnake:
+		return snakeCase(name)
+	}
+	return name
+}
+
+// camelCase converts a snake_case name to camelCase, like user_id to userId.
+// Leading and trailing underscores are kept, so _user_id becomes _userId.
+func camelCase(name string) string {
+	body := strings.TrimLeft(name, "_")
+	prefix := name[:len(name)-len(body)]
+	trimmed := strings.TrimRight(body, "_")
+	suffix := body[len(trimmed):]
+
+	var b strings.Builder
+	upper := false
+	for _, r := range trimmed {
+		if r == '_' {
+			upper = b.Len() > 0
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return prefix + b.String() + suffix
+}
+
+// snakeCase converts a camelCase name to snake_case, like userId to user_id.
+// Runs of capitals are treated as one word, so HTTPCode becomes http_code.
+func snakeCase(name string) string {
+	runes := []rune(name)
+	var b strings.Builder
+	for i, r := range runes {
+		if unicode.IsUpper(r) && i > 0 && runes[i-1] != '_' {
+			prev := runes[i-1]
+			nextLower := i+1 < len(runes) && unicode.IsLower(runes[i+1])
+			if unicode.IsLower(prev) || unicode.IsDigit(prev) || (unicode.IsUpper(prev) && nextLower) {
+				b.WriteRune('_')
+			}
+		}
+		b.WriteRune(unicode.ToLower(r))
+	}
+	return b.String()
+}
+
+// selectColumns returns the fields of schema written in the results of query,
+// leaving out any excluded columns or those not included, and the status column.
+func selectColumns(query SQLQuery, schema bigquery.Schema) bigquery.Schema {
+	selected := bigquery.Schema{}
+	for _, field := range schema {
+		if len(query.IncludeColumns) > 0 && !containsColumn(query.IncludeColumns, field.Name) {
+			continue
+		}
+		if containsColumn(query.ExcludeColumns, field.Name) {
+			continue
+		}
+		if query.StatusColumn != "" && strings.EqualFold(query.StatusColumn, field.Name) {
+			continue
+		}
+		selected = append(selected, field)
+	}
+	return selected
+}
+
+// checkRename reports renames with empty names, or which give columns the same name.
+func checkRename(rename map[string]string) error {
+	seen := map[string]string{}
+	for from, to := range rename {
+		if from == "" || to == "" {
+			return errors.New("rename cannot have empty column names")
+		}
+		if other, ok := seen[strings.ToLower(to)]; ok {
+			return fmt.Errorf("rename gives columns %q and %q the same name %q", other, from, to)
+		}
+		seen[strings.ToLower(to)] = from
+	}
+	return nil
+}
+
+// renamedColumn returns the new name query gives a column, if any. Like BigQuery, column names ignore case.
+func renamedColumn(query SQLQuery, name string) (string, bool) {
+	for from, to := range query.Rename {
+		if strings.EqualFold(from, name) {
+			return to, true
+		}
+	}
+	return "", false
+}
+
+// renameColumns returns schema with the columns renamed by query.
+func renameColumns(query SQLQuery, schema bigquery.Schema) bigquery.Schema {
+	if len(query.Rename) == 0 {
+		return schema
+	}
+	renamed := make(bigquery.Schema, len(schema))
+	for i, field := range schema {
+		if to, ok := renamedColumn(query, field.Name); ok {
+			copied := *field
+			copied.Name = to
+			field = &copied
+		}
+		renamed[i] = field
+	}
+	return renamed
+}
+
+// renameRow returns row with the values of columns renamed by query moved to their new names.
+func renameRow(query SQLQuery, row map[string]bigquery.Value) map[string]bigquery.Value {
+	if len(query.Rename) == 0 {
+		return row
+	}
+	renamed := make(map[string]bigquery.Value, len(row))
+	for name, v := range row {
+		if to, ok := renamedColumn(query, name); ok {
+			name = to
+		}
+		renamed[name] = v
+	}
+	return renamed
+}
+
+// fieldsParam is the URL parameter listing the only fields a request wants in its results.
+const fieldsParam = "fields"
+
+// requestFields narrows schema to the fields listed by the fields URL parameter in values, in the order listed.
+// Fields can be named as they appear in the results, or by their column names.
+func requestFields(values url.Values, schema bigquery.Schema) (bigquery.Schema, error) {
+	list := values.Get(fieldsParam)
+	if list == "" {
+		return schema, nil
+	}
+	selected := bigquery.Schema{}
+	var unknown []string
+	for _, name := range strings.Split(list, ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		field := findField(schema, name)
+		if field == nil {
+			unknown = append(unknown, strconv.Quote(name))
+			continue
+		}
+		if findField(selected, name) == nil {
+			selected = append(selected, field)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("unknown fields: %s", strings.Join(unknown, ", "))
+	}
+	return selected, nil
+}
+
+// resultSchema returns the schema of the results written for query without running it: the schema
+// the query declares, if any, or otherwise the one reported by a dry run of q, which is not billed.
+func resultSchema(ctx context.Context, query SQLQuery, q *bigquery.Query) (bigquery.Schema, error) {
+	if len(query.Schema) > 0 {
+		schema := make(bigquery.Schema, len(query.Schema))
+		for i, field := range query.Schema {
+			schema[i] = &bigquery.FieldSchema{Name: field.Name, Type: field.Type, Repeated: field.Repeated}
+		}
+		return schema, nil
+	}
+
+	dry := *q
+	dry.DryRun = true
+	// A dry run can't start a session, though it can run in an existing one.
+	dry.CreateSession = false
+	job, err := dry.Run(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if status := job.LastStatus(); status != nil && status.Statistics != nil {
+		if details, ok := status.Statistics.Details.(*bigquery.QueryStatistics); ok {
+			return renameColumns(query, selectColumns(query, details.Schema)), nil
+		}
+	}
+	return nil, errors.New("dry run did not report the result schema")
+}
+
+// findField returns the field of schema with the given result or column name, or nil if there is none.
+func findField(schema bigquery.Schema, name string) *bigquery.FieldSchema {
+	for _, field := range schema {
+		if fieldKey(field.Name) == name || strings.EqualFold(field.Name, name) {
+			return field
+		}
+	}
+	return nil
+}
+
+// containsColumn reports whether columns lists name. Like BigQuery, the comparison ignores case.
+func containsColumn(columns []string, name string) bool {
+	for _, c := range columns {
+		if strings.EqualFold(c, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// resultStatus returns the HTTP status set by the status column of the first row of the results of query.
+// Missing or invalid statuses are logged and leave the status unchanged, returning 0.
+func resultStatus(ctx context.Context, query SQLQuery, schema bigquery.Schema, row map[string]bigquery.Value) int {
+	for _, field := range schema {
+		if !strings.EqualFold(field.Name, query.StatusColumn) {
+			continue
+		}
+		status, ok := row[field.Name].(int64)
+		if !ok || status < 200 || status > 599 {
+			slog.WarnContext(ctx, "Invalid status column value", "query_name", query.Name, "column", field.Name, "value", row[field.Name])
+			return 0
+		}
+		return int(status)
+	}
+	slog.WarnContext(ctx, "Missing status column", "query_name", query.Name, "column", query.StatusColumn)
+	return 0
+}
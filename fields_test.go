@@ -0,0 +1,198 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestRequestFieldsCheckedBeforeRunning(t *testing.T) {
+	schema := []map[string]string{{"name": "id", "type": "INTEGER"}, {"name": "name", "type": "STRING"}}
+	tests := []struct {
+		name     string
+		query    SQLQuery
+		url      string
+		wantCode int
+		wantRuns int
+	}{
+		{
+			name:     "known field",
+			query:    SQLQuery{Name: "people", SQL: "SELECT 1 AS id, 'a' AS name"},
+			url:      "/people?fields=name",
+			wantCode: http.StatusOK,
+			wantRuns: 1,
+		},
+		{
+			name:     "unknown field",
+			query:    SQLQuery{Name: "people", SQL: "SELECT 1 AS id, 'a' AS name"},
+			url:      "/people?fields=name,age",
+			wantCode: http.StatusBadRequest,
+			wantRuns: 0,
+		},
+		{
+			name:     "excluded column",
+			query:    SQLQuery{Name: "people", SQL: "SELECT 1 AS id, 'a' AS name", ExcludeColumns: []string{"id"}},
+			url:      "/people?fields=id",
+			wantCode: http.StatusBadRequest,
+			wantRuns: 0,
+		},
+		{
+			name: "unknown field of a declared schema",
+			query: SQLQuery{Name: "people", SQL: "SELECT 1 AS id, 'a' AS name", Schema: []SchemaField{
+				{Name: "id", Type: "INTEGER"}, {Name: "name", Type: "STRING"},
+			}},
+			url:      "/people?fields=age",
+			wantCode: http.StatusBadRequest,
+			wantRuns: 0,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			fake := newFakeBigQuery(t, schema, [][]interface{}{{"1", "a"}})
+			serveQueries(t, tc.query)
+
+			w := httptest.NewRecorder()
+			queryHandler(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+			if w.Code != tc.wantCode {
+				t.Errorf("status = %d, want %d: %s", w.Code, tc.wantCode, w.Body.String())
+			}
+			if got := fake.queryRuns(); got != tc.wantRuns {
+				t.Errorf("queries run = %d, want %d", got, tc.wantRuns)
+			}
+		})
+	}
+}
+
+func TestCamelCase(t *testing.T) {
+	tests := map[string]string{
+		"":            "",
+		"id":          "id",
+		"user_id":     "userId",
+		"user_id_2":   "userId2",
+		"a__b":        "aB",
+		"_user_id":    "_userId",
+		"user_id_":    "userId_",
+		"__private__": "__private__",
+		"userId":      "userId",
+		"ID":          "ID",
+	}
+	for name, want := range tests {
+		if got := camelCase(name); got != want {
+			t.Errorf("camelCase(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestSnakeCase(t *testing.T) {
+	tests := map[string]string{
+		"":           "",
+		"id":         "id",
+		"userId":     "user_id",
+		"UserID":     "user_id",
+		"HTTPCode":   "http_code",
+		"userId2":    "user_id2",
+		"version2Id": "version2_id",
+		"user_id":    "user_id",
+		"_userId":    "_user_id",
+		"Already_Id": "already_id",
+	}
+	for name, want := range tests {
+		if got := snakeCase(name); got != want {
+			t.Errorf("snakeCase(%q) = %q, want %q", name, got, want)
+		}
+	}
+}
+
+func TestQueryHandlerColumns(t *testing.T) {
+	newFakeBigQuery(t,
+		[]map[string]string{{"name": "internal_id", "type": "INTEGER"}, {"name": "name", "type": "STRING"}, {"name": "email", "type": "STRING"}},
+		[][]interface{}{{"7", "Ann", "ann@example.com"}})
+	serveQueries(t,
+		SQLQuery{Name: "excluded", SQL: "SELECT *", ExcludeColumns: []string{"INTERNAL_ID"}},
+		SQLQuery{Name: "included", SQL: "SELECT *", IncludeColumns: []string{"name"}},
+	)
+
+	tests := []struct {
+		url  string
+		want string
+	}{
+		{"/excluded", `[{"email":"ann@example.com","name":"Ann"}]`},
+		// Excluded columns can't be requested.
+		{"/excluded?fields=name,internal_id", `{"error":"unknown fields: \"internal_id\""}`},
+		{"/included", `[{"name":"Ann"}]`},
+		{"/included?format=csv", "name\nAnn"},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if got := strings.TrimSpace(w.Body.String()); got != tc.want {
+			t.Errorf("%s: body = %s, want %s", tc.url, got, tc.want)
+		}
+	}
+
+	q := SQLQuery{Name: "both", SQL: "SELECT *", ExcludeColumns: []string{"a"}, IncludeColumns: []string{"b"}}
+	if err := prepareQuery(&q); err == nil {
+		t.Error("prepareQuery() with exclude_columns and include_columns succeeded, want an error")
+	}
+}
+
+func TestQueryHandlerStatusColumn(t *testing.T) {
+	tests := []struct {
+		status   interface{}
+		wantCode int
+	}{
+		{"404", http.StatusNotFound},
+		{"201", http.StatusCreated},
+		// Values which aren't HTTP statuses are ignored.
+		{"42", http.StatusOK},
+		{nil, http.StatusOK},
+	}
+	for _, tc := range tests {
+		newFakeBigQuery(t,
+			[]map[string]string{{"name": "_status", "type": "INTEGER"}, {"name": "name", "type": "STRING"}},
+			[][]interface{}{{tc.status, "Ann"}})
+		serveQueries(t, SQLQuery{Name: "lookup", SQL: "SELECT _status, name", StatusColumn: "_STATUS"})
+
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/lookup", nil))
+		if got, want := strings.TrimSpace(w.Body.String()), `[{"name":"Ann"}]`; w.Code != tc.wantCode || got != want {
+			t.Errorf("status column %v: response = %d %s, want %d %s", tc.status, w.Code, got, tc.wantCode, want)
+		}
+	}
+}
+
+func TestQueryHandlerRename(t *testing.T) {
+	newFakeBigQuery(t,
+		[]map[string]string{{"name": "usr_nm_txt", "type": "STRING"}, {"name": "email", "type": "STRING"}},
+		[][]interface{}{{"Ann", "ann@example.com"}})
+	serveQueries(t, SQLQuery{Name: "users", SQL: "SELECT *", Rename: map[string]string{"USR_NM_TXT": "user_name"}})
+	defer func(v string) { *fieldCase = v }(*fieldCase)
+
+	tests := []struct {
+		url       string
+		fieldCase string
+		want      string
+	}{
+		{"/users", caseNone, `[{"email":"ann@example.com","user_name":"Ann"}]`},
+		{"/users?format=csv", caseNone, "user_name,email\nAnn,ann@example.com"},
+		// Renamed columns are requested by their new names.
+		{"/users?fields=user_name", caseNone, `[{"user_name":"Ann"}]`},
+		{"/users?fields=usr_nm_txt", caseNone, `{"error":"unknown fields: \"usr_nm_txt\""}`},
+		// Renamed columns are still subject to --field_case.
+		{"/users", caseCamel, `[{"email":"ann@example.com","userName":"Ann"}]`},
+	}
+	for _, tc := range tests {
+		*fieldCase = tc.fieldCase
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if got := strings.TrimSpace(w.Body.String()); got != tc.want {
+			t.Errorf("%s with --field_case=%q: body = %s, want %s", tc.url, tc.fieldCase, got, tc.want)
+		}
+	}
+
+	q := SQLQuery{Name: "clash", SQL: "SELECT *", Rename: map[string]string{"a": "c", "b": "C"}}
+	if err := prepareQuery(&q); err == nil || !strings.Contains(err.Error(), "the same name") {
+		t.Errorf("prepareQuery() renaming two columns to the same name = %v, want an error", err)
+	}
+}
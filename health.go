@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+)
+
+// readyTimeout bounds the BigQuery call made by the readiness check.
+const readyTimeout = 5 * time.Second
+
+// statusResponse is the JSON body written by the health check endpoints.
+type statusResponse struct {
+	Status string `json:"status"`
+}
+
+func writeStatusOK(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(statusResponse{Status: "ok"})
+}
+
+// healthHandler reports that the server is up.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	writeStatusOK(w)
+}
+
+// readyHandler reports whether BigQuery can be reached, using a free dry run query.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+	defer cancel()
+
+	q := bqClient.Query("SELECT 1")
+	q.DryRun = true
+	if _, err := q.Run(ctx); err != nil {
+		slog.ErrorContext(ctx, "Readiness check failed", "error", err)
+		writeError(w, http.StatusServiceUnavailable, "BigQuery unavailable", err)
+		return
+	}
+	writeStatusOK(w)
+}
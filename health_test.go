@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHealthHandler(t *testing.T) {
+	w := httptest.NewRecorder()
+	healthHandler(w, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "{\"status\":\"ok\"}\n" {
+		t.Errorf("response = %d %q, want 200 ok", w.Code, w.Body.String())
+	}
+}
+
+func TestReadyHandler(t *testing.T) {
+	fake := newFakeBigQuery(t, nil, nil)
+
+	w := httptest.NewRecorder()
+	readyHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusOK || w.Body.String() != "{\"status\":\"ok\"}\n" {
+		t.Errorf("response = %d %q, want 200 ok", w.Code, w.Body.String())
+	}
+	// The check is a dry run, so costs nothing.
+	if got := fake.queryRuns(); got != 0 {
+		t.Errorf("queries run = %d, want 0", got)
+	}
+
+	fake.fail(-1, fakeError{code: http.StatusForbidden, reason: "accessDenied", message: "Access Denied"})
+	w = httptest.NewRecorder()
+	readyHandler(w, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("response when BigQuery fails = %d %q, want 503", w.Code, w.Body.String())
+	}
+}
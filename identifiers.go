@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"text/template"
+)
+
+// Identifier describes a table, column or other name substituted into the SQL of a query,
+// which BigQuery parameters cannot bind. Only the listed values can be substituted.
+type Identifier struct {
+	// The values a request may choose from.
+	Allowed []string `yaml:"allowed"`
+	// Value used when the request omits the identifier, which is otherwise required.
+	Default string `yaml:"default"`
+}
+
+// prepareIdentifiers compiles the SQL of a query with identifiers into a template,
+// where they are referenced like {{.table}}.
+func prepareIdentifiers(q *SQLQuery) error {
+	if len(q.Identifiers) == 0 {
+		return nil
+	}
+
+	sample := map[string]string{}
+	for name, ident := range q.Identifiers {
+		if _, ok := q.Parameters[name]; ok {
+			return fmt.Errorf("%q is declared as both a parameter and an identifier", name)
+		}
+		if len(ident.Allowed) == 0 {
+			return fmt.Errorf("identifier %q has no allowed values", name)
+		}
+		if ident.Default != "" && !ident.allows(ident.Default) {
+			return fmt.Errorf("default %q for identifier %q is not an allowed value", ident.Default, name)
+		}
+		sample[name] = ident.Allowed[0]
+	}
+
+	tmpl, err := template.New(q.Name).Option("missingkey=error").Parse(q.SQL)
+	if err != nil {
+		return fmt.Errorf("invalid SQL template: %v", err)
+	}
+	// Catch references to undeclared identifiers now rather than on each request.
+	if err := tmpl.Execute(&strings.Builder{}, sample); err != nil {
+		return fmt.Errorf("invalid SQL template: %v", err)
+	}
+	q.sqlTemplate = tmpl
+	return nil
+}
+
+func (ident Identifier) allows(value string) bool {
+	for _, allowed := range ident.Allowed {
+		if value == allowed {
+			return true
+		}
+	}
+	return false
+}
+
+// renderSQL returns the SQL of query with the identifiers chosen by the request substituted.
+// Values which are not allowed are rejected, so arbitrary SQL cannot be injected.
+func renderSQL(query SQLQuery, values url.Values, body map[string]interface{}) (string, error) {
+	if query.sqlTemplate == nil {
+		return query.SQL, nil
+	}
+
+	vars := map[string]string{}
+	for name, ident := range query.Identifiers {
+		value := ident.Default
+		if raw, ok := body[name]; ok {
+			s, ok := raw.(string)
+			if !ok {
+				return "", fmt.Errorf("invalid value for identifier %q: expected a string, got %v", name, raw)
+			}
+			value = s
+		} else if _, ok := values[name]; ok {
+			value = values.Get(name)
+		}
+		if value == "" {
+			return "", fmt.Errorf("missing identifier %q", name)
+		}
+		if !ident.allows(value) {
+			return "", fmt.Errorf("invalid value for identifier %q: %q is not allowed", name, value)
+		}
+		vars[name] = value
+	}
+
+	var sql strings.Builder
+	if err := query.sqlTemplate.Execute(&sql, vars); err != nil {
+		return "", err
+	}
+	return sql.String(), nil
+}
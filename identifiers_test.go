@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPrepareIdentifiers(t *testing.T) {
+	tests := []struct {
+		query   SQLQuery
+		wantErr string
+	}{
+		{SQLQuery{SQL: "SELECT * FROM {{.table}}", Identifiers: map[string]Identifier{"table": {Allowed: []string{"a", "b"}, Default: "b"}}}, ""},
+		{SQLQuery{SQL: "SELECT * FROM {{.table}}", Identifiers: map[string]Identifier{"table": {}}}, `identifier "table" has no allowed values`},
+		{SQLQuery{SQL: "SELECT * FROM {{.table}}", Identifiers: map[string]Identifier{"table": {Allowed: []string{"a"}, Default: "b"}}}, `default "b" for identifier "table" is not an allowed value`},
+		{SQLQuery{SQL: "SELECT * FROM {{.tabel}}", Identifiers: map[string]Identifier{"table": {Allowed: []string{"a"}}}}, "invalid SQL template"},
+		{SQLQuery{SQL: "SELECT * FROM {{.table", Identifiers: map[string]Identifier{"table": {Allowed: []string{"a"}}}}, "invalid SQL template"},
+		{SQLQuery{SQL: "SELECT * FROM {{.table}}", Identifiers: map[string]Identifier{"table": {Allowed: []string{"a"}}}, Parameters: map[string]Parameter{"table": {}}}, `"table" is declared as both a parameter and an identifier`},
+	}
+	for _, tc := range tests {
+		if got := errString(prepareIdentifiers(&tc.query)); !strings.HasPrefix(got, tc.wantErr) || (got == "") != (tc.wantErr == "") {
+			t.Errorf("prepareIdentifiers(%q) error = %q, want %q", tc.query.SQL, got, tc.wantErr)
+		}
+	}
+}
+
+func TestQueryHandlerIdentifiers(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{
+		Name:        "events",
+		SQL:         "SELECT COUNT(*) AS n FROM logs.{{.table}}",
+		Identifiers: map[string]Identifier{"table": {Allowed: []string{"events_2023", "events_2024"}, Default: "events_2024"}},
+	})
+
+	tests := []struct {
+		url      string
+		wantCode int
+		wantSQL  string
+	}{
+		{"/events?table=events_2023", http.StatusOK, "SELECT COUNT(*) AS n FROM logs.events_2023"},
+		{"/events", http.StatusOK, "SELECT COUNT(*) AS n FROM logs.events_2024"},
+		{"/events?table=users", http.StatusBadRequest, ""},
+		{"/events?table=events_2024%3B%20DROP%20TABLE%20logs.users", http.StatusBadRequest, ""},
+	}
+	for _, tc := range tests {
+		runs := fake.queryRuns()
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: status = %d, want %d: %s", tc.url, w.Code, tc.wantCode, w.Body.String())
+			continue
+		}
+		if tc.wantCode != http.StatusOK {
+			if fake.queryRuns() != runs || !strings.Contains(w.Body.String(), "is not allowed") {
+				t.Errorf("%s: response %s after running %d queries, want it rejected as not allowed", tc.url, w.Body.String(), fake.queryRuns()-runs)
+			}
+			continue
+		}
+		if got := fake.lastRequest()["query"]; got != tc.wantSQL {
+			t.Errorf("%s: SQL = %q, want %q", tc.url, got, tc.wantSQL)
+		}
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// isoIntervalPattern matches ISO 8601 durations like "P1Y2M3DT4H5M6.5S", allowing negative parts
+// as BigQuery intervals have them.
+var isoIntervalPattern = regexp.MustCompile(`^P(?:(-?\d+)Y)?(?:(-?\d+)M)?(?:(-?\d+)W)?(?:(-?\d+)D)?(?:T(?:(-?\d+)H)?(?:(-?\d+)M)?(?:(-?\d+)(?:[.,](\d{1,9}))?S)?)?$`)
+
+// parseInterval parses an INTERVAL request value, either an ISO 8601 duration
+// or in BigQuery's canonical format, like "1-2 3 4:5:6.5".
+func parseInterval(value string) (*bigquery.IntervalValue, error) {
+	if !strings.HasPrefix(strings.ToUpper(value), "P") {
+		iv, err := bigquery.ParseInterval(value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an ISO 8601 duration or BigQuery interval", value)
+		}
+		// The sign of a part like "-0-6" or "-0:30:0" is lost when its leading number is zero.
+		if parts := strings.Fields(value); len(parts) == 3 {
+			if strings.HasPrefix(parts[0], "-") && iv.Years == 0 {
+				iv.Months = -abs32(iv.Months)
+			}
+			if strings.HasPrefix(parts[2], "-") && iv.Hours == 0 {
+				iv.Minutes, iv.Seconds, iv.SubSecondNanos = -abs32(iv.Minutes), -abs32(iv.Seconds), -abs32(iv.SubSecondNanos)
+			}
+		}
+		return iv, nil
+	}
+
+	m := isoIntervalPattern.FindStringSubmatch(strings.ToUpper(value))
+	if m == nil || strings.HasSuffix(m[0], "P") || strings.HasSuffix(m[0], "T") {
+		return nil, fmt.Errorf("%q is not an ISO 8601 duration or BigQuery interval", value)
+	}
+	parts := make([]int32, 7)
+	for i, s := range m[1:8] {
+		if s == "" {
+			continue
+		}
+		n, err := strconv.ParseInt(s, 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%q is out of range for an interval", value)
+		}
+		parts[i] = int32(n)
+	}
+	iv := &bigquery.IntervalValue{
+		Years:   parts[0],
+		Months:  parts[1],
+		Days:    parts[2]*7 + parts[3],
+		Hours:   parts[4],
+		Minutes: parts[5],
+		Seconds: parts[6],
+	}
+	if frac := m[8]; frac != "" {
+		nanos, _ := strconv.Atoi(frac + strings.Repeat("0", 9-len(frac)))
+		iv.SubSecondNanos = int32(nanos)
+		// The fraction has the sign of the seconds it is part of.
+		if strings.HasPrefix(m[7], "-") {
+			iv.SubSecondNanos = -iv.SubSecondNanos
+		}
+	}
+	return iv, nil
+}
+
+// intervalParam returns an INTERVAL parameter value. The value is formatted here rather than
+// by the client library, which loses the sign of negative intervals of under an hour.
+func intervalParam(iv *bigquery.IntervalValue) *bigquery.QueryParameterValue {
+	if !iv.IsCanonical() {
+		iv = iv.Canonicalize()
+	}
+	ym := ""
+	if iv.Years < 0 || iv.Months < 0 {
+		ym = "-"
+	}
+	ym += fmt.Sprintf("%d-%d", abs32(iv.Years), abs32(iv.Months))
+	hms := ""
+	if iv.Hours < 0 || iv.Minutes < 0 || iv.Seconds < 0 || iv.SubSecondNanos < 0 {
+		hms = "-"
+	}
+	hms += fmt.Sprintf("%d:%d:%s", abs32(iv.Hours), abs32(iv.Minutes), strings.TrimSuffix(isoSeconds(abs32(iv.Seconds), abs32(iv.SubSecondNanos)), "S"))
+	return &bigquery.QueryParameterValue{
+		Type:  bigquery.StandardSQLDataType{TypeKind: string(bigquery.IntervalFieldType)},
+		Value: fmt.Sprintf("%s %d %s", ym, iv.Days, hms),
+	}
+}
+
+func abs32(n int32) int32 {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// isoInterval formats an interval as an ISO 8601 duration, like "P1Y2M3DT4H5M6.5S".
+// Each part keeps its own sign, so intervals like "P1M-1D" round trip.
+func isoInterval(iv *bigquery.IntervalValue) string {
+	if !iv.IsCanonical() {
+		iv = iv.Canonicalize()
+	}
+	var b strings.Builder
+	b.WriteString("P")
+	for _, p := range []struct {
+		n    int32
+		unit string
+	}{{iv.Years, "Y"}, {iv.Months, "M"}, {iv.Days, "D"}} {
+		if p.n != 0 {
+			fmt.Fprintf(&b, "%d%s", p.n, p.unit)
+		}
+	}
+	if iv.Hours != 0 || iv.Minutes != 0 || iv.Seconds != 0 || iv.SubSecondNanos != 0 {
+		b.WriteString("T")
+		if iv.Hours != 0 {
+			fmt.Fprintf(&b, "%dH", iv.Hours)
+		}
+		if iv.Minutes != 0 {
+			fmt.Fprintf(&b, "%dM", iv.Minutes)
+		}
+		if iv.Seconds != 0 || iv.SubSecondNanos != 0 {
+			b.WriteString(isoSeconds(iv.Seconds, iv.SubSecondNanos))
+		}
+	}
+	if b.Len() == 1 {
+		return "PT0S"
+	}
+	return b.String()
+}
+
+// isoSeconds formats seconds and fractional nanoseconds of the same sign, like "-6.5S".
+func isoSeconds(seconds, nanos int32) string {
+	sign := ""
+	if seconds < 0 || nanos < 0 {
+		sign = "-"
+		seconds, nanos = -seconds, -nanos
+	}
+	s := sign + strconv.Itoa(int(seconds))
+	if nanos != 0 {
+		s += "." + strings.TrimRight(fmt.Sprintf("%09d", nanos), "0")
+	}
+	return s + "S"
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestParseInterval(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    *bigquery.IntervalValue
+		wantErr bool
+	}{
+		{"P1Y2M3DT4H5M6S", &bigquery.IntervalValue{Years: 1, Months: 2, Days: 3, Hours: 4, Minutes: 5, Seconds: 6}, false},
+		{"p1d", &bigquery.IntervalValue{Days: 1}, false},
+		{"P2W1D", &bigquery.IntervalValue{Days: 15}, false},
+		{"PT0S", &bigquery.IntervalValue{}, false},
+		{"PT1.5S", &bigquery.IntervalValue{Seconds: 1, SubSecondNanos: 500000000}, false},
+		{"PT0,000001S", &bigquery.IntervalValue{SubSecondNanos: 1000}, false},
+		{"PT-1.25S", &bigquery.IntervalValue{Seconds: -1, SubSecondNanos: -250000000}, false},
+		{"P1M-1D", &bigquery.IntervalValue{Months: 1, Days: -1}, false},
+		{"P-1Y", &bigquery.IntervalValue{Years: -1}, false},
+		{"1-2 3 4:5:6.5", &bigquery.IntervalValue{Years: 1, Months: 2, Days: 3, Hours: 4, Minutes: 5, Seconds: 6, SubSecondNanos: 500000000}, false},
+		{"-1-2 -3 -4:5:6", &bigquery.IntervalValue{Years: -1, Months: -2, Days: -3, Hours: -4, Minutes: -5, Seconds: -6}, false},
+		// The client library loses the sign of these, so parseInterval restores it.
+		{"-0-6 0 0:0:0", &bigquery.IntervalValue{Months: -6}, false},
+		{"0-0 0 -0:30:0", &bigquery.IntervalValue{Minutes: -30}, false},
+		{"0-0 0 -0:0:5.5", &bigquery.IntervalValue{Seconds: -5, SubSecondNanos: -500000000}, false},
+		{"P", nil, true},
+		{"PT", nil, true},
+		{"P1H", nil, true},
+		{"PT1.1234567891S", nil, true},
+		{"P9999999999D", nil, true},
+		{"1 day", nil, true},
+		{"", nil, true},
+	}
+	for _, tc := range tests {
+		got, err := parseInterval(tc.value)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseInterval(%q) = %+v, want an error", tc.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseInterval(%q) unexpected error: %v", tc.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseInterval(%q) = %+v, want %+v", tc.value, got, tc.want)
+		}
+	}
+}
+
+func TestIsoInterval(t *testing.T) {
+	tests := []struct {
+		iv   *bigquery.IntervalValue
+		want string
+	}{
+		{&bigquery.IntervalValue{}, "PT0S"},
+		{&bigquery.IntervalValue{Years: 1, Months: 2, Days: 3, Hours: 4, Minutes: 5, Seconds: 6}, "P1Y2M3DT4H5M6S"},
+		{&bigquery.IntervalValue{Days: 1}, "P1D"},
+		{&bigquery.IntervalValue{Seconds: 6, SubSecondNanos: 500000000}, "PT6.5S"},
+		{&bigquery.IntervalValue{SubSecondNanos: 1000}, "PT0.000001S"},
+		{&bigquery.IntervalValue{Seconds: -1, SubSecondNanos: -250000000}, "PT-1.25S"},
+		{&bigquery.IntervalValue{Months: 1, Days: -1}, "P1M-1D"},
+		// Intervals are canonicalized first.
+		{&bigquery.IntervalValue{Months: 14}, "P1Y2M"},
+		{&bigquery.IntervalValue{Minutes: 90}, "PT1H30M"},
+	}
+	for _, tc := range tests {
+		if got := isoInterval(tc.iv); got != tc.want {
+			t.Errorf("isoInterval(%+v) = %q, want %q", tc.iv, got, tc.want)
+		}
+	}
+}
+
+func TestIsoIntervalRoundTrip(t *testing.T) {
+	for _, value := range []string{"P1Y2M3DT4H5M6.5S", "P1M-1D", "PT-1.25S", "P-1Y-2M", "PT-30M", "PT0S"} {
+		iv, err := parseInterval(value)
+		if err != nil {
+			t.Errorf("parseInterval(%q) error: %v", value, err)
+			continue
+		}
+		if got := isoInterval(iv); got != value {
+			t.Errorf("isoInterval(parseInterval(%q)) = %q", value, got)
+		}
+	}
+}
+
+func TestIntervalParam(t *testing.T) {
+	tests := []struct {
+		iv   *bigquery.IntervalValue
+		want string
+	}{
+		{&bigquery.IntervalValue{}, "0-0 0 0:0:0"},
+		{&bigquery.IntervalValue{Years: 1, Months: 2, Days: 3, Hours: 4, Minutes: 5, Seconds: 6, SubSecondNanos: 500000000}, "1-2 3 4:5:6.5"},
+		{&bigquery.IntervalValue{Months: -6}, "-0-6 0 0:0:0"},
+		{&bigquery.IntervalValue{Minutes: -30}, "0-0 0 -0:30:0"},
+		{&bigquery.IntervalValue{Days: -1, Seconds: -5}, "0-0 -1 -0:0:5"},
+	}
+	for _, tc := range tests {
+		got := intervalParam(tc.iv)
+		if got.Type.TypeKind != "INTERVAL" || got.Value != tc.want {
+			t.Errorf("intervalParam(%+v) = %s %v, want INTERVAL %q", tc.iv, got.Type.TypeKind, got.Value, tc.want)
+		}
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// queryNameLabel is the job label holding the name of the query which ran the job.
+const queryNameLabel = "proxy_query"
+
+// maxLabelLength is the longest label key or value BigQuery accepts.
+const maxLabelLength = 63
+
+var (
+	// Label keys start with a lowercase letter and, like values, contain only lowercase
+	// letters, digits, underscores and dashes. International characters are allowed.
+	labelKeyPattern   = regexp.MustCompile(`^\p{Ll}[\p{Ll}\p{Lo}\p{N}_-]*$`)
+	labelValuePattern = regexp.MustCompile(`^[\p{Ll}\p{Lo}\p{N}_-]*$`)
+)
+
+// checkLabels reports labels which BigQuery would reject.
+func checkLabels(labels map[string]string) error {
+	for k, v := range labels {
+		if len([]rune(k)) > maxLabelLength || !labelKeyPattern.MatchString(k) {
+			return fmt.Errorf("invalid label key %q: must start with a lowercase letter, contain only lowercase letters, digits, underscores and dashes, and be at most %d characters", k, maxLabelLength)
+		}
+		if len([]rune(v)) > maxLabelLength || !labelValuePattern.MatchString(v) {
+			return fmt.Errorf("invalid value for label %q: must contain only lowercase letters, digits, underscores and dashes, and be at most %d characters", k, maxLabelLength)
+		}
+	}
+	return nil
+}
+
+// queryLabels returns the labels to apply to jobs run for query.
+func queryLabels(query SQLQuery) map[string]string {
+	if len(query.Labels) == 0 && !*labelQueries {
+		return nil
+	}
+	labels := make(map[string]string, len(query.Labels)+1)
+	if *labelQueries {
+		labels[queryNameLabel] = labelValue(query.Name)
+	}
+	// Labels from the query take precedence over the automatic one.
+	for k, v := range query.Labels {
+		labels[k] = v
+	}
+	return labels
+}
+
+// labelValue converts s into a valid label value, lowercasing it and replacing
+// disallowed characters with underscores.
+func labelValue(s string) string {
+	v := []rune(strings.ToLower(s))
+	for i, r := range v {
+		if !unicode.In(r, unicode.Ll, unicode.Lo, unicode.N) && r != '_' && r != '-' {
+			v[i] = '_'
+		}
+	}
+	if len(v) > maxLabelLength {
+		v = v[:maxLabelLength]
+	}
+	return string(v)
+}
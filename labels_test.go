@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestCheckLabels(t *testing.T) {
+	tests := []struct {
+		labels  map[string]string
+		wantErr string
+	}{
+		{map[string]string{"team": "data", "env": "", "cost-centre_1": "ä"}, ""},
+		{map[string]string{"Team": "data"}, `invalid label key "Team"`},
+		{map[string]string{"1team": "data"}, `invalid label key "1team"`},
+		{map[string]string{strings.Repeat("k", 64): "data"}, "invalid label key"},
+		{map[string]string{"team": "Data"}, `invalid value for label "team"`},
+		{map[string]string{"team": "a.b"}, `invalid value for label "team"`},
+		{map[string]string{"team": strings.Repeat("v", 64)}, `invalid value for label "team"`},
+	}
+	for _, tc := range tests {
+		if got := errString(checkLabels(tc.labels)); !strings.HasPrefix(got, tc.wantErr) || (tc.wantErr == "") != (got == "") {
+			t.Errorf("checkLabels(%v) error = %q, want %q", tc.labels, got, tc.wantErr)
+		}
+	}
+}
+
+func TestQueryLabels(t *testing.T) {
+	defer func(v bool) { *labelQueries = v }(*labelQueries)
+
+	tests := []struct {
+		labelQueries bool
+		query        SQLQuery
+		want         map[string]string
+	}{
+		{false, SQLQuery{Name: "numbers"}, nil},
+		{false, SQLQuery{Name: "numbers", Labels: map[string]string{"team": "data"}}, map[string]string{"team": "data"}},
+		{true, SQLQuery{Name: "numbers", Labels: map[string]string{"team": "data"}}, map[string]string{"team": "data", queryNameLabel: "numbers"}},
+		// Query names are converted into valid label values.
+		{true, SQLQuery{Name: "Top.Users"}, map[string]string{queryNameLabel: "top_users"}},
+		{true, SQLQuery{Name: strings.Repeat("q", 70)}, map[string]string{queryNameLabel: strings.Repeat("q", maxLabelLength)}},
+		// The query's own labels take precedence.
+		{true, SQLQuery{Name: "numbers", Labels: map[string]string{queryNameLabel: "mine"}}, map[string]string{queryNameLabel: "mine"}},
+	}
+	for _, tc := range tests {
+		*labelQueries = tc.labelQueries
+		if got := queryLabels(tc.query); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("queryLabels(%q) with --label_queries=%v = %v, want %v", tc.query.Name, tc.labelQueries, got, tc.want)
+		}
+	}
+}
+
+func TestQueryHandlerLabels(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{Name: "numbers", SQL: "SELECT 1 AS n", Labels: map[string]string{"team": "data"}})
+
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/numbers", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	want := map[string]string{"team": "data", queryNameLabel: "numbers"}
+	if got := fake.labels[len(fake.labels)-1]; !reflect.DeepEqual(got, want) {
+		t.Errorf("job labels = %v, want %v", got, want)
+	}
+
+	q := SQLQuery{Name: "bad", SQL: "SELECT 1", Labels: map[string]string{"Team": "data"}}
+	if err := prepareQuery(&q); err == nil || !strings.Contains(err.Error(), `invalid label key "Team"`) {
+		t.Errorf("prepareQuery() with an invalid label = %v, want an error", err)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Names of the URL parameters which limit and offset the rows of queries with a max_limit.
+const (
+	limitParam  = "limit"
+	offsetParam = "offset"
+)
+
+// checkLimits validates the limit and offset options of a query.
+func checkLimits(q *SQLQuery) error {
+	if q.MaxLimit < 0 || q.MaxOffset < 0 || q.DefaultLimit < 0 {
+		return fmt.Errorf("max_limit, max_offset and default_limit cannot be negative")
+	}
+	if q.MaxLimit == 0 {
+		if q.MaxOffset > 0 || q.DefaultLimit > 0 {
+			return fmt.Errorf("max_offset and default_limit require max_limit")
+		}
+		return nil
+	}
+	if q.LegacySQL {
+		return fmt.Errorf("legacy SQL queries do not support limit and offset")
+	}
+	if q.DefaultLimit > q.MaxLimit {
+		return fmt.Errorf("default_limit %d exceeds max_limit %d", q.DefaultLimit, q.MaxLimit)
+	}
+	for _, name := range []string{limitParam, offsetParam} {
+		if _, ok := q.Parameters[name]; ok {
+			return fmt.Errorf("parameter %q conflicts with the %s URL parameter enabled by max_limit", name, name)
+		}
+	}
+	return nil
+}
+
+// applyLimits appends the LIMIT and OFFSET requested in values to sql, for queries with a max_limit.
+// Both are parsed as integers and checked against the query's bounds, so they cannot inject SQL.
+func applyLimits(query SQLQuery, sql string, values url.Values) (string, error) {
+	if query.MaxLimit == 0 {
+		return sql, nil
+	}
+
+	defaultLimit := query.DefaultLimit
+	if defaultLimit == 0 {
+		defaultLimit = query.MaxLimit
+	}
+	limit, err := boundedInt(values, limitParam, defaultLimit, query.MaxLimit)
+	if err != nil {
+		return "", err
+	}
+	offset, err := boundedInt(values, offsetParam, 0, query.MaxOffset)
+	if err != nil {
+		return "", err
+	}
+
+	sql = strings.TrimRight(strings.TrimSpace(sql), ";")
+	// A newline ends any trailing line comment in the SQL.
+	sql = fmt.Sprintf("%s\nLIMIT %d", sql, limit)
+	if offset > 0 {
+		sql = fmt.Sprintf("%s OFFSET %d", sql, offset)
+	}
+	return sql, nil
+}
+
+// boundedInt parses the named URL parameter as an integer between 0 and max, where a max of 0 is unbounded.
+func boundedInt(values url.Values, name string, fallback, max int) (int, error) {
+	s := values.Get(name)
+	if s == "" {
+		return fallback, nil
+	}
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid %s %q, must be a non-negative integer", name, s)
+	}
+	if max > 0 && n > max {
+		return 0, fmt.Errorf("invalid %s %d, must be at most %d", name, n, max)
+	}
+	return n, nil
+}
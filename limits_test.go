@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+)
+
+func TestApplyLimits(t *testing.T) {
+	query := SQLQuery{MaxLimit: 100, MaxOffset: 1000, DefaultLimit: 10}
+	tests := []struct {
+		query   string
+		want    string
+		wantErr string
+	}{
+		{"", "SELECT n\nLIMIT 10", ""},
+		{"limit=50", "SELECT n\nLIMIT 50", ""},
+		{"limit=100&offset=1000", "SELECT n\nLIMIT 100 OFFSET 1000", ""},
+		{"limit=0", "SELECT n\nLIMIT 0", ""},
+		{"limit=101", "", "invalid limit 101, must be at most 100"},
+		{"offset=1001", "", "invalid offset 1001, must be at most 1000"},
+		{"limit=-1", "", `invalid limit "-1", must be a non-negative integer`},
+		{"limit=1%3BDROP", "", `invalid limit "1;DROP", must be a non-negative integer`},
+	}
+	for _, tc := range tests {
+		values, _ := url.ParseQuery(tc.query)
+		got, err := applyLimits(query, "SELECT n;", values)
+		if got != tc.want || errString(err) != tc.wantErr {
+			t.Errorf("applyLimits(%q) = %q, %q, want %q, %q", tc.query, got, errString(err), tc.want, tc.wantErr)
+		}
+	}
+
+	// The limit goes on its own line, so a trailing comment can't swallow it.
+	if got, _ := applyLimits(SQLQuery{MaxLimit: 5}, "SELECT n -- all of them", nil); got != "SELECT n -- all of them\nLIMIT 5" {
+		t.Errorf("applyLimits() after a comment = %q", got)
+	}
+}
+
+func TestCheckLimits(t *testing.T) {
+	tests := []struct {
+		query   SQLQuery
+		wantErr string
+	}{
+		{SQLQuery{}, ""},
+		{SQLQuery{MaxLimit: 100, MaxOffset: 10, DefaultLimit: 100}, ""},
+		{SQLQuery{MaxLimit: -1}, "max_limit, max_offset and default_limit cannot be negative"},
+		{SQLQuery{DefaultLimit: 10}, "max_offset and default_limit require max_limit"},
+		{SQLQuery{MaxLimit: 10, DefaultLimit: 20}, "default_limit 20 exceeds max_limit 10"},
+		{SQLQuery{MaxLimit: 10, LegacySQL: true}, "legacy SQL queries do not support limit and offset"},
+		{SQLQuery{MaxLimit: 10, Parameters: map[string]Parameter{"limit": {}}}, `parameter "limit" conflicts with the limit URL parameter enabled by max_limit`},
+	}
+	for _, tc := range tests {
+		if got := errString(checkLimits(&tc.query)); got != tc.wantErr {
+			t.Errorf("checkLimits(%+v) error = %q, want %q", tc.query, got, tc.wantErr)
+		}
+	}
+}
+
+func TestQueryHandlerLimits(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{Name: "numbers", SQL: "SELECT n FROM t", MaxLimit: 100})
+
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/numbers?limit=20&offset=40", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	if got, want := fake.lastRequest()["query"], "SELECT n FROM t\nLIMIT 20 OFFSET 40"; got != want {
+		t.Errorf("SQL = %q, want %q", got, want)
+	}
+
+	runs := fake.queryRuns()
+	w = httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/numbers?limit=1000", nil))
+	if w.Code != http.StatusBadRequest || fake.queryRuns() != runs {
+		t.Errorf("over the maximum: response = %d %s, want 400 without running the query", w.Code, w.Body.String())
+	}
+}
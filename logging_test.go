@@ -0,0 +1,143 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestSetupLogging(t *testing.T) {
+	defer slog.SetDefault(slog.Default())
+	for _, format := range []string{"text", "json"} {
+		if err := setupLogging(format); err != nil {
+			t.Errorf("setupLogging(%q) error: %v", format, err)
+		}
+	}
+	if err := setupLogging("xml"); err == nil {
+		t.Error("setupLogging(xml) succeeded, want an error")
+	}
+}
+
+func TestJSONLogs(t *testing.T) {
+	var buf bytes.Buffer
+	logger := slog.New(contextHandler{slog.NewJSONHandler(&buf, nil)})
+	logger.Info("Query handled", "query_name", "numbers", "status", 200)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", buf.String(), err)
+	}
+	if record["msg"] != "Query handled" || record["query_name"] != "numbers" || record["status"] != 200.0 || record["level"] != "INFO" {
+		t.Errorf("log record = %v, want the message, level and attributes", record)
+	}
+	if _, ok := record["request_id"]; ok {
+		t.Errorf("log record = %v, want no request_id outside a request", record)
+	}
+
+	// Attributes added to the logger are kept.
+	buf.Reset()
+	logger.With("component", "cache").InfoContext(context.Background(), "Cleared")
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil || record["component"] != "cache" {
+		t.Errorf("log line = %s, want the logger's attributes", buf.String())
+	}
+}
+
+func TestRequestIDHandler(t *testing.T) {
+	var seen string
+	h := requestIDHandler(func(w http.ResponseWriter, r *http.Request) {
+		seen, _ = r.Context().Value(requestIDKey{}).(string)
+	})
+
+	tests := []struct {
+		header   string
+		wantSame bool
+	}{
+		{"", false},
+		{"abc-123.x_y", true},
+		// IDs which aren't safe to log are replaced.
+		{"has space", false},
+		{"new\nline", false},
+		{strings.Repeat("a", 129), false},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("X-Request-ID", tc.header)
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		got := w.Header().Get("X-Request-ID")
+		if !validRequestID.MatchString(got) || got != seen {
+			t.Errorf("X-Request-ID %q: response ID %q, context ID %q, want the same valid ID", tc.header, got, seen)
+		}
+		if (got == tc.header) != tc.wantSame {
+			t.Errorf("X-Request-ID %q: response ID %q, want the incoming ID kept: %v", tc.header, got, tc.wantSame)
+		}
+	}
+}
+
+func TestRequestIDLogged(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, labelledQuery)
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(contextHandler{slog.NewJSONHandler(&buf, nil)}))
+
+	r := httptest.NewRequest(http.MethodGet, "/numbers", nil)
+	r.Header.Set("X-Request-ID", "req-1")
+	requestIDHandler(queryHandler)(httptest.NewRecorder(), r)
+
+	var record map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+		t.Fatalf("log line %q is not JSON: %v", buf.String(), err)
+	}
+	if record["msg"] != "Query handled" || record["request_id"] != "req-1" {
+		t.Errorf("log record = %v, want the request handled with request_id req-1", record)
+	}
+}
+
+func TestQueryHandlerLogSample(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, labelledQuery)
+	var buf bytes.Buffer
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&buf, nil)))
+	defer func(sample float64) { *logSample = sample }(*logSample)
+
+	tests := []struct {
+		sample  float64
+		url     string
+		wantMsg string
+	}{
+		{1, "/numbers", "Query handled"},
+		{0, "/numbers", ""},
+		// Failed requests are always logged.
+		{0, "/missing", "Query handled"},
+		{0, "/numbers?callback=1cb", "Query failed"},
+	}
+	for _, tc := range tests {
+		*logSample = tc.sample
+		buf.Reset()
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+
+		var record map[string]interface{}
+		if tc.wantMsg == "" {
+			if buf.Len() != 0 {
+				t.Errorf("%s with --log_sample=%v: logged %s, want nothing", tc.url, tc.sample, buf.String())
+			}
+			continue
+		}
+		if err := json.Unmarshal(buf.Bytes(), &record); err != nil {
+			t.Errorf("%s with --log_sample=%v: log line %q is not JSON: %v", tc.url, tc.sample, buf.String(), err)
+			continue
+		}
+		if record["msg"] != tc.wantMsg || record["status"] != float64(w.Code) || record["method"] != "GET" || record["duration_ms"] == nil {
+			t.Errorf("%s with --log_sample=%v: log record = %v, want %q with status %d", tc.url, tc.sample, record, tc.wantMsg, w.Code)
+		}
+	}
+}
@@ -2,17 +2,31 @@ package main
 
 import (
 	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"log/slog"
+	"math"
+	"math/big"
+	"mime"
 	"net/http"
 	"net/url"
+	"os"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 
 	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/api/googleapi"
 	"google.golang.org/api/iterator"
 	"gopkg.in/yaml.v2"
 )
@@ -21,43 +35,355 @@ import (
 type SQLQuery struct {
 	// The Name of the query, part of the URL used to call it.
 	Name string `yaml:"name"`
+	// Additional names the query can also be called by, such as its names before being renamed.
+	Aliases []string `yaml:"aliases"`
 	// The SQL function to run.
 	SQL string `yaml:"query"`
 	// Named-parameters the SQL function expects, with their type information.
-	Parameters map[string]bigquery.FieldType `yaml:"parameters"`
+	Parameters map[string]Parameter `yaml:"parameters"`
+	// How long the query may run before it is cancelled, overriding the --timeout flag.
+	Timeout time.Duration `yaml:"timeout"`
+	// The most rows returned before the response is truncated, overriding the --max_rows flag.
+	MaxRows int `yaml:"max_rows"`
+	// How long responses are cached in memory, 0 to disable caching.
+	CacheTTL time.Duration `yaml:"cache_ttl"`
+	// Whether the SQL is legacy SQL rather than standard SQL.
+	LegacySQL bool `yaml:"legacy_sql"`
+	// The Google Cloud Project to run the query in, overriding the --project flag.
+	Project string `yaml:"project"`
+	// Requests per second allowed for this query, 0 for no limit.
+	RateLimit float64 `yaml:"rate_limit"`
+	// Requests allowed in a burst above RateLimit, defaulting to one second's worth.
+	RateBurst int `yaml:"rate_burst"`
+	// Queries that would bill more bytes than this fail, overriding the --max_bytes_billed flag.
+	MaxBytesBilled int64 `yaml:"max_bytes_billed"`
+	// The location to run the query in, such as EU or us-central1, overriding the --location flag.
+	Location string `yaml:"location"`
+	// Labels applied to the query's jobs, for example to break down billing.
+	Labels map[string]string `yaml:"labels"`
+	// The priority of the query's jobs, interactive (the default) or batch.
+	Priority string `yaml:"priority"`
+	// Whether requests with undeclared parameters are rejected, overriding the --strict_params flag.
+	StrictParams *bool `yaml:"strict_params"`
+	// Names substituted into the SQL, each limited to a list of allowed values.
+	Identifiers map[string]Identifier `yaml:"identifiers"`
+	// The HTTP methods the query can be called with, GET and POST by default.
+	Methods []string `yaml:"methods"`
+	// Columns left out of the results, even when the SQL selects them.
+	ExcludeColumns []string `yaml:"exclude_columns"`
+	// The only columns written in the results, if set.
+	IncludeColumns []string `yaml:"include_columns"`
+	// The largest row count the limit URL parameter accepts. Setting it enables the limit and offset
+	// URL parameters, which are appended to the SQL as LIMIT and OFFSET clauses, so the SQL must not have its own.
+	MaxLimit int `yaml:"max_limit"`
+	// The largest offset the offset URL parameter accepts, 0 for no maximum.
+	MaxOffset int `yaml:"max_offset"`
+	// The limit used when the request has none, defaulting to MaxLimit.
+	DefaultLimit int `yaml:"default_limit"`
+	// The HTTP status returned when the query returns no rows: 200 (the default), 204 or 404.
+	EmptyStatus int `yaml:"empty_status"`
+	// Whether the SQL may contain statements other than SELECT queries, such as INSERT or CREATE TABLE.
+	AllowMutation bool `yaml:"allow_mutation"`
+	// A table the results are stored in and served from until they are refreshed.
+	Destination *Destination `yaml:"destination"`
+	// The columns the results are expected to have, published in the query listing.
+	Schema []SchemaField `yaml:"schema"`
+	// Whether JSON responses hold just the value of a result with one row and one column, as {"value": x}.
+	Scalar bool `yaml:"scalar"`
+	// A media type, like text/html, for responses holding just the text of a result with one row
+	// and one STRING column, instead of rows in the requested format.
+	ContentType string `yaml:"content_type"`
+	// Whether requests run in BigQuery sessions, so temporary tables persist between them.
+	// Requests without an X-BigQuery-Session-ID header start a session, whose ID is returned
+	// in that header, and requests with one run in that session.
+	Session bool `yaml:"session"`
+	// A text/template for the messages of the query's error responses, which can use
+	// {{.Query}}, {{.Status}}, {{.Message}} (the default message) and {{.Param}}.
+	ErrorMessage string `yaml:"error_message"`
+	// New names for columns in the results, by column name. Other columns keep their names.
+	// Renamed columns are still subject to --field_case.
+	Rename map[string]string `yaml:"rename"`
+	// BigQuery connection properties the query runs with, like time_zone.
+	ConnectionProperties map[string]string `yaml:"connection_properties"`
+	// A column whose integer value in the first row sets the HTTP status of the response.
+	// It is left out of the rows written.
+	StatusColumn string `yaml:"status_column"`
+
+	// The SQL compiled into a template, set when the query is loaded with Identifiers.
+	sqlTemplate *template.Template
+	// The labels set on the query's jobs, computed when the query is loaded and shared by every request.
+	jobLabels map[string]string
+	// The compiled ErrorMessage, set when the query is loaded.
+	errorTemplate *template.Template
+}
+
+// queryPriorities maps the priority names accepted in the queries file to BigQuery priorities.
+var queryPriorities = map[string]bigquery.QueryPriority{
+	"":            bigquery.InteractivePriority,
+	"interactive": bigquery.InteractivePriority,
+	"batch":       bigquery.BatchPriority,
 }
 
 var (
-	projectName = flag.String("project", "", "Google Cloud Project to query BigQuery as.")
-	queries     = flag.String("queries", "queries.yaml", "YAML file with queries.")
-	urlPath     = flag.String("url_path", "/", "URL path refix for all queries, example: /query/.")
-	port        = flag.Int("port", 8080, "Port to serve on.")
+	projectName     = flag.String("project", "", "Google Cloud Project to query BigQuery as, defaulting to $GOOGLE_CLOUD_PROJECT.")
+	credentials     = flag.String("credentials", "", "Service account key file to authenticate with, instead of Application Default Credentials.")
+	queries         = flag.String("queries", "queries.yaml", "Comma-separated YAML files with queries, empty to only use --queries_dir.")
+	queriesDir      = flag.String("queries_dir", "", "Directory of .sql files, each a query named after the file.")
+	urlPath         = flag.String("url_path", "/", "URL path refix for all queries, example: /query/.")
+	port            = flag.Int("port", 8080, "Port to serve on.")
+	unixSocket      = flag.String("unix_socket", "", "Path of a Unix domain socket to serve on instead of --port.")
+	debug           = flag.Bool("debug", false, "Include detailed error messages, which may contain SQL, in responses.")
+	maxRows         = flag.Int("max_rows", 0, "Default maximum number of rows returned per query, 0 for no limit.")
+	healthPath      = flag.String("health_path", "/healthz", "URL path of the liveness check, empty to disable.")
+	readyPath       = flag.String("ready_path", "/readyz", "URL path of the readiness check, which queries BigQuery, empty to disable.")
+	reloadPath      = flag.String("reload_path", "", "URL path which reloads the queries file on POST. Requires API keys. Empty to disable.")
+	metricsPath     = flag.String("metrics_path", "/metrics", "URL path of the Prometheus metrics endpoint, empty to disable.")
+	adminPath       = flag.String("admin_path", "", "URL path prefix of the admin endpoint showing the effective query configuration, like /admin/queries/. Requires API keys. Empty to disable.")
+	openAPIPath     = flag.String("openapi_path", "/openapi.json", "URL path of the OpenAPI document describing the queries, empty to disable.")
+	noDiscovery     = flag.Bool("disable_discovery", false, "Disable the query listing and OpenAPI document, so the available queries can't be discovered.")
+	cacheSize       = flag.Int("cache_entries", 1000, "Maximum number of responses kept in the result cache.")
+	cacheBytes      = flag.Int64("cache_bytes", 64<<20, "Maximum total size in bytes of the responses kept in the result cache, 0 for no limit.")
+	maxBilled       = flag.Int64("max_bytes_billed", 0, "Default maximum bytes a query may bill, 0 for the project default.")
+	shutdownTimeout = flag.Duration("shutdown_timeout", 30*time.Second, "How long to wait for in-flight requests when shutting down.")
+	allowedOrigins  = flag.String("allowed_origins", "", "Comma-separated origins allowed to make cross-origin requests, or * for any.")
+	apiKeyList      = flag.String("api_keys", "", "Comma-separated API keys which may call any query. Authentication is disabled without any keys.")
+	apiKeysFile     = flag.String("api_keys_file", "", "YAML file of API keys, each optionally limited to a list of queries.")
+	rateLimit       = flag.Float64("rate_limit", 0, "Requests per second allowed across all queries, 0 for no limit.")
+	rateBurst       = flag.Int("rate_burst", 0, "Requests allowed in a burst above --rate_limit, defaulting to one second's worth.")
+	logFormat       = flag.String("log_format", "text", "Log output format, text or json.")
+	logSample       = flag.Float64("log_sample", 1, "Fraction of successful requests to log, between 0 and 1. Failed requests are always logged.")
+	timeout         = flag.Duration("timeout", 0, "Default time a query may run before it is cancelled, 0 for no limit.")
+	location        = flag.String("location", "", "Default location to run queries in, such as EU or us-central1. Empty lets BigQuery choose.")
+	labelQueries    = flag.Bool("label_queries", true, "Label query jobs with proxy_query=<query name>.")
+	tlsCert         = flag.String("tls_cert", "", "Certificate file to serve HTTPS with, requires --tls_key.")
+	tlsKey          = flag.String("tls_key", "", "Private key file to serve HTTPS with, requires --tls_cert.")
+	tlsMinVersion   = flag.String("tls_min_version", "1.2", "Minimum TLS version accepted when serving HTTPS: 1.0, 1.1, 1.2 or 1.3.")
+	strictParams    = flag.Bool("strict_params", false, "Reject requests with parameters the query does not declare.")
+	maxConcurrency  = flag.Int("max_concurrency", 0, "Maximum number of queries run at once, 0 for no limit.")
+	concurrencyWait = flag.Duration("concurrency_wait", 0, "How long a request waits for a query to finish when --max_concurrency queries are running.")
+	envelope        = flag.Bool("envelope", false, "Wrap JSON results in an object with the query name, row count and elapsed time.")
+	pretty          = flag.Bool("pretty", false, "Indent JSON results, for readability. The pretty URL parameter overrides this per request.")
+	showVersion     = flag.Bool("version", false, "Print the version and exit.")
+	validateOnly    = flag.Bool("validate", false, "Check the queries and API keys are valid and exit, without connecting to BigQuery or serving.")
+	versionHeader   = flag.Bool("version_header", false, "Report the version in an X-BQProxy-Version response header.")
+	fieldCase       = flag.String("field_case", caseNone, "Case of field names in results: none to keep column names, camel or snake.")
+	int64AsString   = flag.Bool("int64_as_string", false, "Write INTEGER results as strings, which JavaScript clients can read without losing precision.")
+	readTimeout     = flag.Duration("read_timeout", time.Minute, "Maximum time to read a request, including its body, 0 for no limit.")
+	headerTimeout   = flag.Duration("read_header_timeout", 10*time.Second, "Maximum time to read request headers, 0 for no limit.")
+	writeTimeout    = flag.Duration("write_timeout", 10*time.Minute, "Maximum time to run a query and write its response, 0 for no limit.")
+	idleTimeout     = flag.Duration("idle_timeout", 2*time.Minute, "How long idle keep-alive connections are kept open, 0 to use --read_timeout.")
+	maxHeaderBytes  = flag.Int("max_header_bytes", http.DefaultMaxHeaderBytes, "Maximum size of request headers.")
+	maxRetries      = flag.Int("max_retries", 2, "How many times to retry queries failing with transient BigQuery errors.")
+	maxRespBytes    = flag.Int64("max_response_bytes", 0, "Maximum size of the rows in a response, 0 for no limit. Larger responses fail.")
+	maxQueryLength  = flag.Int("max_query_length", 0, "Maximum length of a request's query string, 0 for no limit. Longer requests fail with 414.")
+	pageSecret      = flag.String("page_token_secret", "", "Secret used to sign page tokens, so they remain valid across restarts and replicas. Random if empty.")
 )
 
+// dateTimeLayout formats DATETIME values, which carry no time zone information.
+const dateTimeLayout = "2006-01-02T15:04:05.999999"
+
+// timeLayout formats TIME values as HH:MM:SS, with fractional seconds only when present.
+const timeLayout = "15:04:05.999999"
+
 var bqClient *bigquery.Client
-var sqlQueries = map[string]SQLQuery{}
+var results *resultCache
+
+// sqlQueries holds the loaded queries by name and is replaced when queries are reloaded.
+// It must only be accessed through lookupQuery, allQueries and setQueries.
+var (
+	queriesMu  sync.RWMutex
+	sqlQueries = map[string]SQLQuery{}
+)
+
+// lookupQuery returns the query with the given name.
+func lookupQuery(name string) (SQLQuery, bool) {
+	queriesMu.RLock()
+	defer queriesMu.RUnlock()
+	q, ok := sqlQueries[name]
+	return q, ok
+}
+
+// allQueries returns all the loaded queries by name, including an entry for each alias.
+// The map must not be modified.
+func allQueries() map[string]SQLQuery {
+	queriesMu.RLock()
+	defer queriesMu.RUnlock()
+	return sqlQueries
+}
+
+// setQueries replaces all the loaded queries.
+func setQueries(loaded map[string]SQLQuery) {
+	queriesMu.Lock()
+	defer queriesMu.Unlock()
+	sqlQueries = loaded
+}
+
+// pathConflicts reports whether an endpoint path is also the URL of a query.
+func pathConflicts(path string) bool {
+	_, ok := lookupQuery(strings.TrimPrefix(path, *urlPath))
+	return ok && strings.HasPrefix(path, *urlPath)
+}
+
+// validateConfig loads the queries and API keys, reporting the first problem with them.
+// Nothing connects to BigQuery, so it can be run where there are no credentials.
+func validateConfig() error {
+	loaded, err := loadConfiguredQueries()
+	if err != nil {
+		return fmt.Errorf("loading queries: %v", err)
+	}
+	setQueries(loaded)
+	for _, path := range []string{*healthPath, *readyPath, *metricsPath, *reloadPath, *openAPIPath, *adminPath} {
+		if path != "" && pathConflicts(path) {
+			return fmt.Errorf("path %s conflicts with a query of the same name", path)
+		}
+	}
+	keys, err := loadAPIKeys(*apiKeyList, *apiKeysFile)
+	if err != nil {
+		return fmt.Errorf("loading API keys: %v", err)
+	}
+	if *adminPath != "" && len(keys) == 0 {
+		return errors.New("--admin_path requires API keys, set with --api_keys or --api_keys_file")
+	}
+	if *reloadPath != "" && len(keys) == 0 {
+		return errors.New("--reload_path requires API keys, set with --api_keys or --api_keys_file")
+	}
+	return nil
+}
 
 func main() {
 	ctx := context.Background()
 	flag.Parse()
+	if err := applyEnv(flag.CommandLine, os.LookupEnv); err != nil {
+		log.Fatal(err)
+	}
+
+	if *showVersion {
+		fmt.Println(versionString())
+		return
+	}
+
+	if err := setupLogging(*logFormat); err != nil {
+		log.Fatalf("Error configuring logging: %v", err)
+	}
+	if err := checkFieldCase(*fieldCase); err != nil {
+		log.Fatal(err)
+	}
+	if *logSample < 0 || *logSample > 1 {
+		log.Fatalf("Invalid --log_sample %v, must be between 0 and 1.", *logSample)
+	}
+	if *validateOnly {
+		if err := validateConfig(); err != nil {
+			log.Fatalf("Invalid configuration: %v", err)
+		}
+		slog.Info("Configuration is valid", "file", *queries, "dir", *queriesDir)
+		return
+	}
+
+	v, rev, date := buildInfo()
+	slog.Info("Starting bqproxy", "version", v, "commit", rev, "build_date", date)
 
 	if *projectName == "" {
-		log.Fatalf("Empty project flag.")
+		log.Fatalf("No project: set the --project flag or the GOOGLE_CLOUD_PROJECT environment variable.")
 	}
 
-	var err error
-	if bqClient, err = bigquery.NewClient(ctx, *projectName); err != nil {
+	tlsConf, err := tlsConfig(*tlsCert, *tlsKey, *tlsMinVersion)
+	if err != nil {
+		log.Fatalf("Error configuring TLS: %v", err)
+	}
+
+	if bqClient, err = clientFor(ctx, *projectName); err != nil {
+		log.Fatalf("Error connecting to Bigquery: %v", err)
+	}
+
+	loaded, err := loadConfiguredQueries()
+	if err != nil {
+		log.Fatalf("Error loading queries: %v", err)
+	}
+	if err := createClients(ctx, loaded); err != nil {
 		log.Fatalf("Error connecting to Bigquery: %v", err)
 	}
+	setQueries(loaded)
+
+	if apiKeys, err = loadAPIKeys(*apiKeyList, *apiKeysFile); err != nil {
+		log.Fatalf("Error loading API keys: %v", err)
+	}
+	if *adminPath != "" && len(apiKeys) == 0 {
+		log.Fatalf("--admin_path requires API keys, set with --api_keys or --api_keys_file.")
+	}
+	if *reloadPath != "" && len(apiKeys) == 0 {
+		log.Fatalf("--reload_path requires API keys, set with --api_keys or --api_keys_file.")
+	}
+	slog.Info("Loaded queries", "count", len(loaded), "file", *queries, "dir", *queriesDir)
 
-	if sqlQueries, err = loadQueries(*queries); err != nil {
-		log.Fatalf("Error loading queries from %s: %v", *queries, err)
+	results = newResultCache(*cacheSize, *cacheBytes)
+	setPageTokenKey(*pageSecret)
+	if *rateLimit > 0 {
+		globalLimiter = newLimiter(*rateLimit, *rateBurst)
+	}
+	if *maxConcurrency > 0 {
+		querySlots = make(chan struct{}, *maxConcurrency)
+	}
+	reloadOnSignal()
+
+	if *noDiscovery {
+		*openAPIPath = ""
+	}
+	for path, handler := range map[string]http.HandlerFunc{
+		*healthPath:  healthHandler,
+		*readyPath:   readyHandler,
+		*metricsPath: promhttp.Handler().ServeHTTP,
+		*reloadPath:  adminHandler(reloadHandler),
+		*openAPIPath: authHandler(openAPIHandler),
+		*adminPath:   adminHandler(adminQueriesHandler),
+	} {
+		if path == "" {
+			continue
+		}
+		if pathConflicts(path) {
+			log.Fatalf("Path %s conflicts with a query of the same name.", path)
+		}
+		http.HandleFunc(path, handler)
 	}
-	log.Printf("Loaded %d queries from %s.",
-		len(sqlQueries), *queries)
 
-	http.HandleFunc(*urlPath, queryHandler)
-	log.Fatal(http.ListenAndServe(fmt.Sprintf(":%d", *port), nil))
+	http.HandleFunc(*urlPath, requestIDHandler(versionHandler(corsHandler(metricsHandler(authHandler(gzipHandler(proxyHandler)))))))
+	if err := serve(newServer(tlsConf)); err != nil {
+		log.Fatal(err)
+	}
+	closeClients()
+}
+
+// queriesFile is a queries file with defaults shared by its queries.
+type queriesFile struct {
+	Defaults queryDefaults `yaml:"defaults"`
+	Queries  []SQLQuery    `yaml:"queries"`
+}
+
+// queryDefaults holds settings inherited by every query in a queries file.
+type queryDefaults struct {
+	// Parameters added to queries whose SQL uses them. Queries declaring an optional
+	// parameter without a default of their own inherit the default given here.
+	Parameters map[string]Parameter `yaml:"parameters"`
+}
+
+// apply merges the defaults into q, keeping any settings of q's own.
+func (d queryDefaults) apply(q *SQLQuery) {
+	if len(d.Parameters) == 0 {
+		return
+	}
+	used := sqlParameters(q.SQL)
+	for name, param := range d.Parameters {
+		own, declared := q.Parameters[name]
+		switch {
+		case !declared && used[name]:
+			if q.Parameters == nil {
+				q.Parameters = map[string]Parameter{}
+			}
+			q.Parameters[name] = param
+		case declared && own.Default == nil && !own.Required && !own.Nullable && !own.Repeated:
+			own.Default = param.Default
+			q.Parameters[name] = own
+		}
+	}
 }
 
 func loadQueries(path string) (map[string]SQLQuery, error) {
@@ -66,70 +392,772 @@ func loadQueries(path string) (map[string]SQLQuery, error) {
 		return nil, err
 	}
 
-	queries := []SQLQuery{}
-	if err := yaml.Unmarshal(dat, &queries); err != nil {
+	// The file is either a list of queries or a mapping with defaults alongside the queries.
+	var top interface{}
+	if err := yaml.Unmarshal(dat, &top); err != nil {
+		return nil, err
+	}
+	file := queriesFile{}
+	if _, isList := top.([]interface{}); isList {
+		err = yaml.Unmarshal(dat, &file.Queries)
+	} else {
+		err = yaml.UnmarshalStrict(dat, &file)
+	}
+	if err != nil {
+		return nil, err
+	}
+	queries := file.Queries
+	for i := range queries {
+		file.Defaults.apply(&queries[i])
+	}
+
+	// Aliases share the namespace of query names, so they are checked together.
+	names := []string{}
+	for _, q := range queries {
+		names = append(append(names, q.Name), q.Aliases...)
+	}
+	if err := checkQueryNames(names); err != nil {
 		return nil, err
 	}
 
 	result := map[string]SQLQuery{}
 	for _, q := range queries {
+		if err := prepareQuery(&q); err != nil {
+			return nil, fmt.Errorf("query %q: %v", q.Name, err)
+		}
 		result[q.Name] = q
+		for _, alias := range q.Aliases {
+			result[alias] = q
+		}
 	}
 
 	return result, nil
 }
 
+// queryNamePattern matches query names made of characters which need no escaping in a URL path.
+var queryNamePattern = regexp.MustCompile(`^[A-Za-z0-9._~-]+$`)
+
+// checkQueryNames reports query names which are duplicated or not URL-path-safe.
+func checkQueryNames(names []string) error {
+	count := map[string]int{}
+	var invalid, duplicate []string
+	for _, name := range names {
+		if !queryNamePattern.MatchString(name) {
+			invalid = append(invalid, strconv.Quote(name))
+		}
+		if count[name]++; count[name] == 2 {
+			duplicate = append(duplicate, strconv.Quote(name))
+		}
+	}
+
+	var problems []string
+	if len(invalid) > 0 {
+		problems = append(problems, "names must only contain letters, digits, '.', '_', '~' and '-': "+strings.Join(invalid, ", "))
+	}
+	if len(duplicate) > 0 {
+		problems = append(problems, "duplicate names: "+strings.Join(duplicate, ", "))
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// defaultMethods are the HTTP methods allowed for queries which do not list their own.
+var defaultMethods = []string{http.MethodGet, http.MethodPost}
+
+// prepareQuery validates a loaded query and compiles its parameter patterns.
+func prepareQuery(q *SQLQuery) error {
+	if q.LegacySQL && len(q.Parameters) > 0 {
+		return errors.New("legacy SQL queries do not support parameters")
+	}
+	if err := checkParameters(q); err != nil {
+		return err
+	}
+	if !q.AllowMutation {
+		if err := checkReadOnly(q.SQL); err != nil {
+			return err
+		}
+	}
+	if err := prepareIdentifiers(q); err != nil {
+		return err
+	}
+	if err := checkLimits(q); err != nil {
+		return err
+	}
+	if err := prepareDestination(q); err != nil {
+		return err
+	}
+	if err := prepareSchema(q); err != nil {
+		return err
+	}
+	switch q.EmptyStatus {
+	case 0, http.StatusOK, http.StatusNoContent, http.StatusNotFound:
+	default:
+		return fmt.Errorf("invalid empty_status %d, must be 200, 204 or 404", q.EmptyStatus)
+	}
+	if len(q.ExcludeColumns) > 0 && len(q.IncludeColumns) > 0 {
+		return errors.New("exclude_columns and include_columns cannot both be set")
+	}
+	if err := checkRename(q.Rename); err != nil {
+		return err
+	}
+	if err := checkConnectionProperties(q.ConnectionProperties); err != nil {
+		return err
+	}
+	if q.ContentType != "" {
+		if _, _, err := mime.ParseMediaType(q.ContentType); err != nil {
+			return fmt.Errorf("invalid content_type %q: %v", q.ContentType, err)
+		}
+		if q.Scalar {
+			return errors.New("content_type and scalar cannot both be set")
+		}
+	}
+	// Results in a session depend on the state of the session, so can't be shared.
+	if q.Session && (q.CacheTTL > 0 || q.Destination != nil) {
+		return errors.New("session queries cannot have a cache_ttl or destination")
+	}
+	if len(q.Methods) == 0 {
+		q.Methods = append([]string{}, defaultMethods...)
+	}
+	for i, method := range q.Methods {
+		q.Methods[i] = strings.ToUpper(method)
+		if q.Methods[i] != http.MethodGet && q.Methods[i] != http.MethodPost {
+			return fmt.Errorf("unsupported method %q, must be GET or POST", method)
+		}
+	}
+	if err := checkLabels(q.Labels); err != nil {
+		return err
+	}
+	q.jobLabels = queryLabels(*q)
+	if err := prepareErrorMessage(q); err != nil {
+		return err
+	}
+	if _, ok := queryPriorities[q.Priority]; !ok {
+		return fmt.Errorf("invalid priority %q, must be interactive or batch", q.Priority)
+	}
+
+	for key, param := range q.Parameters {
+		param, err := prepareParameter(key, param)
+		if err != nil {
+			return err
+		}
+		q.Parameters[key] = param
+	}
+	return nil
+}
+
+// prepareParameter validates a parameter's options and compiles its pattern,
+// along with those of the fields of RECORD parameters.
+func prepareParameter(key string, param Parameter) (Parameter, error) {
+	param.Type = bigquery.FieldType(strings.ToUpper(string(param.Type)))
+	// Standard SQL names, like INT64 and STRUCT, are accepted as they are for schemas.
+	if alias, ok := fieldTypeAliases[string(param.Type)]; ok {
+		param.Type = alias
+	}
+	if !parameterTypes[param.Type] {
+		return param, fmt.Errorf("unsupported type %q for parameter %q", param.Type, key)
+	}
+	if param.Type == bigquery.RecordFieldType {
+		if len(param.Fields) == 0 {
+			return param, fmt.Errorf("RECORD parameter %q has no fields", key)
+		}
+		if param.Repeated || param.Default != nil || param.Pattern != "" || param.Transform != "" {
+			return param, fmt.Errorf("RECORD parameter %q cannot be repeated or have a default, pattern or transform", key)
+		}
+		fields := map[string]Parameter{}
+		for name, field := range param.Fields {
+			field, err := prepareParameter(key+"."+name, field)
+			if err != nil {
+				return param, err
+			}
+			if field.Repeated {
+				return param, fmt.Errorf("field %q of RECORD parameter %q cannot be repeated", name, key)
+			}
+			fields[name] = field
+		}
+		param.Fields = fields
+	} else if len(param.Fields) > 0 {
+		return param, fmt.Errorf("parameter %q has fields but is not a RECORD", key)
+	}
+
+	if param.Transform != "" {
+		if _, ok := transforms[param.Transform]; !ok {
+			return param, fmt.Errorf("unknown transform %q for parameter %q, must be epoch_ms_to_timestamp, lowercase or trim", param.Transform, key)
+		}
+		if param.Transform == "epoch_ms_to_timestamp" && param.Type != bigquery.TimestampFieldType {
+			return param, fmt.Errorf("parameter %q with transform epoch_ms_to_timestamp must be a TIMESTAMP", key)
+		}
+	}
+	if param.Pattern != "" {
+		re, err := regexp.Compile(param.Pattern)
+		if err != nil {
+			return param, fmt.Errorf("invalid pattern for parameter %q: %v", key, err)
+		}
+		param.pattern = re
+	}
+	if param.Repeated && param.Default != nil {
+		return param, fmt.Errorf("repeated parameter %q cannot have a default", key)
+	}
+	if param.Min != nil || param.Max != nil {
+		switch param.Type {
+		case bigquery.IntegerFieldType, bigquery.FloatFieldType, bigquery.NumericFieldType:
+		default:
+			return param, fmt.Errorf("parameter %q has min or max but is not INTEGER, FLOAT or NUMERIC", key)
+		}
+		if param.Min != nil && param.Max != nil && *param.Min > *param.Max {
+			return param, fmt.Errorf("parameter %q has min greater than max", key)
+		}
+	}
+	if param.Nullable && (param.Required || param.Repeated || param.Default != nil) {
+		return param, fmt.Errorf("nullable parameter %q cannot be required, repeated or have a default", key)
+	}
+	if param.Default != nil {
+		if _, err := paramValue(param, *param.Default); err != nil {
+			return param, fmt.Errorf("invalid default for parameter %q: %v", key, err)
+		}
+	}
+	return param, nil
+}
+
+// allowsMethod reports whether the query can be called with the HTTP method.
+func (q SQLQuery) allowsMethod(method string) bool {
+	for _, m := range q.Methods {
+		if m == method {
+			return true
+		}
+	}
+	return false
+}
+
 func queryHandler(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	start := time.Now()
 
 	queryName := strings.TrimPrefix(r.URL.Path, *urlPath)
-	query, ok := sqlQueries[queryName]
+
+	// Log a single structured line per request once it has been handled.
+	rec := &statusRecorder{ResponseWriter: w}
+	w = rec
+	var processed int64
+	var reqErr error
+	defer func() {
+		attrs := []interface{}{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"query_name", queryName,
+			"status", rec.statusCode(),
+			"duration_ms", time.Since(start).Milliseconds(),
+			"bytes_processed", processed,
+		}
+		if reqErr != nil {
+			slog.ErrorContext(r.Context(), "Query failed", append(attrs, "error", reqErr)...)
+			return
+		}
+		if rec.statusCode() < http.StatusBadRequest && !logSampled() {
+			return
+		}
+		slog.InfoContext(r.Context(), "Query handled", attrs...)
+	}()
+
+	if *maxQueryLength > 0 && len(r.URL.RawQuery) > *maxQueryLength {
+		writeError(w, http.StatusRequestURITooLong, "query string too long", nil)
+		return
+	}
+
+	query, ok := lookupQuery(queryName)
 	if !ok {
-		w.WriteHeader(http.StatusNotFound)
+		writeError(w, http.StatusNotFound, "query not found", nil)
+		return
+	}
+	if !query.allowsMethod(r.Method) {
+		w.Header().Set("Allow", strings.Join(query.Methods, ", "))
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed", nil)
+		return
+	}
+	if query.errorTemplate != nil {
+		w = &errorMessageWriter{ResponseWriter: w, query: query}
+	}
+
+	// Query parses the URL afresh on each call, so it is only done once and passed on.
+	values := r.URL.Query()
+
+	if _, err := jsonpCallback(values); err != nil {
+		reqErr = err
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+	// Unknown formats are rejected rather than served as JSON, so they can't fill the cache with copies.
+	if err := checkFormat(values); err != nil {
+		reqErr = err
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	body, err := readBodyParams(w, r)
+	if err != nil {
+		reqErr = err
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	session, err := requestSession(r)
+	if err == nil && session != "" && !query.Session {
+		err = errors.New("query does not run in sessions")
+	}
+	if err != nil {
+		reqErr = err
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	dryRunRequested := values.Get("dryRun") == "true"
+	explainRequested := values.Get("explain") == "true"
+
+	// Dry runs and query plans describe a single run of the query rather than its results, so aren't cached.
+	cacheTTL := query.CacheTTL
+	if dryRunRequested || explainRequested {
+		cacheTTL = 0
+	}
+	w.Header().Set("Cache-Control", cacheControl(cacheTTL))
+	if cacheTTL > 0 {
+		key := cacheKey(queryName, r, values, body)
+		if e, ok := results.get(key); ok {
+			serveCached(w, r, e)
+			return
+		}
+
+		rec := &cacheRecorder{statusRecorder: statusRecorder{ResponseWriter: w}}
+		w = rec
+		defer func() {
+			// Streamed responses start with a 200 status even if reading the results later fails.
+			if rec.status == http.StatusOK && reqErr == nil {
+				results.add(key, rec.entry(cacheTTL))
+			}
+		}()
+	}
+
+	if retry, ok := checkRateLimits(query); !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+		writeError(w, http.StatusTooManyRequests, "rate limit exceeded", nil)
+		return
+	}
+
+	strict := *strictParams
+	if query.StrictParams != nil {
+		strict = *query.StrictParams
+	}
+	if strict {
+		if err := checkUnknownParams(query, values, body); err != nil {
+			reqErr = err
+			writeError(w, http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+	}
+
+	sql, err := renderSQL(query, values, body)
+	if err == nil {
+		sql, err = applyLimits(query, sql, values)
+	}
+	if err != nil {
+		reqErr = err
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
 		return
 	}
 
-	q := bqClient.Query(query.SQL)
+	q := newQuery(query)
+	q.Q = sql
+	if query.Session {
+		setSession(q, session)
+	}
+	useJobsInsert(q)
 
 	// Add query paramters.
-	var err error
-	q.Parameters, err = buildQueryParams(query.Parameters, r.URL.Query())
+	q.Parameters, err = buildQueryParams(query.Parameters, values, body)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		log.Printf("Error parsing params: %v", err)
+		reqErr = err
+		writeParamErrors(w, err.(paramErrors))
+		return
+	}
+
+	queryTimeout := *timeout
+	if query.Timeout > 0 {
+		queryTimeout = query.Timeout
+	}
+	if queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, queryTimeout)
+		defer cancel()
+	}
+
+	if dryRunRequested {
+		reqErr = dryRun(ctx, w, q)
 		return
 	}
 
+	page, err := parsePaging(values, queryName)
+	if err != nil {
+		reqErr = err
+		if err == errStalePageToken {
+			writeError(w, http.StatusGone, err.Error(), nil)
+			return
+		}
+		writeError(w, http.StatusBadRequest, err.Error(), nil)
+		return
+	}
+
+	// Unknown fields are rejected before the query runs, so the request isn't billed.
+	if page.token == nil && values.Get(fieldsParam) != "" {
+		schema, err := resultSchema(ctx, query, q)
+		if err != nil {
+			reqErr = err
+			writeQueryError(ctx, w, "query failed", err)
+			return
+		}
+		if _, err := requestFields(values, schema); err != nil {
+			reqErr = err
+			writeError(w, http.StatusBadRequest, err.Error(), nil)
+			return
+		}
+	}
+
+	release, ok := acquireSlot(ctx)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Max(1, math.Ceil(concurrencyWait.Seconds())))))
+		writeError(w, http.StatusServiceUnavailable, "too many queries running", nil)
+		return
+	}
+	defer release()
+
+	// Explaining a query runs it, so it takes a query slot like any other.
+	if explainRequested {
+		reqErr = explain(ctx, w, q)
+		return
+	}
+
+	// Later pages are read from the results of the query run for the first page.
+	if page.token != nil {
+		it, err := readPage(ctx, queryClient(query), page.token)
+		if err != nil {
+			reqErr = err
+			if hasErrorReason(err, "notFound") {
+				writeError(w, http.StatusGone, errStalePageToken.Error(), err)
+				return
+			}
+			writeQueryError(ctx, w, "reading query results failed", err)
+			return
+		}
+		reqErr = writeResults(ctx, w, r, values, query, it, page, start)
+		return
+	}
+
+	// Serve stored results from the destination table while they are fresh.
+	if query.Destination != nil {
+		if it, ok := readDestination(ctx, query); ok {
+			reqErr = writeResults(ctx, w, r, values, query, it, page, start)
+			return
+		}
+	}
+
 	// Run the query.
-	it, err := q.Read(ctx)
+	var it *bigquery.RowIterator
+	err = withRetry(ctx, func() error {
+		var err error
+		it, err = q.Read(ctx)
+		return err
+	})
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		log.Printf("BigQuery error: %v", err)
+		reqErr = err
+		// Clients can start a new session once theirs has expired.
+		if session != "" && isSessionError(err) {
+			writeError(w, http.StatusGone, errSessionExpired.Error(), err)
+			return
+		}
+		writeQueryError(ctx, w, "query failed", err)
 		return
 	}
+	if stats := jobStatistics(ctx, it); stats != nil {
+		if query.Session && stats.SessionInfo != nil {
+			w.Header().Set(sessionHeader, stats.SessionInfo.SessionID)
+		}
+		processed = stats.TotalBytesProcessed
+		bytesProcessed.WithLabelValues(queryName).Add(float64(processed))
+		w.Header().Set("X-BigQuery-Bytes-Processed", strconv.FormatInt(processed, 10))
+		if details, ok := stats.Details.(*bigquery.QueryStatistics); ok {
+			w.Header().Set("X-BigQuery-Cache-Hit", strconv.FormatBool(details.CacheHit))
+		}
+	}
+
+	reqErr = writeResults(ctx, w, r, values, query, it, page, start)
+}
+
+// errResponseTooLarge is returned when the rows of a response exceed --max_response_bytes.
+var errResponseTooLarge = errors.New("response exceeds the maximum size")
+
+// writeResults reads the rows from it and writes them to the response to r, whose URL parameters
+// are values, returning any error once it has been written to the response.
+func writeResults(ctx context.Context, w http.ResponseWriter, r *http.Request, values url.Values, query SQLQuery, it *bigquery.RowIterator, page paging, start time.Time) error {
+	rowLimit := *maxRows
+	if query.MaxRows > 0 {
+		rowLimit = query.MaxRows
+	}
+	// Pages are no larger than the row limit.
+	if page.size > 0 && (rowLimit == 0 || page.size < rowLimit) {
+		rowLimit = page.size
+	}
+
+	var offset uint64
+	if page.token != nil {
+		offset = page.token.Offset
+	}
+	if rowLimit > 0 {
+		// Fetch at most one row more than needed, which shows whether there are more rows.
+		it.PageInfo().MaxSize = rowLimit + 1
+	}
+
+	if job := it.SourceJob(); job != nil {
+		w.Header().Set("X-BigQuery-Job-ID", job.ID())
+	}
 
-	rows := []map[string]interface{}{}
+	out := &statusOverrideWriter{ResponseWriter: w}
+	rw := newResultWriter(out, r, values, query.ContentType)
+	// The schema is only known once the first page of results has been read.
+	var schema bigquery.Schema
+	rowCount := 0
+	truncated := false
 	for {
+		// Rows already fetched would otherwise be read and written for a client which has gone away.
+		if err := ctx.Err(); err != nil {
+			slog.InfoContext(ctx, "Request cancelled, no longer reading results", "query_name", query.Name, "rows", rowCount, "error", err)
+			if !rw.streaming() || rowCount == 0 {
+				writeQueryError(ctx, w, "reading query results failed", err)
+			}
+			return err
+		}
+
 		rawRow := map[string]bigquery.Value{}
 		err := it.Next(&rawRow)
 		if err == iterator.Done {
 			break
 		}
 		if err != nil {
-			w.WriteHeader(http.StatusInternalServerError)
-			log.Printf("BigQuery read error: %v", err)
+			// Once streaming has begun the status has been sent, so the response just ends early.
+			if !rw.streaming() || rowCount == 0 {
+				writeQueryError(ctx, w, "reading query results failed", err)
+			}
+			return err
+		}
+		if rowLimit > 0 && rowCount >= rowLimit {
+			truncated = true
+			break
+		}
+		if schema == nil {
+			if query.StatusColumn != "" {
+				out.status = resultStatus(ctx, query, it.Schema, rawRow)
+			}
+			schema = renameColumns(query, selectColumns(query, it.Schema))
+			if len(query.Schema) > 0 {
+				if err := checkSchema(query.Schema, schema); err != nil {
+					slog.WarnContext(ctx, "Unexpected result schema", "query_name", query.Name, "error", err)
+				}
+			}
+			if schema, err = requestFields(values, schema); err != nil {
+				writeError(w, http.StatusBadRequest, err.Error(), nil)
+				return err
+			}
+		}
+		if err := rw.writeRow(schema, convertRecord(schema, renameRow(query, rawRow))); err != nil {
+			if !rw.streaming() {
+				writeError(w, http.StatusInternalServerError, "encoding results failed", err)
+			}
+			return err
+		}
+		rowCount++
+		if *maxRespBytes > 0 && rw.size() > *maxRespBytes {
+			slog.WarnContext(ctx, "Response exceeds --max_response_bytes", "query_name", query.Name, "rows", rowCount, "max_response_bytes", *maxRespBytes)
+			if !rw.streaming() {
+				writeError(w, http.StatusInternalServerError, errResponseTooLarge.Error(), nil)
+			}
+			return errResponseTooLarge
+		}
+	}
+
+	if rowCount == 0 {
+		switch query.EmptyStatus {
+		case http.StatusNoContent:
+			w.WriteHeader(http.StatusNoContent)
+			return nil
+		case http.StatusNotFound:
+			writeError(w, http.StatusNotFound, "no results", nil)
+			return nil
 		}
-		row := make(map[string]interface{})
+	}
 
-		for _, field := range it.Schema {
-			row[field.Name] = castField(field.Type, rawRow[field.Name])
+	// A page which does not reach the end of the results links to the next one instead of being truncated.
+	info := resultInfo{
+		truncated: truncated,
+		paged:     page.size > 0,
+		envelope:  wantsEnvelope(values),
+		query:     query.Name,
+		elapsed:   time.Since(start),
+		scalar:    query.Scalar,
+	}
+	if truncated && info.paged {
+		if job := it.SourceJob(); job != nil {
+			info.truncated = false
+			info.nextPageToken = newPageToken(query.Name, job, offset+uint64(rowCount)).encode()
+		}
+	}
+	if schema == nil {
+		var err error
+		if schema, err = requestFields(values, renameColumns(query, selectColumns(query, it.Schema))); err != nil {
+			writeError(w, http.StatusBadRequest, err.Error(), nil)
+			return err
 		}
-		rows = append(rows, row)
 	}
+	return rw.close(schema, info)
+}
+
+// convertRecord converts a row or RECORD value read from BigQuery into a map keyed by field name.
+// Every field in the schema has a key, with a null value if it is missing from raw.
+func convertRecord(schema bigquery.Schema, raw map[string]bigquery.Value) map[string]interface{} {
+	row := make(map[string]interface{}, len(schema))
+	for _, field := range schema {
+		row[fieldKey(field.Name)] = convertValue(field, raw[field.Name])
+	}
+	return row
+}
+
+// convertValue converts a value read from BigQuery into one suitable for JSON encoding.
+// Repeated fields are converted element by element into a slice.
+func convertValue(field *bigquery.FieldSchema, v bigquery.Value) interface{} {
+	if !field.Repeated || v == nil {
+		return convertElement(field, v)
+	}
+
+	elems, ok := v.([]bigquery.Value)
+	if !ok {
+		// The client always reads repeated fields as slices, but anything else is kept as a single value.
+		return convertElement(field, v)
+	}
+	result := make([]interface{}, len(elems))
+	for i, e := range elems {
+		result[i] = convertElement(field, e)
+	}
+	return result
+}
+
+// convertElement converts a single, non-repeated value, recursing into nested RECORD fields.
+func convertElement(field *bigquery.FieldSchema, v bigquery.Value) interface{} {
+	if v == nil {
+		return nil
+	}
+	if field.Type == bigquery.RecordFieldType {
+		return convertRecord(field.Schema, v.(map[string]bigquery.Value))
+	}
+	return castField(field.Type, v)
+}
+
+// errorResponse is the JSON body written for failed requests.
+type errorResponse struct {
+	Error string `json:"error"`
+	// Each of the problems found with the request, when there may be several.
+	Errors []string `json:"errors,omitempty"`
+}
 
-	jsonStr, _ := json.Marshal(rows)
+// writeError writes a JSON error response with the given status code.
+// The underlying err is only exposed to clients when --debug is set.
+func writeError(w http.ResponseWriter, status int, msg string, err error) {
+	msg = errorMessage(w, status, msg, "")
+	if *debug && err != nil {
+		msg = fmt.Sprintf("%s: %v", msg, err)
+	}
 	w.Header().Set("Content-Type", "application/json")
-	w.Write(jsonStr)
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(errorResponse{Error: msg})
+}
+
+// newQuery creates the BigQuery query for a configured query.
+func newQuery(query SQLQuery) *bigquery.Query {
+	q := queryClient(query).Query(query.SQL)
+	q.UseLegacySQL = query.LegacySQL
+	q.MaxBytesBilled = *maxBilled
+	if query.MaxBytesBilled > 0 {
+		q.MaxBytesBilled = query.MaxBytesBilled
+	}
+	q.Location = *location
+	if query.Location != "" {
+		q.Location = query.Location
+	}
+	// The labels are computed when the query is loaded; each job gets its own copy.
+	q.Labels = make(map[string]string, len(query.jobLabels))
+	for k, v := range query.jobLabels {
+		q.Labels[k] = v
+	}
+	q.Priority = queryPriorities[query.Priority]
+	if query.Destination != nil {
+		setDestination(q, query)
+	}
+	q.ConnectionProperties = connectionProperties(query.ConnectionProperties)
+	return q
+}
+
+// jobStatistics returns the statistics of the completed job backing it, or nil when unavailable.
+// The client does not keep the statistics of a jobs.query response, and SourceJob has no status,
+// so this is a jobs.get call on every request: the price of the bytes processed metric and headers.
+func jobStatistics(ctx context.Context, it *bigquery.RowIterator) *bigquery.JobStatistics {
+	job := it.SourceJob()
+	if job == nil {
+		return nil
+	}
+	status, err := job.Status(ctx)
+	if err != nil {
+		slog.WarnContext(ctx, "Error fetching job status", "error", err)
+		return nil
+	}
+	return status.Statistics
+}
+
+// writeQueryError writes the error response for a failure running a query or reading its results.
+func writeQueryError(ctx context.Context, w http.ResponseWriter, msg string, err error) {
+	if ctx.Err() == context.DeadlineExceeded {
+		writeError(w, http.StatusGatewayTimeout, "query timed out", err)
+		return
+	}
+	if hasErrorReason(err, "bytesBilledLimitExceeded") {
+		writeError(w, http.StatusBadRequest, "query exceeds the maximum bytes billed", err)
+		return
+	}
+	writeError(w, http.StatusInternalServerError, msg, err)
+}
+
+// writeParamErrors writes a 400 response listing every problem with the parameters of a request.
+func writeParamErrors(w http.ResponseWriter, errs paramErrors) {
+	resp := errorResponse{
+		Error: errorMessage(w, http.StatusBadRequest, errs.Error(), errs[0].param),
+	}
+	for _, e := range errs {
+		resp.Errors = append(resp.Errors, e.msg)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusBadRequest)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// hasErrorReason reports whether err is a BigQuery error with the given reason.
+func hasErrorReason(err error, reason string) bool {
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		for _, e := range apiErr.Errors {
+			if e.Reason == reason {
+				return true
+			}
+		}
+	}
+	var bqErr *bigquery.Error
+	return errors.As(err, &bqErr) && bqErr.Reason == reason
 }
 
 func castField(fieldType bigquery.FieldType, v bigquery.Value) interface{} {
@@ -138,6 +1166,10 @@ func castField(fieldType bigquery.FieldType, v bigquery.Value) interface{} {
 	}
 	switch fieldType {
 	case bigquery.IntegerFieldType:
+		if *int64AsString {
+			// Integers beyond 2^53 can't be represented exactly by JavaScript numbers.
+			return strconv.FormatInt(v.(int64), 10)
+		}
 		return v.(int64)
 	case bigquery.StringFieldType:
 		return v.(string)
@@ -145,38 +1177,28 @@ func castField(fieldType bigquery.FieldType, v bigquery.Value) interface{} {
 		return v.(bool)
 	case bigquery.FloatFieldType:
 		return v.(float64)
+	case bigquery.TimestampFieldType:
+		return v.(time.Time).Format(time.RFC3339Nano)
+	case bigquery.DateTimeFieldType:
+		// DATETIME has no time zone, so it is rendered as an RFC3339 date-time without an offset.
+		return v.(civil.DateTime).In(time.UTC).Format(dateTimeLayout)
+	case bigquery.DateFieldType:
+		return v.(civil.Date).String()
+	case bigquery.TimeFieldType:
+		t := v.(civil.Time)
+		return time.Date(0, 1, 1, t.Hour, t.Minute, t.Second, t.Nanosecond, time.UTC).Format(timeLayout)
+	case bigquery.NumericFieldType:
+		// Decimal strings keep the full precision a float64 would lose.
+		return bigquery.NumericString(v.(*big.Rat))
+	case bigquery.BigNumericFieldType:
+		return bigquery.BigNumericString(v.(*big.Rat))
+	case bigquery.BytesFieldType:
+		return base64.StdEncoding.EncodeToString(v.([]byte))
+	case bigquery.IntervalFieldType:
+		return isoInterval(v.(*bigquery.IntervalValue))
+	case bigquery.GeographyFieldType:
+		// Geographies are returned as well-known text (WKT).
+		return v.(string)
 	}
 	return v
 }
-
-func buildQueryParams(config map[string]bigquery.FieldType, values url.Values) ([]bigquery.QueryParameter, error) {
-	params := []bigquery.QueryParameter{}
-
-	for key, fieldType := range config {
-		var v interface{}
-		var err error
-
-		// Convert the form input (string) into the native type before being passed to BiqQuery.
-		switch fieldType {
-		case bigquery.IntegerFieldType:
-			v, err = strconv.Atoi(values.Get(key))
-		case bigquery.BooleanFieldType:
-			v = (values.Get(key) == "true")
-		case bigquery.FloatFieldType:
-			v, err = strconv.ParseFloat(values.Get(key), 64)
-		default:
-			v = values.Get(key)
-		}
-
-		if err != nil {
-			return nil, err
-		}
-
-		params = append(params, bigquery.QueryParameter{
-			Name:  key,
-			Value: v,
-		})
-	}
-
-	return params, nil
-}
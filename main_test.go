@@ -0,0 +1,806 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+)
+
+func TestPrepareParameterType(t *testing.T) {
+	tests := []struct {
+		typ     bigquery.FieldType
+		want    bigquery.FieldType
+		wantErr bool
+	}{
+		{"", "", false},
+		{"STRING", bigquery.StringFieldType, false},
+		{"integer", bigquery.IntegerFieldType, false},
+		{"GEOGRAPHY", bigquery.GeographyFieldType, false},
+		{"INT64", bigquery.IntegerFieldType, false},
+		{"float64", bigquery.FloatFieldType, false},
+		{"BOOL", bigquery.BooleanFieldType, false},
+		{"STIRNG", "", true},
+		{"BIGNUMERIC", "", true},
+	}
+	for _, tc := range tests {
+		got, err := prepareParameter("p", Parameter{Type: tc.typ})
+		if tc.wantErr {
+			if err == nil || !strings.Contains(err.Error(), "unsupported type") {
+				t.Errorf("prepareParameter(%q) error = %v, want an unsupported type error", tc.typ, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("prepareParameter(%q) unexpected error: %v", tc.typ, err)
+			continue
+		}
+		if got.Type != tc.want {
+			t.Errorf("prepareParameter(%q) type = %q, want %q", tc.typ, got.Type, tc.want)
+		}
+	}
+}
+
+func TestPrepareParameterStructFieldType(t *testing.T) {
+	param := Parameter{Type: "STRUCT", Fields: map[string]Parameter{"x": {Type: "INT64"}, "y": {Type: "FLAOT64"}}}
+	if _, err := prepareParameter("point", param); err == nil || !strings.Contains(err.Error(), `"point.y"`) {
+		t.Errorf("prepareParameter() error = %v, want an error naming point.y", err)
+	}
+
+	param.Fields["y"] = Parameter{Type: "FLOAT64"}
+	got, err := prepareParameter("point", param)
+	if err != nil {
+		t.Fatalf("prepareParameter() unexpected error: %v", err)
+	}
+	if got.Type != bigquery.RecordFieldType || got.Fields["x"].Type != bigquery.IntegerFieldType || got.Fields["y"].Type != bigquery.FloatFieldType {
+		t.Errorf("prepareParameter() = %+v, want a RECORD of an INTEGER and a FLOAT", got)
+	}
+}
+
+func TestConvertValueRepeated(t *testing.T) {
+	field := &bigquery.FieldSchema{Name: "ids", Type: bigquery.StringFieldType, Repeated: true}
+	tests := []struct {
+		name string
+		v    bigquery.Value
+		want interface{}
+	}{
+		{"null", nil, nil},
+		{"empty", []bigquery.Value{}, []interface{}{}},
+		{"elements", []bigquery.Value{"a", nil, "b"}, []interface{}{"a", nil, "b"}},
+		{"not a slice", "a", "a"},
+	}
+	for _, tc := range tests {
+		if got := convertValue(field, tc.v); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: convertValue(%#v) = %#v, want %#v", tc.name, tc.v, got, tc.want)
+		}
+	}
+}
+
+// serveQueries loads queries as if from a queries file, restoring the previous queries when the test ends.
+func serveQueries(tb testing.TB, queries ...SQLQuery) {
+	prev := allQueries()
+	loaded := map[string]SQLQuery{}
+	for _, q := range queries {
+		if err := prepareQuery(&q); err != nil {
+			tb.Fatalf("query %q: %v", q.Name, err)
+		}
+		loaded[q.Name] = q
+	}
+	setQueries(loaded)
+	tb.Cleanup(func() { setQueries(prev) })
+}
+
+var labelledQuery = SQLQuery{
+	Name:   "numbers",
+	SQL:    "SELECT n FROM UNNEST(GENERATE_ARRAY(1, 2)) AS n",
+	Labels: map[string]string{"team": "data"},
+}
+
+func TestQueryHandlerParallel(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}, {"2"}})
+	serveQueries(t, labelledQuery)
+
+	const requests = 20
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			w := httptest.NewRecorder()
+			queryHandler(w, httptest.NewRequest(http.MethodGet, "/numbers", nil))
+			if w.Code != http.StatusOK || w.Body.String() != `[{"n":1},{"n":2}]` {
+				t.Errorf("response = %d %q, want 200 with both rows", w.Code, w.Body.String())
+			}
+		}()
+	}
+	wg.Wait()
+
+	if got := fake.queryRuns(); got != requests {
+		t.Errorf("queries run = %d, want %d", got, requests)
+	}
+	for _, labels := range fake.labels {
+		if labels["team"] != "data" || labels[queryNameLabel] != "numbers" {
+			t.Errorf("job labels = %v, want team and query name labels", labels)
+		}
+	}
+}
+
+func BenchmarkQueryHandler(b *testing.B) {
+	newFakeBigQuery(b, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}, {"2"}})
+	serveQueries(b, labelledQuery)
+	// Successful requests are not logged, as with --log_sample=0.
+	defer func(sample float64) { *logSample = sample }(*logSample)
+	*logSample = 0
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			w := httptest.NewRecorder()
+			queryHandler(w, httptest.NewRequest(http.MethodGet, "/numbers", nil))
+			if w.Code != http.StatusOK {
+				b.Fatalf("status = %d: %s", w.Code, w.Body.String())
+			}
+		}
+	})
+}
+
+func TestCastField(t *testing.T) {
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 500000000, time.UTC)
+	tests := []struct {
+		fieldType bigquery.FieldType
+		v         bigquery.Value
+		want      interface{}
+	}{
+		{bigquery.StringFieldType, nil, nil},
+		{bigquery.IntegerFieldType, int64(42), int64(42)},
+		{bigquery.StringFieldType, "hello", "hello"},
+		{bigquery.BooleanFieldType, true, true},
+		{bigquery.FloatFieldType, 1.5, 1.5},
+		{bigquery.TimestampFieldType, ts, "2020-01-02T03:04:05.5Z"},
+		{bigquery.TimestampFieldType, ts.Truncate(time.Second), "2020-01-02T03:04:05Z"},
+		{bigquery.DateTimeFieldType, civil.DateTimeOf(ts), "2020-01-02T03:04:05.5"},
+		{bigquery.DateFieldType, civil.DateOf(ts), "2020-01-02"},
+		{bigquery.TimeFieldType, civil.Time{Hour: 3, Minute: 4, Second: 5}, "03:04:05"},
+		{bigquery.TimeFieldType, civil.Time{Hour: 23, Minute: 59, Second: 59, Nanosecond: 123456000}, "23:59:59.123456"},
+		{bigquery.NumericFieldType, big.NewRat(1, 4), "0.250000000"},
+		{bigquery.NumericFieldType, new(big.Rat).SetInt64(123456789012345678), "123456789012345678.000000000"},
+		{bigquery.BigNumericFieldType, big.NewRat(-1, 8), "-0.12500000000000000000000000000000000000"},
+		{bigquery.BytesFieldType, []byte("hi"), "aGk="},
+		{bigquery.IntervalFieldType, &bigquery.IntervalValue{Years: 1, Months: 2, Days: 3, Hours: 4}, "P1Y2M3DT4H"},
+		{bigquery.GeographyFieldType, "POINT(1 2)", "POINT(1 2)"},
+	}
+	for _, tc := range tests {
+		if got := castField(tc.fieldType, tc.v); !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("castField(%s, %#v) = %#v, want %#v", tc.fieldType, tc.v, got, tc.want)
+		}
+	}
+}
+
+func TestCastFieldInt64AsString(t *testing.T) {
+	defer func(v bool) { *int64AsString = v }(*int64AsString)
+	*int64AsString = true
+
+	if got := castField(bigquery.IntegerFieldType, int64(9007199254740993)); got != "9007199254740993" {
+		t.Errorf("castField(INTEGER) = %#v, want the exact decimal string", got)
+	}
+}
+
+func TestCheckQueryNames(t *testing.T) {
+	tests := []struct {
+		names   []string
+		wantErr string
+	}{
+		{nil, ""},
+		{[]string{"hello-world", "v1.users_by~id", "A9"}, ""},
+		{[]string{"a", "b", "a", "a", "b"}, `duplicate names: "a", "b"`},
+		{[]string{"has space", "a/b", ""}, `names must only contain letters, digits, '.', '_', '~' and '-': "has space", "a/b", ""`},
+		{[]string{"a?", "x", "x"}, `names must only contain letters, digits, '.', '_', '~' and '-': "a?"; duplicate names: "x"`},
+	}
+	for _, tc := range tests {
+		if got := errString(checkQueryNames(tc.names)); got != tc.wantErr {
+			t.Errorf("checkQueryNames(%q) = %q, want %q", tc.names, got, tc.wantErr)
+		}
+	}
+}
+
+func TestConvertRecord(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "address", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "city", Type: bigquery.StringFieldType},
+			{Name: "geo", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+				{Name: "lat", Type: bigquery.FloatFieldType},
+			}},
+		}},
+		{Name: "tags", Type: bigquery.RecordFieldType, Repeated: true, Schema: bigquery.Schema{
+			{Name: "name", Type: bigquery.StringFieldType},
+		}},
+		{Name: "missing", Type: bigquery.StringFieldType},
+	}
+	raw := map[string]bigquery.Value{
+		"id": int64(1),
+		"address": map[string]bigquery.Value{
+			"city": "Paris",
+			"geo":  map[string]bigquery.Value{"lat": 48.9},
+		},
+		"tags": []bigquery.Value{
+			map[string]bigquery.Value{"name": "a"},
+			nil,
+		},
+	}
+	want := map[string]interface{}{
+		"id": int64(1),
+		"address": map[string]interface{}{
+			"city": "Paris",
+			"geo":  map[string]interface{}{"lat": 48.9},
+		},
+		"tags":    []interface{}{map[string]interface{}{"name": "a"}, nil},
+		"missing": nil,
+	}
+	if got := convertRecord(schema, raw); !reflect.DeepEqual(got, want) {
+		t.Errorf("convertRecord() = %#v, want %#v", got, want)
+	}
+
+	// A NULL record is null rather than an object of nulls.
+	raw["address"] = nil
+	if got := convertRecord(schema, raw)["address"]; got != nil {
+		t.Errorf("NULL record = %#v, want nil", got)
+	}
+}
+
+func TestWriteError(t *testing.T) {
+	tests := []struct {
+		debug bool
+		err   error
+		want  string
+	}{
+		{false, nil, `{"error":"query failed"}`},
+		{false, errors.New("backend error"), `{"error":"query failed"}`},
+		{true, errors.New("backend error"), `{"error":"query failed: backend error"}`},
+	}
+	defer func(v bool) { *debug = v }(*debug)
+	for _, tc := range tests {
+		*debug = tc.debug
+		w := httptest.NewRecorder()
+		writeError(w, http.StatusInternalServerError, "query failed", tc.err)
+
+		if w.Code != http.StatusInternalServerError {
+			t.Errorf("status = %d, want 500", w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != "application/json" {
+			t.Errorf("Content-Type = %q, want application/json", got)
+		}
+		if got := strings.TrimSpace(w.Body.String()); got != tc.want {
+			t.Errorf("debug %v, error %v: body = %s, want %s", tc.debug, tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestValidateConfig(t *testing.T) {
+	defer func(q, dir string) { *queries, *queriesDir = q, dir }(*queries, *queriesDir)
+	prev := allQueries()
+	defer setQueries(prev)
+
+	*queries, *queriesDir = "sample/example.yaml", "sample/sql"
+	if err := validateConfig(); err != nil {
+		t.Errorf("validateConfig() of the sample configuration = %v, want nil", err)
+	}
+
+	broken := filepath.Join(t.TempDir(), "queries.yaml")
+	if err := ioutil.WriteFile(broken, []byte("- name: broken\n  query: SELECT @id\n  parameters:\n    id:\n      type: INTEGR\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	*queries, *queriesDir = broken, ""
+	if err := validateConfig(); err == nil || !strings.Contains(err.Error(), `unsupported type "INTEGR"`) {
+		t.Errorf("validateConfig() of a broken configuration = %v, want an unsupported type error", err)
+	}
+
+	// Queries can't shadow the other endpoints.
+	defer func(path string) { *healthPath = path }(*healthPath)
+	*healthPath = "/broken"
+	if err := ioutil.WriteFile(broken, []byte("- name: broken\n  query: SELECT 1\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := validateConfig(); err == nil || !strings.Contains(err.Error(), "conflicts") {
+		t.Errorf("validateConfig() with a query named like --health_path = %v, want a conflict error", err)
+	}
+}
+
+func TestQueryHandlerRepeatedColumns(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{
+		{"name": "tags", "type": "STRING", "mode": "REPEATED"},
+		{"name": "ids", "type": "INTEGER", "mode": "REPEATED"},
+	}, [][]interface{}{
+		{[]interface{}{"a", "b"}, []interface{}{"1"}},
+		{[]interface{}{}, []interface{}{}},
+	})
+	serveQueries(t, SQLQuery{Name: "arrays", SQL: "SELECT ['a', 'b'] AS tags, [1] AS ids"})
+
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/arrays", nil))
+	// Elements are converted like other values of their type, and empty arrays are empty lists.
+	if want := `[{"ids":[1],"tags":["a","b"]},{"ids":[],"tags":[]}]`; w.Code != http.StatusOK || w.Body.String() != want {
+		t.Errorf("response = %d %s, want 200 %s", w.Code, w.Body.String(), want)
+	}
+}
+
+func TestQueryHandlerMaxRows(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}, {"2"}, {"3"}})
+	defer func(v int) { *maxRows = v }(*maxRows)
+	*maxRows = 2
+	serveQueries(t,
+		SQLQuery{Name: "default", SQL: "SELECT n"},
+		SQLQuery{Name: "more", SQL: "SELECT n", MaxRows: 5},
+		SQLQuery{Name: "exact", SQL: "SELECT n", MaxRows: 3},
+	)
+
+	tests := []struct {
+		name          string
+		want          string
+		wantTruncated string
+	}{
+		{"default", `[{"n":1},{"n":2}]`, "true"},
+		{"more", `[{"n":1},{"n":2},{"n":3}]`, ""},
+		// A result with exactly the row limit isn't truncated.
+		{"exact", `[{"n":1},{"n":2},{"n":3}]`, ""},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/"+tc.name, nil))
+		if w.Code != http.StatusOK || w.Body.String() != tc.want {
+			t.Errorf("%s: response = %d %s, want 200 %s", tc.name, w.Code, w.Body.String(), tc.want)
+		}
+		if got := w.Header().Get("X-Result-Truncated"); got != tc.wantTruncated {
+			t.Errorf("%s: X-Result-Truncated = %q, want %q", tc.name, got, tc.wantTruncated)
+		}
+	}
+}
+
+// TestQueriesConcurrentReload runs requests while the queries are replaced, for the race detector to check.
+func TestQueriesConcurrentReload(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, labelledQuery)
+	loaded := allQueries()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				setQueries(loaded)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				w := httptest.NewRecorder()
+				queryHandler(w, httptest.NewRequest(http.MethodGet, "/numbers", nil))
+				if w.Code != http.StatusOK {
+					t.Errorf("response = %d %s, want 200", w.Code, w.Body.String())
+				}
+				if len(allQueries()) != 1 {
+					t.Errorf("allQueries() = %v, want the one query", allQueries())
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestLegacySQL(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t,
+		SQLQuery{Name: "legacy", SQL: "SELECT 1 AS n", LegacySQL: true},
+		SQLQuery{Name: "standard", SQL: "SELECT 1 AS n"},
+	)
+
+	for name, want := range map[string]interface{}{"legacy": true, "standard": false} {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: response = %d %s, want 200", name, w.Code, w.Body.String())
+		}
+		if got := fake.lastRequest()["useLegacySql"]; got != want {
+			t.Errorf("%s: useLegacySql = %v, want %v", name, got, want)
+		}
+	}
+
+	q := SQLQuery{Name: "params", SQL: "SELECT @id", LegacySQL: true, Parameters: map[string]Parameter{"id": {Type: "INTEGER"}}}
+	if err := prepareQuery(&q); err == nil || !strings.Contains(err.Error(), "legacy SQL queries do not support parameters") {
+		t.Errorf("prepareQuery() of a legacy SQL query with parameters = %v, want an error", err)
+	}
+}
+
+func TestMaxBytesBilled(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	defer func(v int64) { *maxBilled = v }(*maxBilled)
+	*maxBilled = 1000
+	serveQueries(t,
+		SQLQuery{Name: "default", SQL: "SELECT 1 AS n"},
+		SQLQuery{Name: "own", SQL: "SELECT 1 AS n", MaxBytesBilled: 5000},
+	)
+
+	for name, want := range map[string]string{"default": "1000", "own": "5000"} {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: response = %d %s, want 200", name, w.Code, w.Body.String())
+		}
+		if got := fake.lastRequest()["maximumBytesBilled"]; got != want {
+			t.Errorf("%s: maximumBytesBilled = %v, want %s", name, got, want)
+		}
+	}
+
+	// Queries which would bill more fail with a 400, as retrying won't help.
+	fake.fail(1, fakeError{code: http.StatusBadRequest, reason: "bytesBilledLimitExceeded", message: "Query exceeded limit for bytes billed: 1000."})
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/default", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "query exceeds the maximum bytes billed") {
+		t.Errorf("response = %d %s, want 400 query exceeds the maximum bytes billed", w.Code, w.Body.String())
+	}
+}
+
+func TestQueryHandlerGeography(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "area", "type": "GEOGRAPHY"}}, [][]interface{}{{"POLYGON((0 0, 0 1, 1 1, 0 0))"}})
+	serveQueries(t, SQLQuery{
+		Name:       "areas",
+		SQL:        "SELECT area FROM areas WHERE ST_CONTAINS(area, @point)",
+		Parameters: prepareParameters(t, map[string]Parameter{"point": {Type: "GEOGRAPHY", Required: true}}),
+	})
+
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/areas?point=POINT(0.2%200.5)", nil))
+	if got, want := w.Body.String(), `[{"area":"POLYGON((0 0, 0 1, 1 1, 0 0))"}]`; w.Code != http.StatusOK || strings.TrimSpace(got) != want {
+		t.Errorf("response = %d %s, want 200 %s", w.Code, got, want)
+	}
+	params, _ := json.Marshal(fake.lastRequest()["queryParameters"])
+	if got, want := string(params), `[{"name":"point","parameterType":{"type":"GEOGRAPHY"},"parameterValue":{"value":"POINT(0.2 0.5)"}}]`; got != want {
+		t.Errorf("queryParameters = %s, want %s", got, want)
+	}
+
+	// Values which aren't WKT are rejected before running the query.
+	runs := fake.queryRuns()
+	w = httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/areas?point=somewhere", nil))
+	if w.Code != http.StatusBadRequest || fake.queryRuns() != runs {
+		t.Errorf("response = %d %s after %d queries, want 400 without running the query", w.Code, w.Body.String(), fake.queryRuns()-runs)
+	}
+}
+
+func TestQueryLocation(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	defer func(v string) { *location = v }(*location)
+	*location = "EU"
+	serveQueries(t,
+		SQLQuery{Name: "default", SQL: "SELECT 1 AS n"},
+		SQLQuery{Name: "own", SQL: "SELECT 1 AS n", Location: "us-central1"},
+	)
+
+	for name, want := range map[string]string{"default": "EU", "own": "us-central1"} {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: response = %d %s, want 200", name, w.Code, w.Body.String())
+		}
+		if got := fake.lastRequest()["location"]; got != want {
+			t.Errorf("%s: location = %v, want %s", name, got, want)
+		}
+	}
+}
+
+func TestQueryPriority(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t,
+		SQLQuery{Name: "default", SQL: "SELECT 1 AS n"},
+		SQLQuery{Name: "batch", SQL: "SELECT 1 AS n", Priority: "batch"},
+	)
+
+	// Interactive queries can run through jobs.query, which has no priority.
+	for name, want := range map[string]interface{}{"default": nil, "batch": "BATCH"} {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: response = %d %s, want 200", name, w.Code, w.Body.String())
+		}
+		if got := fake.lastRequest()["priority"]; got != want {
+			t.Errorf("%s: priority = %v, want %v", name, got, want)
+		}
+	}
+
+	q := SQLQuery{Name: "urgent", SQL: "SELECT 1", Priority: "urgent"}
+	if err := prepareQuery(&q); err == nil || !strings.Contains(err.Error(), `invalid priority "urgent"`) {
+		t.Errorf("prepareQuery() with priority urgent = %v, want an error", err)
+	}
+}
+
+func TestQueryHandlerReadError(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}, {"2"}, {"3"}})
+	serveQueries(t, SQLQuery{Name: "numbers", SQL: "SELECT n"})
+	// The first page of rows is read before the second fails.
+	fake.setPageSize(2)
+	fake.failReads(fakeError{code: http.StatusForbidden, reason: "responseTooLarge", message: "Response too large to return."})
+
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/numbers", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("status = %d, want 500", w.Code)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || body["error"] == nil {
+		t.Errorf("body = %s, want only the error", w.Body.String())
+	}
+}
+
+func TestQueryHandlerEncodingError(t *testing.T) {
+	// JSON has no infinity, so the row can't be encoded.
+	newFakeBigQuery(t, []map[string]string{{"name": "x", "type": "FLOAT"}}, [][]interface{}{{"1.5"}, {"Infinity"}})
+	serveQueries(t, SQLQuery{Name: "floats", SQL: "SELECT x"})
+
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/floats", nil))
+	if got, want := strings.TrimSpace(w.Body.String()), `{"error":"encoding results failed"}`; w.Code != http.StatusInternalServerError || got != want {
+		t.Errorf("response = %d %s, want 500 %s", w.Code, got, want)
+	}
+}
+
+func TestQueryHandlerMethods(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t,
+		SQLQuery{Name: "lookup", SQL: "SELECT 1 AS n", Methods: []string{"get"}},
+		SQLQuery{Name: "search", SQL: "SELECT 1 AS n", Methods: []string{"POST"}},
+		SQLQuery{Name: "either", SQL: "SELECT 1 AS n"},
+	)
+
+	tests := []struct {
+		method, name string
+		wantCode     int
+		wantAllow    string
+	}{
+		{http.MethodGet, "lookup", http.StatusOK, ""},
+		{http.MethodPost, "lookup", http.StatusMethodNotAllowed, "GET"},
+		{http.MethodGet, "search", http.StatusMethodNotAllowed, "POST"},
+		{http.MethodPost, "search", http.StatusOK, ""},
+		{http.MethodGet, "either", http.StatusOK, ""},
+		{http.MethodPost, "either", http.StatusOK, ""},
+		{http.MethodDelete, "either", http.StatusMethodNotAllowed, "GET, POST"},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(tc.method, "/"+tc.name, nil))
+		if w.Code != tc.wantCode || w.Header().Get("Allow") != tc.wantAllow {
+			t.Errorf("%s /%s: response = %d with Allow %q, want %d with Allow %q", tc.method, tc.name, w.Code, w.Header().Get("Allow"), tc.wantCode, tc.wantAllow)
+		}
+	}
+
+	q := SQLQuery{Name: "remove", SQL: "SELECT 1", Methods: []string{"DELETE"}}
+	if err := prepareQuery(&q); err == nil || !strings.Contains(err.Error(), `unsupported method "DELETE"`) {
+		t.Errorf("prepareQuery() with method DELETE = %v, want an error", err)
+	}
+}
+
+func TestQueryHandlerJobIDAndElapsed(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{Name: "numbers", SQL: "SELECT n"})
+	fake.setDelay(20 * time.Millisecond)
+
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/numbers", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	// The fake BigQuery API names every job "job".
+	if got := w.Header().Get("X-BigQuery-Job-ID"); got != "job" {
+		t.Errorf("X-BigQuery-Job-ID = %q, want job", got)
+	}
+	if ms, err := strconv.Atoi(w.Header().Get("X-Query-Elapsed-Ms")); err != nil || ms < 20 {
+		t.Errorf("X-Query-Elapsed-Ms = %q, want at least the 20ms the query took", w.Header().Get("X-Query-Elapsed-Ms"))
+	}
+}
+
+func TestQueryHandlerEmptyStatus(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, nil)
+	serveQueries(t,
+		SQLQuery{Name: "default", SQL: "SELECT n"},
+		SQLQuery{Name: "ok", SQL: "SELECT n", EmptyStatus: http.StatusOK},
+		SQLQuery{Name: "none", SQL: "SELECT n", EmptyStatus: http.StatusNoContent},
+		SQLQuery{Name: "missing", SQL: "SELECT n", EmptyStatus: http.StatusNotFound},
+	)
+
+	tests := []struct {
+		name     string
+		wantCode int
+		wantBody string
+	}{
+		{"default", http.StatusOK, "[]"},
+		{"ok", http.StatusOK, "[]"},
+		{"none", http.StatusNoContent, ""},
+		{"missing", http.StatusNotFound, `{"error":"no results"}`},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/"+tc.name, nil))
+		if got := strings.TrimSpace(w.Body.String()); w.Code != tc.wantCode || got != tc.wantBody {
+			t.Errorf("%s: response = %d %s, want %d %s", tc.name, w.Code, got, tc.wantCode, tc.wantBody)
+		}
+	}
+
+	q := SQLQuery{Name: "teapot", SQL: "SELECT 1", EmptyStatus: http.StatusTeapot}
+	if err := prepareQuery(&q); err == nil || !strings.Contains(err.Error(), "invalid empty_status 418") {
+		t.Errorf("prepareQuery() with empty_status 418 = %v, want an error", err)
+	}
+}
+
+func TestQueryHandlerMaxResponseBytes(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{{"name": "s", "type": "STRING"}}, [][]interface{}{{"aaaaaaaaaa"}, {"bbbbbbbbbb"}, {"cccccccccc"}})
+	serveQueries(t, SQLQuery{Name: "wide", SQL: "SELECT s"})
+	defer func(v int64) { *maxRespBytes = v }(*maxRespBytes)
+
+	*maxRespBytes = 1000
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/wide", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("under the limit: status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+
+	*maxRespBytes = 20
+	w = httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/wide", nil))
+	if got, want := strings.TrimSpace(w.Body.String()), `{"error":"response exceeds the maximum size"}`; w.Code != http.StatusInternalServerError || got != want {
+		t.Errorf("over the limit: response = %d %s, want 500 %s", w.Code, got, want)
+	}
+
+	// Streamed responses have already sent their status, so they just end early.
+	w = httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/wide?format=ndjson", nil))
+	if w.Code != http.StatusOK || strings.Contains(w.Body.String(), "cccccccccc") {
+		t.Errorf("streamed over the limit: response = %d %q, want 200 ending before the last row", w.Code, w.Body.String())
+	}
+}
+
+func TestLoadQueriesDefaults(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.yaml")
+	if err := ioutil.WriteFile(path, []byte(`
+defaults:
+  parameters:
+    tenant:
+      default: acme
+queries:
+- name: inherits
+  query: SELECT * FROM t WHERE tenant = @tenant
+- name: overrides
+  query: SELECT * FROM t WHERE tenant = @tenant
+  parameters:
+    tenant:
+      default: globex
+- name: optional
+  query: SELECT * FROM t WHERE tenant = @tenant
+  parameters:
+    tenant: STRING
+- name: unused
+  query: SELECT * FROM t
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	queries, err := loadQueries(path)
+	if err != nil {
+		t.Fatalf("loadQueries() error: %v", err)
+	}
+
+	for name, want := range map[string]string{"inherits": "acme", "overrides": "globex", "optional": "acme"} {
+		param, ok := queries[name].Parameters["tenant"]
+		if !ok || param.Default == nil || *param.Default != want {
+			t.Errorf("%s: tenant parameter = %+v, want default %s", name, param, want)
+		}
+	}
+	if _, ok := queries["unused"].Parameters["tenant"]; ok {
+		t.Error("unused: has a tenant parameter, want only queries using it to inherit it")
+	}
+}
+
+func TestQueryHandlerMaxQueryLength(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{Name: "numbers", SQL: "SELECT n"})
+	defer func(v int) { *maxQueryLength = v }(*maxQueryLength)
+	*maxQueryLength = 20
+
+	tests := []struct {
+		url      string
+		wantCode int
+	}{
+		{"/numbers?format=json", http.StatusOK},
+		{"/numbers?format=json&pretty=true", http.StatusRequestURITooLong},
+		// The length is checked before the query is looked up.
+		{"/missing?" + strings.Repeat("a", 21), http.StatusRequestURITooLong},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: status = %d, want %d: %s", tc.url, w.Code, tc.wantCode, w.Body.String())
+		}
+	}
+	if got := fake.queryRuns(); got != 1 {
+		t.Errorf("queries run = %d, want 1", got)
+	}
+}
+
+func TestQueryHandlerInt64AsString(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{{"name": "id", "type": "INTEGER"}}, [][]interface{}{{"9007199254740993"}, {nil}})
+	serveQueries(t, SQLQuery{Name: "ids", SQL: "SELECT id"})
+	defer func(v bool) { *int64AsString = v }(*int64AsString)
+
+	for flag, want := range map[bool]string{
+		false: `[{"id":9007199254740993},{"id":null}]`,
+		true:  `[{"id":"9007199254740993"},{"id":null}]`,
+	} {
+		*int64AsString = flag
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/ids", nil))
+		if got := strings.TrimSpace(w.Body.String()); got != want {
+			t.Errorf("--int64_as_string=%v: body = %s, want %s", flag, got, want)
+		}
+	}
+}
+
+func TestLoadQueriesAliases(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	path := filepath.Join(t.TempDir(), "queries.yaml")
+	if err := ioutil.WriteFile(path, []byte(`- name: users
+  query: SELECT COUNT(*) AS n FROM users
+  aliases: [v1.users, legacy_users]
+- name: orders
+  query: SELECT COUNT(*) AS n FROM orders
+`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	queries, err := loadQueries(path)
+	if err != nil {
+		t.Fatalf("loadQueries() error: %v", err)
+	}
+	prev := allQueries()
+	setQueries(queries)
+	defer setQueries(prev)
+
+	for _, name := range []string{"users", "v1.users", "legacy_users"} {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/"+name, nil))
+		if w.Code != http.StatusOK {
+			t.Errorf("%s: status = %d, want 200: %s", name, w.Code, w.Body.String())
+			continue
+		}
+		if got := fake.lastRequest()["query"]; got != "SELECT COUNT(*) AS n FROM users" {
+			t.Errorf("%s: ran %v, want the users query", name, got)
+		}
+	}
+
+	for _, tc := range []struct {
+		yaml    string
+		wantErr string
+	}{
+		{"- {name: users, query: SELECT 1, aliases: [orders]}\n- {name: orders, query: SELECT 2}\n", `duplicate names: "orders"`},
+		{"- {name: users, query: SELECT 1, aliases: [people]}\n- {name: orders, query: SELECT 2, aliases: [people]}\n", `duplicate names: "people"`},
+		{"- {name: users, query: SELECT 1, aliases: [users]}\n", `duplicate names: "users"`},
+		{"- {name: users, query: SELECT 1, aliases: [v1/users]}\n", `"v1/users"`},
+	} {
+		if err := ioutil.WriteFile(path, []byte(tc.yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := loadQueries(path); err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+			t.Errorf("loadQueries(%q) error = %v, want %s", tc.yaml, err, tc.wantErr)
+		}
+	}
+}
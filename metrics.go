@@ -0,0 +1,52 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bqproxy_requests_total",
+		Help: "Query requests handled, by query name and HTTP status code.",
+	}, []string{"query", "code"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bqproxy_request_duration_seconds",
+		Help:    "Latency of query requests, by query name.",
+		Buckets: prometheus.ExponentialBuckets(0.05, 2, 10),
+	}, []string{"query"})
+
+	bytesProcessed = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "bqproxy_bytes_processed_total",
+		Help: "Bytes processed by BigQuery, by query name.",
+	}, []string{"query"})
+)
+
+// metricsHandler records request counts and latency for each query.
+func metricsHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h(rec, r)
+
+		name := metricsQueryName(r)
+		requestsTotal.WithLabelValues(name, strconv.Itoa(rec.statusCode())).Inc()
+		requestDuration.WithLabelValues(name).Observe(time.Since(start).Seconds())
+	}
+}
+
+// metricsQueryName returns the name of the query requested by r, or an empty
+// string for unknown queries to keep the number of label values bounded.
+func metricsQueryName(r *http.Request) string {
+	name := strings.TrimPrefix(r.URL.Path, *urlPath)
+	if _, ok := lookupQuery(name); !ok {
+		return ""
+	}
+	return name
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsHandler(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{Name: "measured", SQL: "SELECT 1 AS n"})
+
+	ok := requestsTotal.WithLabelValues("measured", "200")
+	notFound := requestsTotal.WithLabelValues("", "404")
+	processed := bytesProcessed.WithLabelValues("measured")
+	okBefore, notFoundBefore, processedBefore := testutil.ToFloat64(ok), testutil.ToFloat64(notFound), testutil.ToFloat64(processed)
+
+	h := metricsHandler(queryHandler)
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/measured", nil))
+	// Unknown queries share a label, so requests for made up names can't create unbounded label values.
+	h(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/made-up", nil))
+
+	if got := testutil.ToFloat64(ok) - okBefore; got != 1 {
+		t.Errorf("requests for the query = %v, want 1", got)
+	}
+	if got := testutil.ToFloat64(notFound) - notFoundBefore; got != 1 {
+		t.Errorf("requests for unknown queries = %v, want 1", got)
+	}
+	// The fake BigQuery API reports 10 bytes processed for every query.
+	if got := testutil.ToFloat64(processed) - processedBefore; got != 10 {
+		t.Errorf("bytes processed = %v, want 10", got)
+	}
+}
+
+func TestQueryHandlerJobHeaders(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{Name: "measured", SQL: "SELECT 1 AS n"})
+
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/measured", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	for header, want := range map[string]string{
+		"X-BigQuery-Bytes-Processed": "10",
+		"X-BigQuery-Cache-Hit":       "false",
+	} {
+		if got := w.Header().Get(header); got != want {
+			t.Errorf("%s = %q, want %q", header, got, want)
+		}
+	}
+}
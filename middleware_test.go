@@ -0,0 +1,136 @@
+package main
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAcceptsEncoding(t *testing.T) {
+	tests := []struct {
+		header string
+		want   bool
+	}{
+		{"", false},
+		{"gzip", true},
+		{"GZIP", true},
+		{"deflate, gzip", true},
+		{"gzip;q=0.5", true},
+		{"gzip; q=1", true},
+		{"gzip;q=0", false},
+		{"gzip; q=0.0", false},
+		{"gzip;q=bad", false},
+		{"deflate", false},
+		{"x-gzip", false},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", tc.header)
+		if got := acceptsEncoding(r, "gzip"); got != tc.want {
+			t.Errorf("acceptsEncoding(%q) = %v, want %v", tc.header, got, tc.want)
+		}
+	}
+}
+
+func TestGzipHandler(t *testing.T) {
+	tests := []struct {
+		name         string
+		status       int
+		body         string
+		wantEncoding string
+	}{
+		{"ok", http.StatusOK, "hello", "gzip"},
+		{"no content", http.StatusNoContent, "", ""},
+		{"not modified", http.StatusNotModified, "", ""},
+	}
+	for _, tc := range tests {
+		h := gzipHandler(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(tc.status)
+			io.WriteString(w, tc.body)
+		})
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set("Accept-Encoding", "gzip")
+		rec := httptest.NewRecorder()
+		h(rec, r)
+
+		if got := rec.Header().Get("Content-Encoding"); got != tc.wantEncoding {
+			t.Errorf("%s: Content-Encoding = %q, want %q", tc.name, got, tc.wantEncoding)
+		}
+		if tc.wantEncoding == "" {
+			if rec.Body.Len() != 0 {
+				t.Errorf("%s: body = %q, want empty", tc.name, rec.Body.String())
+			}
+			continue
+		}
+		zr, err := gzip.NewReader(rec.Body)
+		if err != nil {
+			t.Fatalf("%s: gzip.NewReader() error: %v", tc.name, err)
+		}
+		got, err := io.ReadAll(zr)
+		if err != nil {
+			t.Fatalf("%s: reading gzip body: %v", tc.name, err)
+		}
+		if string(got) != tc.body {
+			t.Errorf("%s: body = %q, want %q", tc.name, got, tc.body)
+		}
+	}
+}
+
+func TestCORSHandler(t *testing.T) {
+	defer func(v string) { *allowedOrigins = v }(*allowedOrigins)
+	*allowedOrigins = "https://a.example, https://b.example"
+	called := false
+	h := corsHandler(func(w http.ResponseWriter, r *http.Request) { called = true })
+
+	tests := []struct {
+		method, origin string
+		wantAllowed    bool
+		wantCalled     bool
+		wantStatus     int
+	}{
+		{http.MethodGet, "", false, true, http.StatusOK},
+		{http.MethodGet, "https://a.example", true, true, http.StatusOK},
+		{http.MethodGet, "https://b.example", true, true, http.StatusOK},
+		{http.MethodGet, "https://evil.example", false, true, http.StatusOK},
+		// Preflight requests are answered without calling the handler.
+		{http.MethodOptions, "https://a.example", true, false, http.StatusNoContent},
+	}
+	for _, tc := range tests {
+		called = false
+		r := httptest.NewRequest(tc.method, "/numbers", nil)
+		if tc.origin != "" {
+			r.Header.Set("Origin", tc.origin)
+		}
+		if tc.method == http.MethodOptions {
+			r.Header.Set("Access-Control-Request-Method", http.MethodGet)
+			r.Header.Set("Access-Control-Request-Headers", "X-API-Key")
+		}
+		w := httptest.NewRecorder()
+		h(w, r)
+
+		allowed := w.Header().Get("Access-Control-Allow-Origin")
+		if tc.wantAllowed && allowed != tc.origin || !tc.wantAllowed && allowed != "" {
+			t.Errorf("%s from %q: Access-Control-Allow-Origin = %q, want allowed %v", tc.method, tc.origin, allowed, tc.wantAllowed)
+		}
+		if tc.wantAllowed && w.Header().Get("Vary") != "Origin" {
+			t.Errorf("%s from %q: Vary = %q, want Origin", tc.method, tc.origin, w.Header().Get("Vary"))
+		}
+		if called != tc.wantCalled || w.Code != tc.wantStatus {
+			t.Errorf("%s from %q: called %v with status %d, want called %v with status %d", tc.method, tc.origin, called, w.Code, tc.wantCalled, tc.wantStatus)
+		}
+		if tc.method == http.MethodOptions && w.Header().Get("Access-Control-Allow-Headers") != "X-API-Key" {
+			t.Errorf("preflight Access-Control-Allow-Headers = %q, want X-API-Key", w.Header().Get("Access-Control-Allow-Headers"))
+		}
+	}
+
+	*allowedOrigins = "*"
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest(http.MethodGet, "/numbers", nil)
+	r.Header.Set("Origin", "https://any.example")
+	h(w, r)
+	if got := w.Header().Get("Access-Control-Allow-Origin"); got != "https://any.example" {
+		t.Errorf("with * allowed: Access-Control-Allow-Origin = %q, want the origin", got)
+	}
+}
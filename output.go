@@ -0,0 +1,434 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// Output formats which can be requested with the format URL parameter.
+const (
+	formatJSON   = "json"
+	formatNDJSON = "ndjson"
+	formatCSV    = "csv"
+	formatXML    = "xml"
+)
+
+// resultWriter writes the rows of a query result to a response in a particular format.
+type resultWriter interface {
+	// writeRow writes a single result row, whose fields are described by schema.
+	writeRow(schema bigquery.Schema, row map[string]interface{}) error
+	// close completes the response after the last row has been written.
+	close(schema bigquery.Schema, info resultInfo) error
+	// streaming reports whether part of the response has already been sent,
+	// after which an error response can no longer be written.
+	streaming() bool
+	// size returns the number of bytes of rows written so far.
+	size() int64
+}
+
+// byteCounter counts the bytes written through it.
+type byteCounter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *byteCounter) Write(b []byte) (int, error) {
+	n, err := c.w.Write(b)
+	c.n += int64(n)
+	return n, err
+}
+
+// resultInfo describes a query result once all of its rows have been read.
+type resultInfo struct {
+	// Whether rows were left out because the result exceeded the row limit.
+	truncated bool
+	// Whether the request asked for a page of results.
+	paged bool
+	// The token for the next page of results, if there is one.
+	nextPageToken string
+	// Whether the rows are wrapped in an envelope with the metadata below.
+	envelope bool
+	// The name of the query.
+	query string
+	// How long the request took, up to reading the last row.
+	elapsed time.Duration
+	// Whether the single value of a one row, one column result is written instead of the rows.
+	scalar bool
+}
+
+// setHeaders sets the response headers describing the result.
+func (info resultInfo) setHeaders(h http.Header) {
+	if info.truncated {
+		h.Set("X-Result-Truncated", "true")
+	}
+	if info.nextPageToken != "" {
+		h.Set("X-Next-Page-Token", info.nextPageToken)
+	}
+	h.Set("X-Query-Elapsed-Ms", strconv.FormatInt(info.elapsed.Milliseconds(), 10))
+}
+
+// resultTrailers lists the headers set by resultInfo, which streamed responses send as trailers.
+const resultTrailers = "X-Result-Truncated, X-Next-Page-Token, X-Query-Elapsed-Ms"
+
+// envelopeResponse is the JSON body written when rows are wrapped with metadata about the result.
+type envelopeResponse struct {
+	Query         string          `json:"query"`
+	RowCount      int             `json:"rowCount"`
+	ElapsedMs     int64           `json:"elapsedMs"`
+	Rows          json.RawMessage `json:"rows"`
+	NextPageToken string          `json:"nextPageToken,omitempty"`
+}
+
+// scalarResponse is the JSON body written for queries returning a single value.
+type scalarResponse struct {
+	Value interface{} `json:"value"`
+}
+
+// errNotScalar is returned for scalar queries whose results are not a single value.
+var errNotScalar = errors.New("query result is not a single value")
+
+// errNotText is returned for queries with a content_type whose results are not a single STRING value.
+var errNotText = errors.New("query result is not a single text value")
+
+// wantsEnvelope reports whether the response to a request with the URL parameters values should
+// wrap the rows in an envelope, which the envelope parameter can request or turn off, overriding --envelope.
+func wantsEnvelope(values url.Values) bool {
+	if v, err := strconv.ParseBool(values.Get("envelope")); err == nil {
+		return v
+	}
+	return *envelope
+}
+
+// wantsPretty reports whether the JSON response to a request with the URL parameters values should
+// be indented, which the pretty parameter can request or turn off, overriding --pretty.
+func wantsPretty(values url.Values) bool {
+	if v, err := strconv.ParseBool(values.Get("pretty")); err == nil {
+		return v
+	}
+	return *pretty
+}
+
+// callbackPattern matches JSONP callback names: JavaScript identifiers, optionally dotted like app.onData.
+var callbackPattern = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*(\.[A-Za-z_$][A-Za-z0-9_$]*)*$`)
+
+// jsonpCallback returns the JSONP callback requested with the callback URL parameter, if any.
+func jsonpCallback(values url.Values) (string, error) {
+	callback := values.Get("callback")
+	if callback != "" && (len(callback) > 128 || !callbackPattern.MatchString(callback)) {
+		return "", fmt.Errorf("invalid callback %q, must be a JavaScript identifier", callback)
+	}
+	return callback, nil
+}
+
+// checkFormat returns an error if the format URL parameter names a format that isn't supported.
+func checkFormat(values url.Values) error {
+	switch format := values.Get("format"); format {
+	case "", formatJSON, formatNDJSON, formatCSV, formatXML:
+		return nil
+	default:
+		return fmt.Errorf("unsupported format %q, must be json, ndjson, csv or xml", format)
+	}
+}
+
+// newResultWriter returns a resultWriter for the format requested by r, whose URL parameters are values,
+// or one writing the raw text of the result if the query has a contentType.
+func newResultWriter(w http.ResponseWriter, r *http.Request, values url.Values, contentType string) resultWriter {
+	if contentType != "" {
+		return &rawWriter{w: w, r: r, contentType: contentType}
+	}
+	switch requestFormat(r, values) {
+	case formatNDJSON:
+		return &ndjsonWriter{w: w}
+	case formatCSV:
+		return &csvWriter{w: w}
+	case formatXML:
+		return &xmlWriter{w: w}
+	}
+	return &jsonWriter{w: w, r: r, values: values}
+}
+
+// requestFormat returns the output format for r, whose URL parameters are values,
+// preferring the format URL parameter over the Accept header.
+func requestFormat(r *http.Request, values url.Values) string {
+	if format := values.Get("format"); format != "" {
+		return format
+	}
+	if accepts(r, "application/x-ndjson") {
+		return formatNDJSON
+	}
+	if accepts(r, "text/csv") {
+		return formatCSV
+	}
+	if accepts(r, "application/xml") || accepts(r, "text/xml") {
+		return formatXML
+	}
+	return formatJSON
+}
+
+// accepts reports whether the Accept header of r lists mediaType.
+func accepts(r *http.Request, mediaType string) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		if t, _, err := mime.ParseMediaType(accept); err == nil && t == mediaType {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonWriter buffers all rows and writes them as a single JSON array.
+// Rows are encoded as they are written, so the size of the response is known as it grows.
+type jsonWriter struct {
+	w      http.ResponseWriter
+	r      *http.Request
+	values url.Values
+	rows   bytes.Buffer
+	count  int
+	first  map[string]interface{}
+}
+
+func (jw *jsonWriter) writeRow(_ bigquery.Schema, row map[string]interface{}) error {
+	b, err := json.Marshal(row)
+	if err != nil {
+		return err
+	}
+	if jw.count > 0 {
+		jw.rows.WriteByte(',')
+	} else {
+		jw.first = row
+	}
+	jw.rows.Write(b)
+	jw.count++
+	return nil
+}
+
+func (jw *jsonWriter) close(schema bigquery.Schema, info resultInfo) error {
+	rows := make(json.RawMessage, 0, jw.rows.Len()+2)
+	rows = append(append(append(rows, '['), jw.rows.Bytes()...), ']')
+
+	jsonStr := []byte(rows)
+	var err error
+	switch {
+	case info.scalar:
+		if jw.count != 1 || len(schema) != 1 || info.truncated || info.nextPageToken != "" {
+			writeError(jw.w, http.StatusInternalServerError, errNotScalar.Error(), nil)
+			return errNotScalar
+		}
+		jsonStr, err = json.Marshal(scalarResponse{Value: jw.first[fieldKey(schema[0].Name)]})
+	// Pages are always wrapped, as the next page token must be returned with the rows.
+	case info.envelope || info.paged:
+		jsonStr, err = json.Marshal(envelopeResponse{
+			Query:         info.query,
+			RowCount:      jw.count,
+			ElapsedMs:     info.elapsed.Milliseconds(),
+			Rows:          rows,
+			NextPageToken: info.nextPageToken,
+		})
+	}
+	if err != nil {
+		writeError(jw.w, http.StatusInternalServerError, "encoding results failed", err)
+		return err
+	}
+	if wantsPretty(jw.values) {
+		var indented bytes.Buffer
+		if err := json.Indent(&indented, jsonStr, "", "  "); err != nil {
+			writeError(jw.w, http.StatusInternalServerError, "encoding results failed", err)
+			return err
+		}
+		jsonStr = indented.Bytes()
+	}
+	// Validated by queryHandler before the query ran.
+	callback, _ := jsonpCallback(jw.values)
+	if callback != "" {
+		// The leading comment guards against content sniffing attacks on the callback name.
+		jsonStr = []byte(fmt.Sprintf("/**/%s(%s);", callback, jsonStr))
+	}
+	tag := etag(jsonStr)
+	jw.w.Header().Set("ETag", tag)
+	if etagMatches(jw.r, tag) {
+		jw.w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	if callback != "" {
+		jw.w.Header().Set("Content-Type", "application/javascript")
+		jw.w.Header().Set("X-Content-Type-Options", "nosniff")
+	} else {
+		jw.w.Header().Set("Content-Type", "application/json")
+	}
+	info.setHeaders(jw.w.Header())
+	_, err = jw.w.Write(jsonStr)
+	return err
+}
+
+func (jw *jsonWriter) streaming() bool { return false }
+
+func (jw *jsonWriter) size() int64 { return int64(jw.rows.Len()) }
+
+// ndjsonWriter streams each row as a JSON object followed by a newline,
+// flushing as it goes so clients can consume large results incrementally.
+type ndjsonWriter struct {
+	w       http.ResponseWriter
+	out     byteCounter
+	started bool
+}
+
+// begin sends the response headers, once.
+func (nw *ndjsonWriter) begin() {
+	if nw.started {
+		return
+	}
+	nw.started = true
+	nw.out.w = nw.w
+	nw.w.Header().Set("Content-Type", "application/x-ndjson")
+	// Truncation and paging are only known after the rows have been sent, so they are reported as trailers.
+	nw.w.Header().Set("Trailer", resultTrailers)
+	nw.w.WriteHeader(http.StatusOK)
+}
+
+func (nw *ndjsonWriter) writeRow(_ bigquery.Schema, row map[string]interface{}) error {
+	nw.begin()
+	if err := json.NewEncoder(&nw.out).Encode(row); err != nil {
+		return err
+	}
+	if f, ok := nw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+func (nw *ndjsonWriter) close(_ bigquery.Schema, info resultInfo) error {
+	nw.begin()
+	info.setHeaders(nw.w.Header())
+	return nil
+}
+
+func (nw *ndjsonWriter) streaming() bool { return nw.started }
+
+func (nw *ndjsonWriter) size() int64 { return nw.out.n }
+
+// csvWriter streams rows as CSV, with a header row of the schema field names.
+type csvWriter struct {
+	w       http.ResponseWriter
+	cw      *csv.Writer
+	out     byteCounter
+	started bool
+}
+
+// begin sends the response headers and the CSV header row, once.
+func (c *csvWriter) begin(schema bigquery.Schema) error {
+	if c.started {
+		return nil
+	}
+	c.started = true
+	c.w.Header().Set("Content-Type", "text/csv")
+	c.w.Header().Set("Trailer", resultTrailers)
+	c.w.WriteHeader(http.StatusOK)
+
+	c.out.w = c.w
+	c.cw = csv.NewWriter(&c.out)
+	names := make([]string, len(schema))
+	for i, field := range schema {
+		names[i] = fieldKey(field.Name)
+	}
+	return c.cw.Write(names)
+}
+
+func (c *csvWriter) writeRow(schema bigquery.Schema, row map[string]interface{}) error {
+	if err := c.begin(schema); err != nil {
+		return err
+	}
+	record := make([]string, len(schema))
+	for i, field := range schema {
+		record[i] = csvValue(row[fieldKey(field.Name)])
+	}
+	return c.cw.Write(record)
+}
+
+func (c *csvWriter) close(schema bigquery.Schema, info resultInfo) error {
+	if err := c.begin(schema); err != nil {
+		return err
+	}
+	c.cw.Flush()
+	info.setHeaders(c.w.Header())
+	return c.cw.Error()
+}
+
+func (c *csvWriter) streaming() bool { return c.started }
+
+// size lags behind the rows written by up to the size of the CSV writer's buffer.
+func (c *csvWriter) size() int64 { return c.out.n }
+
+// csvValue formats a converted field value as a CSV cell.
+// Nulls become empty cells and nested values are written as JSON.
+func csvValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return ""
+	case string:
+		return v
+	case []interface{}, map[string]interface{}:
+		b, _ := json.Marshal(v)
+		return string(b)
+	}
+	return fmt.Sprint(v)
+}
+
+// rawWriter writes the text of a result with one row and one STRING column as the whole response,
+// with the query's content type.
+type rawWriter struct {
+	w           http.ResponseWriter
+	r           *http.Request
+	contentType string
+	count       int
+	text        *string
+}
+
+func (rw *rawWriter) writeRow(schema bigquery.Schema, row map[string]interface{}) error {
+	if rw.count == 0 && len(schema) == 1 && schema[0].Type == bigquery.StringFieldType && !schema[0].Repeated {
+		if s, ok := row[fieldKey(schema[0].Name)].(string); ok {
+			rw.text = &s
+		}
+	}
+	rw.count++
+	return nil
+}
+
+func (rw *rawWriter) close(schema bigquery.Schema, info resultInfo) error {
+	if rw.count != 1 || len(schema) != 1 || rw.text == nil || info.truncated || info.nextPageToken != "" {
+		writeError(rw.w, http.StatusInternalServerError, errNotText.Error(), nil)
+		return errNotText
+	}
+	body := []byte(*rw.text)
+	tag := etag(body)
+	rw.w.Header().Set("ETag", tag)
+	if etagMatches(rw.r, tag) {
+		rw.w.WriteHeader(http.StatusNotModified)
+		return nil
+	}
+	rw.w.Header().Set("Content-Type", rw.contentType)
+	rw.w.Header().Set("X-Content-Type-Options", "nosniff")
+	info.setHeaders(rw.w.Header())
+	_, err := rw.w.Write(body)
+	return err
+}
+
+func (rw *rawWriter) streaming() bool { return false }
+
+func (rw *rawWriter) size() int64 {
+	if rw.text == nil {
+		return 0
+	}
+	return int64(len(*rw.text))
+}
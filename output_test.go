@@ -0,0 +1,259 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestCSVWriter(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "name", Type: bigquery.StringFieldType},
+	}
+	w := httptest.NewRecorder()
+	cw := &csvWriter{w: w}
+	for _, row := range []map[string]interface{}{
+		{"id": int64(1), "name": "a, b"},
+		{"id": int64(2), "name": nil},
+	} {
+		if err := cw.writeRow(schema, row); err != nil {
+			t.Fatalf("writeRow() error: %v", err)
+		}
+	}
+	if err := cw.close(schema, resultInfo{}); err != nil {
+		t.Fatalf("close() error: %v", err)
+	}
+
+	if got := w.Header().Get("Content-Type"); got != "text/csv" {
+		t.Errorf("Content-Type = %q, want text/csv", got)
+	}
+	// NULLs are empty cells.
+	if got, want := w.Body.String(), "id,name\n1,\"a, b\"\n2,\n"; got != want {
+		t.Errorf("body = %q, want %q", got, want)
+	}
+}
+
+func TestQueryHandlerFormat(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	useResultCache(t)
+	serveQueries(t, SQLQuery{Name: "cached", SQL: "SELECT 1 AS n", CacheTTL: time.Minute})
+
+	tests := []struct {
+		url, accept string
+		wantType    string
+	}{
+		{"/cached", "", "application/json"},
+		{"/cached?format=csv", "", "text/csv"},
+		{"/cached", "text/csv", "text/csv"},
+		{"/cached?format=json", "text/csv", "application/json"},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, tc.url, nil)
+		r.Header.Set("Accept", tc.accept)
+		w := httptest.NewRecorder()
+		queryHandler(w, r)
+		if got := w.Header().Get("Content-Type"); w.Code != http.StatusOK || !strings.HasPrefix(got, tc.wantType) {
+			t.Errorf("%s, Accept %q: response = %d %s, want 200 %s", tc.url, tc.accept, w.Code, got, tc.wantType)
+		}
+	}
+	runs, cached := fake.queryRuns(), results.lru.Len()
+
+	for _, format := range []string{"yaml", "CSV", "json "} {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/cached?format="+strings.ReplaceAll(format, " ", "%20"), nil))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "unsupported format") {
+			t.Errorf("format %q: response = %d %s, want 400 unsupported format", format, w.Code, w.Body.String())
+		}
+	}
+	if fake.queryRuns() != runs || results.lru.Len() != cached {
+		t.Errorf("unsupported formats ran %d queries and cached %d responses, want none", fake.queryRuns()-runs, results.lru.Len()-cached)
+	}
+}
+
+func TestQueryHandlerNDJSON(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}, {"2"}, {"3"}})
+	serveQueries(t, SQLQuery{Name: "numbers", SQL: "SELECT n", MaxRows: 2})
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/numbers?format=ndjson", nil),
+		httptest.NewRequest(http.MethodGet, "/numbers", nil),
+	} {
+		if r.URL.RawQuery == "" {
+			r.Header.Set("Accept", "application/x-ndjson")
+		}
+		w := httptest.NewRecorder()
+		queryHandler(w, r)
+
+		if got := w.Header().Get("Content-Type"); got != "application/x-ndjson" {
+			t.Errorf("%s: Content-Type = %q, want application/x-ndjson", r.URL, got)
+		}
+		if got, want := w.Body.String(), "{\"n\":1}\n{\"n\":2}\n"; got != want {
+			t.Errorf("%s: body = %q, want %q", r.URL, got, want)
+		}
+		// Rows are flushed as they are written, so truncation is reported in a trailer.
+		if !w.Flushed {
+			t.Errorf("%s: response was not flushed", r.URL)
+		}
+		if got := w.Result().Trailer.Get("X-Result-Truncated"); got != "true" {
+			t.Errorf("%s: X-Result-Truncated trailer = %q, want true", r.URL, got)
+		}
+	}
+}
+
+func TestQueryHandlerEnvelope(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}, {"2"}})
+	serveQueries(t, SQLQuery{Name: "numbers", SQL: "SELECT n"})
+	defer func(v bool) { *envelope = v }(*envelope)
+
+	tests := []struct {
+		flag         bool
+		url          string
+		wantEnvelope bool
+	}{
+		{false, "/numbers", false},
+		{false, "/numbers?envelope=true", true},
+		{true, "/numbers", true},
+		{true, "/numbers?envelope=false", false},
+	}
+	for _, tc := range tests {
+		*envelope = tc.flag
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+
+		rows := w.Body.Bytes()
+		if tc.wantEnvelope {
+			var env envelopeResponse
+			if err := json.Unmarshal(w.Body.Bytes(), &env); err != nil || env.Query != "numbers" || env.RowCount != 2 {
+				t.Errorf("%s with --envelope=%v: body = %s, want an envelope for 2 rows of numbers", tc.url, tc.flag, w.Body.String())
+				continue
+			}
+			rows = env.Rows
+		}
+		if got, want := strings.TrimSpace(string(rows)), `[{"n":1},{"n":2}]`; got != want {
+			t.Errorf("%s with --envelope=%v: rows = %s, want %s", tc.url, tc.flag, got, want)
+		}
+	}
+}
+
+func TestQueryHandlerJSONP(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{Name: "numbers", SQL: "SELECT n"})
+
+	for _, callback := range []string{"cb", "app.handlers.$load_1"} {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/numbers?callback="+callback, nil))
+		if got := w.Header().Get("Content-Type"); got != "application/javascript" {
+			t.Errorf("callback %s: Content-Type = %q, want application/javascript", callback, got)
+		}
+		if got, want := w.Body.String(), "/**/"+callback+`([{"n":1}]);`; got != want {
+			t.Errorf("callback %s: body = %s, want %s", callback, got, want)
+		}
+	}
+
+	runs := fake.queryRuns()
+	for _, callback := range []string{"alert(1)//", "a-b", "1cb", "cb.", strings.Repeat("c", 129)} {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/numbers?callback="+url.QueryEscape(callback), nil))
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "invalid callback") {
+			t.Errorf("callback %q: response = %d %s, want 400 invalid callback", callback, w.Code, w.Body.String())
+		}
+	}
+	if got := fake.queryRuns(); got != runs {
+		t.Errorf("invalid callbacks ran %d queries, want none", got-runs)
+	}
+}
+
+func TestQueryHandlerScalar(t *testing.T) {
+	tests := []struct {
+		schema   []map[string]string
+		rows     [][]interface{}
+		wantCode int
+		wantBody string
+	}{
+		{[]map[string]string{{"name": "c", "type": "INTEGER"}}, [][]interface{}{{"5"}}, http.StatusOK, `{"value":5}`},
+		{[]map[string]string{{"name": "c", "type": "STRING"}}, [][]interface{}{{nil}}, http.StatusOK, `{"value":null}`},
+		{[]map[string]string{{"name": "c", "type": "INTEGER"}}, [][]interface{}{{"5"}, {"6"}}, http.StatusInternalServerError, `{"error":"query result is not a single value"}`},
+		{[]map[string]string{{"name": "c", "type": "INTEGER"}, {"name": "d", "type": "INTEGER"}}, [][]interface{}{{"5", "6"}}, http.StatusInternalServerError, `{"error":"query result is not a single value"}`},
+		{[]map[string]string{{"name": "c", "type": "INTEGER"}}, nil, http.StatusInternalServerError, `{"error":"query result is not a single value"}`},
+	}
+	for _, tc := range tests {
+		newFakeBigQuery(t, tc.schema, tc.rows)
+		serveQueries(t, SQLQuery{Name: "count", SQL: "SELECT COUNT(*) AS c", Scalar: true})
+
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/count", nil))
+		if got := strings.TrimSpace(w.Body.String()); w.Code != tc.wantCode || got != tc.wantBody {
+			t.Errorf("rows %v: response = %d %s, want %d %s", tc.rows, w.Code, got, tc.wantCode, tc.wantBody)
+		}
+	}
+}
+
+func TestQueryHandlerPretty(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}, {"2"}})
+	serveQueries(t, SQLQuery{Name: "numbers", SQL: "SELECT n"})
+	defer func(v bool) { *pretty = v }(*pretty)
+
+	const compact, indented = `[{"n":1},{"n":2}]`, "[\n  {\n    \"n\": 1\n  },\n  {\n    \"n\": 2\n  }\n]"
+	tests := []struct {
+		flag bool
+		url  string
+		want string
+	}{
+		{false, "/numbers", compact},
+		{false, "/numbers?pretty=true", indented},
+		{true, "/numbers", indented},
+		{true, "/numbers?pretty=false", compact},
+	}
+	for _, tc := range tests {
+		*pretty = tc.flag
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if got := strings.TrimSpace(w.Body.String()); got != tc.want {
+			t.Errorf("%s with --pretty=%v: body = %q, want %q", tc.url, tc.flag, got, tc.want)
+		}
+	}
+}
+
+func TestQueryHandlerContentType(t *testing.T) {
+	tests := []struct {
+		schema   []map[string]string
+		rows     [][]interface{}
+		wantCode int
+		wantType string
+		wantBody string
+	}{
+		{[]map[string]string{{"name": "html", "type": "STRING"}}, [][]interface{}{{"<p>Hi & bye</p>"}}, http.StatusOK, "text/html; charset=utf-8", "<p>Hi & bye</p>"},
+		{[]map[string]string{{"name": "html", "type": "STRING"}}, [][]interface{}{{"<p>a</p>"}, {"<p>b</p>"}}, http.StatusInternalServerError, "application/json", `{"error":"query result is not a single text value"}`},
+		{[]map[string]string{{"name": "html", "type": "STRING"}}, [][]interface{}{{nil}}, http.StatusInternalServerError, "application/json", `{"error":"query result is not a single text value"}`},
+		{[]map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}}, http.StatusInternalServerError, "application/json", `{"error":"query result is not a single text value"}`},
+	}
+	for _, tc := range tests {
+		newFakeBigQuery(t, tc.schema, tc.rows)
+		serveQueries(t, SQLQuery{Name: "page", SQL: "SELECT html", ContentType: "text/html; charset=utf-8"})
+
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/page", nil))
+		if got := strings.TrimSpace(w.Body.String()); w.Code != tc.wantCode || got != tc.wantBody {
+			t.Errorf("rows %v: response = %d %s, want %d %s", tc.rows, w.Code, got, tc.wantCode, tc.wantBody)
+		}
+		if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tc.wantType) {
+			t.Errorf("rows %v: Content-Type = %q, want %q", tc.rows, got, tc.wantType)
+		}
+	}
+
+	for _, q := range []SQLQuery{
+		{Name: "bad", SQL: "SELECT 1", ContentType: "text/html; charset"},
+		{Name: "bad", SQL: "SELECT 1", ContentType: "text/html", Scalar: true},
+	} {
+		if err := prepareQuery(&q); err == nil || !strings.Contains(err.Error(), "content_type") {
+			t.Errorf("prepareQuery() with content_type %q = %v, want an error", q.ContentType, err)
+		}
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// errStalePageToken is returned for page tokens which can no longer be used, such as
+// tokens issued before the server restarted or whose query results have expired.
+var errStalePageToken = errors.New("page token is invalid or has expired, start again from the first page")
+
+// pageTokenKey signs page tokens so clients cannot use them to read arbitrary jobs.
+var pageTokenKey []byte
+
+// setPageTokenKey sets the key used to sign page tokens. Without a secret, a random key
+// is used, so tokens become stale when the server restarts and only work with this server.
+func setPageTokenKey(secret string) {
+	if secret != "" {
+		pageTokenKey = []byte(secret)
+		return
+	}
+	pageTokenKey = make([]byte, 32)
+	rand.Read(pageTokenKey)
+}
+
+// pageToken identifies where the next page of a query's results starts. It names the job
+// so later pages are read from the same results rather than by running the query again.
+type pageToken struct {
+	Query    string `json:"q"`
+	Project  string `json:"p"`
+	Location string `json:"l"`
+	JobID    string `json:"j"`
+	Offset   uint64 `json:"o"`
+}
+
+// newPageToken returns the token for the page of results from job starting at offset.
+func newPageToken(query string, job *bigquery.Job, offset uint64) *pageToken {
+	return &pageToken{
+		Query:    query,
+		Project:  job.ProjectID(),
+		Location: job.Location(),
+		JobID:    job.ID(),
+		Offset:   offset,
+	}
+}
+
+// encode returns the signed, URL-safe form of the token.
+func (t *pageToken) encode() string {
+	payload, _ := json.Marshal(t)
+	return base64.RawURLEncoding.EncodeToString(payload) + "." + base64.RawURLEncoding.EncodeToString(signPageToken(payload))
+}
+
+func signPageToken(payload []byte) []byte {
+	mac := hmac.New(sha256.New, pageTokenKey)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+// decodePageToken verifies and decodes a page token issued for the named query.
+func decodePageToken(s, query string) (*pageToken, error) {
+	parts := strings.SplitN(s, ".", 2)
+	if len(parts) != 2 {
+		return nil, errStalePageToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, errStalePageToken
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil || !hmac.Equal(sig, signPageToken(payload)) {
+		return nil, errStalePageToken
+	}
+
+	t := &pageToken{}
+	if err := json.Unmarshal(payload, t); err != nil || t.Query != query {
+		return nil, errStalePageToken
+	}
+	return t, nil
+}
+
+// paging holds the pagination requested with the pageSize and pageToken URL parameters.
+type paging struct {
+	// The number of rows per page, or 0 if the results are not paged.
+	size int
+	// Where the requested page starts, or nil for the first page.
+	token *pageToken
+}
+
+// parsePaging reads the pagination parameters of a request for the named query.
+func parsePaging(values url.Values, query string) (paging, error) {
+	p := paging{}
+	if s := values.Get("pageSize"); s != "" {
+		size, err := strconv.Atoi(s)
+		if err != nil || size <= 0 {
+			return p, fmt.Errorf("invalid pageSize %q, must be a positive integer", s)
+		}
+		p.size = size
+	}
+	if s := values.Get("pageToken"); s != "" {
+		if p.size == 0 {
+			return p, errors.New("pageToken requires pageSize")
+		}
+		t, err := decodePageToken(s, query)
+		if err != nil {
+			return p, err
+		}
+		p.token = t
+	}
+	return p, nil
+}
+
+// readPage reads the results of the job named by t, starting at its offset.
+func readPage(ctx context.Context, client *bigquery.Client, t *pageToken) (*bigquery.RowIterator, error) {
+	var it *bigquery.RowIterator
+	err := withRetry(ctx, func() error {
+		job, err := client.JobFromProject(ctx, t.Project, t.JobID, t.Location)
+		if err != nil {
+			return err
+		}
+		it, err = job.Read(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	it.StartIndex = t.Offset
+	return it, nil
+}
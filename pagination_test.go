@@ -0,0 +1,106 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestQueryHandlerPages(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}, {"2"}, {"3"}, {"4"}, {"5"}})
+	serveQueries(t, SQLQuery{Name: "numbers", SQL: "SELECT n"})
+	defer func(key []byte) { pageTokenKey = key }(pageTokenKey)
+	setPageTokenKey("secret")
+
+	var pages [][]map[string]int
+	token := ""
+	for i := 0; i < 5; i++ {
+		target := "/numbers?pageSize=2"
+		if token != "" {
+			target += "&pageToken=" + url.QueryEscape(token)
+		}
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, target, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("page %d: status = %d, want 200: %s", i+1, w.Code, w.Body.String())
+		}
+		var page struct {
+			Rows          []map[string]int `json:"rows"`
+			NextPageToken string           `json:"nextPageToken"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &page); err != nil {
+			t.Fatalf("page %d: decoding %s: %v", i+1, w.Body.String(), err)
+		}
+		if got := w.Header().Get("X-Next-Page-Token"); got != page.NextPageToken {
+			t.Errorf("page %d: X-Next-Page-Token = %q, want %q", i+1, got, page.NextPageToken)
+		}
+		pages = append(pages, page.Rows)
+		if token = page.NextPageToken; token == "" {
+			break
+		}
+	}
+
+	want := [][]map[string]int{{{"n": 1}, {"n": 2}}, {{"n": 3}, {"n": 4}}, {{"n": 5}}}
+	if !reflect.DeepEqual(pages, want) {
+		t.Errorf("pages = %v, want %v", pages, want)
+	}
+	// Later pages are read from the first page's job rather than running the query again.
+	if got := fake.queryRuns(); got != 1 {
+		t.Errorf("queries run = %d, want 1", got)
+	}
+}
+
+func TestQueryHandlerStalePageToken(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}, {"2"}, {"3"}})
+	serveQueries(t, SQLQuery{Name: "numbers", SQL: "SELECT n"}, SQLQuery{Name: "other", SQL: "SELECT n"})
+	defer func(key []byte) { pageTokenKey = key }(pageTokenKey)
+
+	// firstPage returns the next page token of the first page of numbers.
+	firstPage := func() string {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/numbers?pageSize=1", nil))
+		token := w.Header().Get("X-Next-Page-Token")
+		if token == "" {
+			t.Fatalf("first page has no next page token: %s", w.Body.String())
+		}
+		return token
+	}
+	// Tokens signed with another key, like those issued before a restart without --page_token_secret, are stale.
+	setPageTokenKey("old")
+	oldToken := firstPage()
+	setPageTokenKey("secret")
+	token := firstPage()
+	runs := fake.queryRuns()
+
+	tests := []struct {
+		target   string
+		wantCode int
+	}{
+		{"/numbers?pageSize=1&pageToken=" + url.QueryEscape(oldToken), http.StatusGone},
+		{"/numbers?pageSize=1&pageToken=garbage", http.StatusGone},
+		// Tokens only work for the query they were issued for.
+		{"/other?pageSize=1&pageToken=" + url.QueryEscape(token), http.StatusGone},
+		{"/numbers?pageToken=" + url.QueryEscape(token), http.StatusBadRequest},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, tc.target, nil))
+		if w.Code != tc.wantCode {
+			t.Errorf("%s: status = %d, want %d: %s", tc.target, w.Code, tc.wantCode, w.Body.String())
+		}
+	}
+
+	// Tokens whose job results have expired are gone too.
+	fake.fail(-1, fakeError{code: http.StatusNotFound, reason: "notFound", message: "Not found: Job project:US.job"})
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/numbers?pageSize=1&pageToken="+url.QueryEscape(token), nil))
+	if w.Code != http.StatusGone {
+		t.Errorf("expired results: status = %d, want 410: %s", w.Code, w.Body.String())
+	}
+	if got := fake.queryRuns(); got != runs {
+		t.Errorf("stale page tokens ran %d queries, want none", got-runs)
+	}
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+)
+
+// Parameter describes a named parameter accepted by a query.
+type Parameter struct {
+	// The BigQuery type the request value is converted to.
+	Type bigquery.FieldType `yaml:"type"`
+	// Whether the request must include the parameter.
+	Required bool `yaml:"required"`
+	// Value used when the request omits the parameter, converted just like a request value.
+	Default *string `yaml:"default"`
+	// Regular expression that string values must match.
+	Pattern string `yaml:"pattern"`
+	// Whether the parameter is an ARRAY of Type, taking every value given for it in the URL.
+	Repeated bool `yaml:"repeated"`
+	// Whether a typed NULL is sent when the request omits the parameter, rather than the zero value.
+	Nullable bool `yaml:"nullable"`
+	// Inclusive bounds on the values of INTEGER, FLOAT and NUMERIC parameters.
+	Min *float64 `yaml:"min"`
+	Max *float64 `yaml:"max"`
+	// The fields of a RECORD (or STRUCT) parameter, whose value is given as a JSON object.
+	Fields map[string]Parameter `yaml:"fields"`
+	// The name of a transform applied to request values before they are checked and converted.
+	Transform string `yaml:"transform"`
+
+	// The compiled Pattern, set when the query is loaded.
+	pattern *regexp.Regexp
+}
+
+// UnmarshalYAML allows a parameter to be declared with just its type, like "id: INTEGER",
+// or as a mapping with additional options.
+func (p *Parameter) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var fieldType bigquery.FieldType
+	if err := unmarshal(&fieldType); err == nil {
+		*p = Parameter{Type: fieldType}
+		return nil
+	}
+
+	// plain has the same fields as Parameter but not this UnmarshalYAML method.
+	type plain Parameter
+	return unmarshal((*plain)(p))
+}
+
+// transforms are the functions parameters can apply to their request values, by name.
+var transforms = map[string]func(string) (string, error){
+	"lowercase": func(v string) (string, error) { return strings.ToLower(v), nil },
+	"trim":      func(v string) (string, error) { return strings.TrimSpace(v), nil },
+	// Converts milliseconds since the Unix epoch into an RFC 3339 timestamp, for TIMESTAMP parameters.
+	"epoch_ms_to_timestamp": func(v string) (string, error) {
+		ms, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("%q is not a number of milliseconds", v)
+		}
+		return time.UnixMilli(ms).UTC().Format(time.RFC3339Nano), nil
+	},
+}
+
+// wktPattern loosely matches well-known text (WKT) geometries, like "POINT(1 2)".
+var wktPattern = regexp.MustCompile(`(?is)^\s*(POINT|LINESTRING|POLYGON|MULTIPOINT|MULTILINESTRING|MULTIPOLYGON|GEOMETRYCOLLECTION)\s*(Z|M|ZM)?\s*(\(.*\)|EMPTY)\s*$`)
+
+// maxBodyBytes bounds the size of a JSON request body.
+const maxBodyBytes = 1 << 20
+
+// readBodyParams decodes the JSON object body of a POST request into parameter values,
+// decompressing it first if it was sent with Content-Encoding: gzip.
+// Other requests, and POST requests without a body, have no body parameters.
+func readBodyParams(w http.ResponseWriter, r *http.Request) (map[string]interface{}, error) {
+	body := map[string]interface{}{}
+	if r.Method != http.MethodPost {
+		return body, nil
+	}
+
+	in := http.MaxBytesReader(w, r.Body, maxBodyBytes)
+	switch encoding := strings.TrimSpace(r.Header.Get("Content-Encoding")); {
+	case strings.EqualFold(encoding, "gzip"):
+		gz, err := gzip.NewReader(in)
+		if err == io.EOF {
+			return body, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid gzip body: %v", err)
+		}
+		defer gz.Close()
+		// The decompressed body is bounded too, so small bodies can't expand without limit.
+		in = http.MaxBytesReader(w, gz, maxBodyBytes)
+	case encoding != "" && !strings.EqualFold(encoding, "identity"):
+		return nil, fmt.Errorf("unsupported Content-Encoding %q", encoding)
+	}
+
+	dec := json.NewDecoder(in)
+	// Keep numbers as json.Number so large integers aren't rounded through float64.
+	dec.UseNumber()
+	if err := dec.Decode(&body); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("invalid JSON body: %v", err)
+	}
+	return body, nil
+}
+
+// reservedParams are URL parameters interpreted by the proxy itself rather than passed to queries.
+var reservedParams = map[string]bool{
+	"format":    true,
+	"callback":  true,
+	"dryRun":    true,
+	"explain":   true,
+	"fields":    true,
+	"envelope":  true,
+	"pretty":    true,
+	"pageSize":  true,
+	"pageToken": true,
+}
+
+// checkUnknownParams reports request parameters which are neither declared by the query nor reserved,
+// such as misspelled parameter names.
+func checkUnknownParams(query SQLQuery, values url.Values, body map[string]interface{}) error {
+	declared := func(key string) bool {
+		_, isParam := query.Parameters[key]
+		_, isIdent := query.Identifiers[key]
+		isLimit := query.MaxLimit > 0 && (key == limitParam || key == offsetParam)
+		return isParam || isIdent || isLimit
+	}
+	unknown := []string{}
+	for key := range values {
+		if !declared(key) && !reservedParams[key] {
+			unknown = append(unknown, key)
+		}
+	}
+	for key := range body {
+		if !declared(key) {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return fmt.Errorf("unknown parameters: %s", strings.Join(unknown, ", "))
+}
+
+// paramError is a problem with a request parameter.
+type paramError struct {
+	param string
+	msg   string
+}
+
+// paramErrors lists every problem found with the parameters of a request.
+type paramErrors []paramError
+
+func (e paramErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, err := range e {
+		msgs[i] = err.msg
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// buildQueryParams builds the BigQuery parameters for a request.
+// Values in the JSON body take precedence over those in the URL.
+// If any parameter is missing or invalid, the returned paramErrors lists them all.
+func buildQueryParams(config map[string]Parameter, values url.Values, body map[string]interface{}) ([]bigquery.QueryParameter, error) {
+	keys := make([]string, 0, len(config))
+	for key := range config {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	params := []bigquery.QueryParameter{}
+	var errs paramErrors
+	for _, key := range keys {
+		param := config[key]
+		// A parameter counts as present even when its value is empty, e.g. "?name=".
+		_, inURL := values[key]
+		_, inBody := body[key]
+		if param.Required && !inURL && !inBody {
+			errs = append(errs, paramError{key, fmt.Sprintf("missing required parameter %q", key)})
+			continue
+		}
+
+		v, err := requestValue(key, param, values, body)
+		if err != nil {
+			errs = append(errs, paramError{key, fmt.Sprintf("invalid %s value for parameter %q: %v", param.Type, key, err)})
+			continue
+		}
+
+		params = append(params, bigquery.QueryParameter{
+			Name:  key,
+			Value: v,
+		})
+	}
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return params, nil
+}
+
+// requestValue returns the native value of a parameter from the request body, the URL or its default.
+func requestValue(key string, param Parameter, values url.Values, body map[string]interface{}) (interface{}, error) {
+	raw, inBody := body[key]
+
+	if param.Repeated {
+		elems := []interface{}{}
+		if inBody {
+			list, ok := raw.([]interface{})
+			if !ok {
+				return nil, fmt.Errorf("expected a JSON array, got %v", raw)
+			}
+			for _, e := range list {
+				v, err := jsonParamValue(param, e)
+				if err != nil {
+					return nil, err
+				}
+				elems = append(elems, v)
+			}
+		} else {
+			// Every value is used, as in "?ids=1&ids=2".
+			for _, value := range values[key] {
+				v, err := paramValue(param, value)
+				if err != nil {
+					return nil, err
+				}
+				elems = append(elems, v)
+			}
+		}
+		return arrayValue(param.Type, elems), nil
+	}
+
+	if inBody {
+		return jsonParamValue(param, raw)
+	}
+	value := values.Get(key)
+	if _, ok := values[key]; !ok {
+		// RECORD parameters have no zero value to fall back on, so are always NULL when omitted.
+		if param.Nullable || param.Type == bigquery.RecordFieldType {
+			return nullValue(param), nil
+		}
+		if param.Default != nil {
+			value = *param.Default
+		}
+	}
+	return paramValue(param, value)
+}
+
+// nullValue returns a NULL value of the parameter's type.
+func nullValue(param Parameter) *bigquery.QueryParameterValue {
+	return &bigquery.QueryParameterValue{
+		Type: sqlDataType(param),
+		// An invalid NullString is sent without a value, which the explicit Type makes a typed NULL.
+		Value: bigquery.NullString{},
+	}
+}
+
+// arrayValue builds an ARRAY parameter value from elements of the given type.
+func arrayValue(fieldType bigquery.FieldType, elems []interface{}) *bigquery.QueryParameterValue {
+	v := &bigquery.QueryParameterValue{
+		Type: bigquery.StandardSQLDataType{
+			TypeKind:         "ARRAY",
+			ArrayElementType: &bigquery.StandardSQLDataType{TypeKind: standardSQLType(fieldType)},
+		},
+	}
+	if len(elems) == 0 {
+		// An empty ArrayValue is treated as unset, so an empty slice is used instead.
+		v.Value = []interface{}{}
+		return v
+	}
+	for _, e := range elems {
+		// Element types come from the array's type, so only the values of typed elements are used.
+		if typed, ok := e.(*bigquery.QueryParameterValue); ok {
+			v.ArrayValue = append(v.ArrayValue, *typed)
+			continue
+		}
+		v.ArrayValue = append(v.ArrayValue, bigquery.QueryParameterValue{Value: e})
+	}
+	return v
+}
+
+// structValue builds a RECORD parameter value from a JSON object, checking it against the declared fields.
+// Fields which are omitted or null are sent as NULL, unless they are required.
+func structValue(param Parameter, raw interface{}) (*bigquery.QueryParameterValue, error) {
+	obj, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("expected a JSON object, got %v", raw)
+	}
+	unknown := []string{}
+	for name := range obj {
+		if _, ok := param.Fields[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return nil, fmt.Errorf("unknown fields: %s", strings.Join(unknown, ", "))
+	}
+
+	v := &bigquery.QueryParameterValue{
+		Type:        sqlDataType(param),
+		StructValue: map[string]bigquery.QueryParameterValue{},
+	}
+	for name, field := range param.Fields {
+		fieldRaw, ok := obj[name]
+		if !ok || fieldRaw == nil {
+			if field.Required {
+				return nil, fmt.Errorf("missing required field %q", name)
+			}
+			v.StructValue[name] = bigquery.QueryParameterValue{Value: bigquery.NullString{}}
+			continue
+		}
+		fv, err := jsonParamValue(field, fieldRaw)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s value for field %q: %v", field.Type, name, err)
+		}
+		// Field types come from the struct's type, so only the values of typed fields are used.
+		if typed, ok := fv.(*bigquery.QueryParameterValue); ok {
+			v.StructValue[name] = *typed
+		} else {
+			v.StructValue[name] = bigquery.QueryParameterValue{Value: fv}
+		}
+	}
+	return v, nil
+}
+
+// sqlDataType returns the standard SQL type of a parameter, including the fields of RECORD parameters.
+// Struct fields are ordered by name, as they are declared in a map.
+func sqlDataType(param Parameter) bigquery.StandardSQLDataType {
+	t := bigquery.StandardSQLDataType{TypeKind: standardSQLType(param.Type)}
+	if param.Type != bigquery.RecordFieldType {
+		return t
+	}
+	names := make([]string, 0, len(param.Fields))
+	for name := range param.Fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	t.StructType = &bigquery.StandardSQLStructType{}
+	for _, name := range names {
+		fieldType := sqlDataType(param.Fields[name])
+		t.StructType.Fields = append(t.StructType.Fields, &bigquery.StandardSQLField{Name: name, Type: &fieldType})
+	}
+	return t
+}
+
+// parameterTypes are the types a parameter may be declared with, using the legacy SQL names
+// of the BigQuery API once fieldTypeAliases are applied. Parameters declared without a type are STRINGs.
+var parameterTypes = map[bigquery.FieldType]bool{
+	"":                          true,
+	bigquery.StringFieldType:    true,
+	bigquery.BytesFieldType:     true,
+	bigquery.IntegerFieldType:   true,
+	bigquery.FloatFieldType:     true,
+	bigquery.BooleanFieldType:   true,
+	bigquery.TimestampFieldType: true,
+	bigquery.DateTimeFieldType:  true,
+	bigquery.DateFieldType:      true,
+	bigquery.TimeFieldType:      true,
+	bigquery.NumericFieldType:   true,
+	bigquery.IntervalFieldType:  true,
+	bigquery.GeographyFieldType: true,
+	bigquery.RecordFieldType:    true,
+}
+
+// standardSQLType returns the standard SQL name of a BigQuery field type, for use in explicitly typed parameters.
+func standardSQLType(fieldType bigquery.FieldType) string {
+	switch fieldType {
+	case bigquery.IntegerFieldType:
+		return "INT64"
+	case bigquery.FloatFieldType:
+		return "FLOAT64"
+	case bigquery.BooleanFieldType:
+		return "BOOL"
+	case bigquery.RecordFieldType:
+		return "STRUCT"
+	}
+	return string(fieldType)
+}
+
+// paramValue checks a request value (string) against the parameter's pattern and converts it to the parameter type.
+func paramValue(param Parameter, value string) (interface{}, error) {
+	if transform, ok := transforms[param.Transform]; ok {
+		var err error
+		if value, err = transform(value); err != nil {
+			return nil, err
+		}
+	}
+	if param.Type == bigquery.RecordFieldType {
+		// RECORD values in the URL are JSON objects too.
+		dec := json.NewDecoder(strings.NewReader(value))
+		dec.UseNumber()
+		var raw interface{}
+		if err := dec.Decode(&raw); err != nil {
+			return nil, fmt.Errorf("invalid JSON object: %v", err)
+		}
+		return structValue(param, raw)
+	}
+	if param.pattern != nil && !param.pattern.MatchString(value) {
+		return nil, fmt.Errorf("%q does not match pattern %s", value, param.Pattern)
+	}
+	v, err := parseValue(param.Type, value)
+	if err != nil {
+		return nil, err
+	}
+	return v, checkRange(param, v)
+}
+
+// checkRange reports numeric values outside the parameter's min and max bounds.
+func checkRange(param Parameter, v interface{}) error {
+	if param.Min == nil && param.Max == nil {
+		return nil
+	}
+	var n *big.Rat
+	shown := fmt.Sprint(v)
+	switch v := v.(type) {
+	case int64:
+		n = new(big.Rat).SetInt64(v)
+	case float64:
+		n = new(big.Rat)
+		if n.SetFloat64(v) == nil {
+			return fmt.Errorf("%v is not a finite number", v)
+		}
+	case *big.Rat:
+		n = v
+		shown = v.RatString()
+	default:
+		return nil
+	}
+	if param.Min != nil && n.Cmp(new(big.Rat).SetFloat64(*param.Min)) < 0 {
+		return fmt.Errorf("%s is less than the minimum %v", shown, *param.Min)
+	}
+	if param.Max != nil && n.Cmp(new(big.Rat).SetFloat64(*param.Max)) > 0 {
+		return fmt.Errorf("%s is greater than the maximum %v", shown, *param.Max)
+	}
+	return nil
+}
+
+// jsonParamValue converts a value from a JSON body to the parameter type.
+// Strings are handled like request values, including the pattern check,
+// as are numbers for parameters with a transform. A JSON null is a NULL of
+// the parameter's type, for nullable parameters only.
+func jsonParamValue(param Parameter, raw interface{}) (interface{}, error) {
+	if raw == nil {
+		if param.Nullable {
+			return nullValue(param), nil
+		}
+		return nil, errors.New("parameter cannot be null")
+	}
+	if param.Type == bigquery.RecordFieldType {
+		return structValue(param, raw)
+	}
+	if s, ok := raw.(string); ok {
+		return paramValue(param, s)
+	}
+	if n, ok := raw.(json.Number); ok && param.Transform != "" {
+		return paramValue(param, n.String())
+	}
+	v, err := convertJSONValue(param.Type, raw)
+	if err != nil {
+		return nil, err
+	}
+	return v, checkRange(param, v)
+}
+
+// convertJSONValue converts a value decoded from a JSON body into the native type for BigQuery.
+// Typed JSON values are used as-is, while strings go through the same parsing as URL values.
+func convertJSONValue(fieldType bigquery.FieldType, raw interface{}) (interface{}, error) {
+	switch v := raw.(type) {
+	case string:
+		return parseValue(fieldType, v)
+	case json.Number:
+		switch fieldType {
+		case bigquery.IntegerFieldType:
+			return v.Int64()
+		case bigquery.FloatFieldType:
+			return v.Float64()
+		case bigquery.NumericFieldType:
+			return parseValue(fieldType, v.String())
+		}
+	case bool:
+		if fieldType == bigquery.BooleanFieldType {
+			return v, nil
+		}
+	}
+	return nil, fmt.Errorf("unexpected JSON value %v", raw)
+}
+
+// parseValue converts a request value (string) into the native type before being passed to BigQuery.
+func parseValue(fieldType bigquery.FieldType, value string) (interface{}, error) {
+	switch fieldType {
+	case bigquery.IntegerFieldType:
+		return strconv.ParseInt(value, 10, 64)
+	case bigquery.BooleanFieldType:
+		return value == "true", nil
+	case bigquery.FloatFieldType:
+		return strconv.ParseFloat(value, 64)
+	case bigquery.TimestampFieldType:
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, fmt.Errorf("%q is not an RFC 3339 timestamp", value)
+		}
+		return t, nil
+	case bigquery.DateTimeFieldType:
+		return civil.ParseDateTime(value)
+	case bigquery.DateFieldType:
+		return civil.ParseDate(value)
+	case bigquery.TimeFieldType:
+		return civil.ParseTime(value)
+	case bigquery.NumericFieldType:
+		r, ok := new(big.Rat).SetString(value)
+		if !ok {
+			return nil, fmt.Errorf("%q is not a decimal number", value)
+		}
+		return r, nil
+	case bigquery.BytesFieldType:
+		return base64.StdEncoding.DecodeString(value)
+	case bigquery.IntervalFieldType:
+		iv, err := parseInterval(value)
+		if err != nil {
+			return nil, err
+		}
+		return intervalParam(iv), nil
+	case bigquery.GeographyFieldType:
+		if !wktPattern.MatchString(value) {
+			return nil, fmt.Errorf("%q is not a WKT geography", value)
+		}
+		// A plain string would be sent as a STRING parameter, so the type is given explicitly.
+		return &bigquery.QueryParameterValue{
+			Type:  bigquery.StandardSQLDataType{TypeKind: string(bigquery.GeographyFieldType)},
+			Value: value,
+		}, nil
+	}
+	return value, nil
+}
@@ -0,0 +1,472 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"cloud.google.com/go/bigquery"
+	"cloud.google.com/go/civil"
+)
+
+func TestParseValue(t *testing.T) {
+	tests := []struct {
+		fieldType bigquery.FieldType
+		value     string
+		want      interface{}
+		wantErr   bool
+	}{
+		{bigquery.StringFieldType, "hello", "hello", false},
+		{"", "hello", "hello", false},
+		{bigquery.IntegerFieldType, "42", int64(42), false},
+		{bigquery.IntegerFieldType, "-7", int64(-7), false},
+		{bigquery.IntegerFieldType, "4.2", nil, true},
+		{bigquery.BooleanFieldType, "true", true, false},
+		{bigquery.BooleanFieldType, "yes", false, false},
+		{bigquery.FloatFieldType, "1.5", 1.5, false},
+		{bigquery.FloatFieldType, "x", nil, true},
+		{bigquery.TimestampFieldType, "2020-01-02T03:04:05Z", time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC), false},
+		{bigquery.TimestampFieldType, "2020-01-02", nil, true},
+		{bigquery.DateTimeFieldType, "2020-01-02T03:04:05", civil.DateTime{Date: civil.Date{Year: 2020, Month: 1, Day: 2}, Time: civil.Time{Hour: 3, Minute: 4, Second: 5}}, false},
+		{bigquery.DateTimeFieldType, "2020-01-02T03:04:05Z", nil, true},
+		{bigquery.DateFieldType, "2020-01-02", civil.Date{Year: 2020, Month: 1, Day: 2}, false},
+		{bigquery.DateFieldType, "2020-13-02", nil, true},
+		{bigquery.TimeFieldType, "03:04:05", civil.Time{Hour: 3, Minute: 4, Second: 5}, false},
+		{bigquery.TimeFieldType, "3pm", nil, true},
+		{bigquery.NumericFieldType, "1.25", big.NewRat(5, 4), false},
+		{bigquery.NumericFieldType, "abc", nil, true},
+		{bigquery.BytesFieldType, "aGk=", []byte("hi"), false},
+		{bigquery.BytesFieldType, "!!", nil, true},
+		{bigquery.IntervalFieldType, "P1D", intervalParam(&bigquery.IntervalValue{Days: 1}), false},
+		{bigquery.IntervalFieldType, "1 day", nil, true},
+		{bigquery.GeographyFieldType, "POINT(1 2)", &bigquery.QueryParameterValue{
+			Type:  bigquery.StandardSQLDataType{TypeKind: "GEOGRAPHY"},
+			Value: "POINT(1 2)",
+		}, false},
+		{bigquery.GeographyFieldType, "somewhere", nil, true},
+	}
+	for _, tc := range tests {
+		got, err := parseValue(tc.fieldType, tc.value)
+		if tc.wantErr {
+			if err == nil {
+				t.Errorf("parseValue(%s, %q) = %#v, want an error", tc.fieldType, tc.value, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseValue(%s, %q) unexpected error: %v", tc.fieldType, tc.value, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("parseValue(%s, %q) = %#v, want %#v", tc.fieldType, tc.value, got, tc.want)
+		}
+	}
+}
+
+// prepareParameters prepares parameters as if they were loaded with a query.
+func prepareParameters(t *testing.T, config map[string]Parameter) map[string]Parameter {
+	t.Helper()
+	for key, param := range config {
+		param, err := prepareParameter(key, param)
+		if err != nil {
+			t.Fatal(err)
+		}
+		config[key] = param
+	}
+	return config
+}
+
+func TestBuildQueryParams(t *testing.T) {
+	three := "3"
+	tests := []struct {
+		name   string
+		config map[string]Parameter
+		url    string
+		body   map[string]interface{}
+		want   []bigquery.QueryParameter
+	}{
+		{
+			name:   "URL value",
+			config: map[string]Parameter{"id": {Type: bigquery.IntegerFieldType, Required: true}},
+			url:    "id=5",
+			want:   []bigquery.QueryParameter{{Name: "id", Value: int64(5)}},
+		},
+		{
+			name:   "default",
+			config: map[string]Parameter{"n": {Type: bigquery.IntegerFieldType, Default: &three}},
+			want:   []bigquery.QueryParameter{{Name: "n", Value: int64(3)}},
+		},
+		{
+			name:   "zero value when omitted",
+			config: map[string]Parameter{"name": {Type: bigquery.StringFieldType}},
+			want:   []bigquery.QueryParameter{{Name: "name", Value: ""}},
+		},
+		{
+			name:   "body takes precedence",
+			config: map[string]Parameter{"id": {Type: bigquery.IntegerFieldType}},
+			url:    "id=5",
+			body:   map[string]interface{}{"id": json.Number("7")},
+			want:   []bigquery.QueryParameter{{Name: "id", Value: int64(7)}},
+		},
+		{
+			name:   "repeated",
+			config: map[string]Parameter{"ids": {Type: bigquery.IntegerFieldType, Repeated: true}},
+			url:    "ids=1&ids=2",
+			want:   []bigquery.QueryParameter{{Name: "ids", Value: arrayValue(bigquery.IntegerFieldType, []interface{}{int64(1), int64(2)})}},
+		},
+		{
+			name:   "nullable",
+			config: map[string]Parameter{"at": {Type: bigquery.TimestampFieldType, Nullable: true}},
+			want:   []bigquery.QueryParameter{{Name: "at", Value: nullValue(Parameter{Type: bigquery.TimestampFieldType})}},
+		},
+		{
+			name: "sorted by name",
+			config: map[string]Parameter{
+				"b": {Type: bigquery.StringFieldType},
+				"a": {Type: bigquery.StringFieldType},
+			},
+			url:  "a=1&b=2",
+			want: []bigquery.QueryParameter{{Name: "a", Value: "1"}, {Name: "b", Value: "2"}},
+		},
+	}
+	for _, tc := range tests {
+		values, err := url.ParseQuery(tc.url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := buildQueryParams(prepareParameters(t, tc.config), values, tc.body)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %#v, want %#v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestBuildQueryParamsErrors(t *testing.T) {
+	config := prepareParameters(t, map[string]Parameter{
+		"id":   {Type: bigquery.IntegerFieldType, Required: true},
+		"code": {Type: bigquery.StringFieldType, Pattern: "^[A-Z]{3}$"},
+		"n":    {Type: bigquery.IntegerFieldType},
+		"ok":   {Type: bigquery.StringFieldType},
+	})
+	values, _ := url.ParseQuery("code=abc&n=x&ok=fine")
+
+	_, err := buildQueryParams(config, values, nil)
+	errs, ok := err.(paramErrors)
+	if !ok {
+		t.Fatalf("error = %v, want paramErrors", err)
+	}
+	got := []string{}
+	for _, e := range errs {
+		got = append(got, e.param)
+	}
+	// Every invalid parameter is reported, in order of name.
+	if want := []string{"code", "id", "n"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("parameters with errors = %v, want %v", got, want)
+	}
+}
+
+func TestBuildQueryParamsJSONNull(t *testing.T) {
+	config := prepareParameters(t, map[string]Parameter{
+		"n":  {Type: bigquery.IntegerFieldType, Nullable: true},
+		"id": {Type: bigquery.IntegerFieldType},
+	})
+
+	got, err := buildQueryParams(config, url.Values{}, map[string]interface{}{"n": nil, "id": json.Number("1")})
+	if err != nil {
+		t.Fatalf("null for a nullable parameter: unexpected error: %v", err)
+	}
+	want := []bigquery.QueryParameter{
+		{Name: "id", Value: int64(1)},
+		{Name: "n", Value: nullValue(Parameter{Type: bigquery.IntegerFieldType})},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("null for a nullable parameter: got %#v, want %#v", got, want)
+	}
+
+	_, err = buildQueryParams(config, url.Values{}, map[string]interface{}{"id": nil})
+	if want := `invalid INTEGER value for parameter "id": parameter cannot be null`; errString(err) != want {
+		t.Errorf("null for a parameter which is not nullable: error = %v, want %q", err, want)
+	}
+}
+
+func TestParamValuePattern(t *testing.T) {
+	config := prepareParameters(t, map[string]Parameter{
+		"code":  {Type: bigquery.StringFieldType, Pattern: "^[A-Z]{3}$"},
+		"codes": {Type: bigquery.StringFieldType, Pattern: "^[A-Z]{3}$", Repeated: true},
+	})
+	tests := []struct {
+		url     string
+		wantErr string
+	}{
+		{"code=ABC&codes=DEF&codes=GHI", ""},
+		{"code=abc", `invalid STRING value for parameter "code": "abc" does not match pattern ^[A-Z]{3}$`},
+		{"code=ABCD", `invalid STRING value for parameter "code": "ABCD" does not match pattern ^[A-Z]{3}$`},
+		// Each value of a repeated parameter must match.
+		{"code=ABC&codes=DEF&codes=x", `invalid STRING value for parameter "codes": "x" does not match pattern ^[A-Z]{3}$`},
+	}
+	for _, tc := range tests {
+		values, _ := url.ParseQuery(tc.url)
+		_, err := buildQueryParams(config, values, nil)
+		if got := errString(err); got != tc.wantErr {
+			t.Errorf("buildQueryParams(%s) error = %q, want %q", tc.url, got, tc.wantErr)
+		}
+	}
+
+	if _, err := prepareParameter("code", Parameter{Pattern: "[A-Z"}); err == nil || !strings.Contains(err.Error(), `invalid pattern for parameter "code"`) {
+		t.Errorf("prepareParameter() with an invalid pattern = %v, want an invalid pattern error", err)
+	}
+}
+
+func TestParamValueRange(t *testing.T) {
+	min, max := 1.0, 10.0
+	config := prepareParameters(t, map[string]Parameter{
+		"window": {Type: bigquery.IntegerFieldType, Min: &min, Max: &max},
+		"ratio":  {Type: bigquery.FloatFieldType, Max: &max},
+		"price":  {Type: bigquery.NumericFieldType, Min: &min},
+	})
+	tests := []struct {
+		url     string
+		wantErr string
+	}{
+		{"window=1&ratio=10&price=1", ""},
+		{"window=10&ratio=-5.5&price=99.99", ""},
+		{"window=0&ratio=1&price=1", `invalid INTEGER value for parameter "window": 0 is less than the minimum 1`},
+		{"window=11&ratio=1&price=1", `invalid INTEGER value for parameter "window": 11 is greater than the maximum 10`},
+		{"window=5&ratio=10.01&price=1", `invalid FLOAT value for parameter "ratio": 10.01 is greater than the maximum 10`},
+		{"window=5&ratio=Inf&price=1", `invalid FLOAT value for parameter "ratio": +Inf is not a finite number`},
+		{"window=5&ratio=1&price=0.999", `invalid NUMERIC value for parameter "price": 999/1000 is less than the minimum 1`},
+	}
+	for _, tc := range tests {
+		values, _ := url.ParseQuery(tc.url)
+		_, err := buildQueryParams(config, values, nil)
+		if got := errString(err); got != tc.wantErr {
+			t.Errorf("buildQueryParams(%s) error = %q, want %q", tc.url, got, tc.wantErr)
+		}
+	}
+
+	for _, param := range []Parameter{
+		{Type: bigquery.StringFieldType, Min: &min},
+		{Type: bigquery.IntegerFieldType, Min: &max, Max: &min},
+	} {
+		if _, err := prepareParameter("p", param); err == nil {
+			t.Errorf("prepareParameter(%+v) succeeded, want an error", param)
+		}
+	}
+}
+
+func TestParamValueTransform(t *testing.T) {
+	config := prepareParameters(t, map[string]Parameter{
+		"since": {Type: bigquery.TimestampFieldType, Transform: "epoch_ms_to_timestamp"},
+		"email": {Type: bigquery.StringFieldType, Transform: "lowercase", Pattern: "^[a-z@.]+$"},
+		"name":  {Type: bigquery.StringFieldType, Transform: "trim"},
+	})
+	since := time.Date(2020, 1, 2, 3, 4, 5, 678000000, time.UTC)
+	tests := []struct {
+		url     string
+		body    map[string]interface{}
+		want    []bigquery.QueryParameter
+		wantErr string
+	}{
+		{
+			url:  "since=1577934245678&email=Ann@Example.COM&name=%20Ann%20",
+			want: []bigquery.QueryParameter{{Name: "email", Value: "ann@example.com"}, {Name: "name", Value: "Ann"}, {Name: "since", Value: since}},
+		},
+		{
+			// JSON numbers are transformed too.
+			url:  "email=a&name=b",
+			body: map[string]interface{}{"since": json.Number("1577934245678")},
+			want: []bigquery.QueryParameter{{Name: "email", Value: "a"}, {Name: "name", Value: "b"}, {Name: "since", Value: since}},
+		},
+		{url: "since=2020-01-02T03:04:05Z&email=a&name=b", wantErr: `invalid TIMESTAMP value for parameter "since": "2020-01-02T03:04:05Z" is not a number of milliseconds`},
+	}
+	for _, tc := range tests {
+		values, _ := url.ParseQuery(tc.url)
+		got, err := buildQueryParams(config, values, tc.body)
+		if errString(err) != tc.wantErr || !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("buildQueryParams(%s, %v) = %v, %q, want %v, %q", tc.url, tc.body, got, errString(err), tc.want, tc.wantErr)
+		}
+	}
+
+	for _, param := range []Parameter{
+		{Type: bigquery.StringFieldType, Transform: "uppercase"},
+		{Type: bigquery.IntegerFieldType, Transform: "epoch_ms_to_timestamp"},
+	} {
+		if _, err := prepareParameter("p", param); err == nil {
+			t.Errorf("prepareParameter(%+v) succeeded, want an error", param)
+		}
+	}
+}
+
+func TestQueryHandlerStrictParams(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	defer func(v bool) { *strictParams = v }(*strictParams)
+	*strictParams = true
+	lenient := false
+	serveQueries(t,
+		SQLQuery{Name: "strict", SQL: "SELECT @id AS n", Parameters: prepareParameters(t, map[string]Parameter{"id": {Type: "INTEGER"}})},
+		SQLQuery{Name: "lenient", SQL: "SELECT @id AS n", Parameters: prepareParameters(t, map[string]Parameter{"id": {Type: "INTEGER"}}), StrictParams: &lenient},
+	)
+
+	tests := []struct {
+		url      string
+		wantCode int
+		wantErr  string
+	}{
+		{"/strict?id=1", http.StatusOK, ""},
+		// Parameters interpreted by the proxy are always allowed.
+		{"/strict?id=1&format=csv&pageSize=10&pretty=true", http.StatusOK, ""},
+		{"/strict?idd=1&zz=2", http.StatusBadRequest, "unknown parameters: idd, zz"},
+		{"/lenient?id=1&idd=1", http.StatusOK, ""},
+	}
+	for _, tc := range tests {
+		runs := fake.queryRuns()
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, tc.url, nil))
+		if w.Code != tc.wantCode || !strings.Contains(w.Body.String(), tc.wantErr) {
+			t.Errorf("%s: response = %d %s, want %d %s", tc.url, w.Code, w.Body.String(), tc.wantCode, tc.wantErr)
+		}
+		if tc.wantCode != http.StatusOK && fake.queryRuns() != runs {
+			t.Errorf("%s: ran the query, want it rejected first", tc.url)
+		}
+	}
+}
+
+func TestQueryHandlerStructParam(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{
+		Name: "people",
+		SQL:  "SELECT COUNT(*) AS n FROM people WHERE name = @filter.name AND age >= @filter.age",
+		Parameters: map[string]Parameter{"filter": {Type: "RECORD", Required: true, Fields: map[string]Parameter{
+			"name": {Type: "STRING", Required: true},
+			"age":  {Type: "INTEGER"},
+		}}},
+	})
+
+	tests := []struct {
+		body       string
+		wantCode   int
+		wantParams string
+		wantErr    string
+	}{
+		{`{"filter": {"name": "Ann", "age": 30}}`, http.StatusOK,
+			`[{"name":"filter","parameterType":{"structTypes":[{"name":"age","type":{"type":"INT64"}},{"name":"name","type":{"type":"STRING"}}],"type":"STRUCT"},"parameterValue":{"structValues":{"age":{"value":"30"},"name":{"value":"Ann"}}}}]`, ""},
+		{`{"filter": {"name": "Ann"}}`, http.StatusOK,
+			`[{"name":"filter","parameterType":{"structTypes":[{"name":"age","type":{"type":"INT64"}},{"name":"name","type":{"type":"STRING"}}],"type":"STRUCT"},"parameterValue":{"structValues":{"age":{"value":null},"name":{"value":"Ann"}}}}]`, ""},
+		{`{"filter": {"age": 30}}`, http.StatusBadRequest, "", `missing required field \"name\"`},
+		{`{"filter": {"name": "Ann", "height": 2}}`, http.StatusBadRequest, "", `unknown fields: height`},
+		{`{"filter": {"name": "Ann", "age": "old"}}`, http.StatusBadRequest, "", `invalid INTEGER value for field \"age\"`},
+		{`{"filter": "Ann"}`, http.StatusBadRequest, "", "expected a JSON object"},
+	}
+	for _, tc := range tests {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodPost, "/people", strings.NewReader(tc.body)))
+		if w.Code != tc.wantCode || !strings.Contains(w.Body.String(), tc.wantErr) {
+			t.Errorf("%s: response = %d %s, want %d %s", tc.body, w.Code, w.Body.String(), tc.wantCode, tc.wantErr)
+			continue
+		}
+		if tc.wantCode != http.StatusOK {
+			continue
+		}
+		if params, _ := json.Marshal(fake.lastRequest()["queryParameters"]); string(params) != tc.wantParams {
+			t.Errorf("%s: queryParameters = %s, want %s", tc.body, params, tc.wantParams)
+		}
+	}
+}
+
+// gzipped returns s compressed with gzip.
+func gzipped(t *testing.T, s string) *bytes.Buffer {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write([]byte(s)); err != nil {
+		t.Fatalf("compressing body: %v", err)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("compressing body: %v", err)
+	}
+	return &buf
+}
+
+func TestQueryHandlerGzipBody(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{
+		Name:       "users",
+		SQL:        "SELECT COUNT(*) AS n FROM users WHERE id IN UNNEST(@ids)",
+		Parameters: map[string]Parameter{"ids": {Type: "INTEGER", Repeated: true, Required: true}},
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/users", gzipped(t, `{"ids": [1, 2, 3]}`))
+	r.Header.Set("Content-Encoding", "gzip")
+	w := httptest.NewRecorder()
+	queryHandler(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("gzip body: response = %d %s, want 200", w.Code, w.Body.String())
+	}
+	want := `[{"name":"ids","parameterType":{"arrayType":{"type":"INT64"},"type":"ARRAY"},"parameterValue":{"arrayValues":[{"value":"1"},{"value":"2"},{"value":"3"}]}}]`
+	if params, _ := json.Marshal(fake.lastRequest()["queryParameters"]); string(params) != want {
+		t.Errorf("gzip body: queryParameters = %s, want %s", params, want)
+	}
+
+	tests := []struct {
+		encoding string
+		body     string
+		wantErr  string
+	}{
+		{"gzip", `{"ids": [1]}`, "invalid gzip body"},
+		{"br", `{"ids": [1]}`, `unsupported Content-Encoding \"br\"`},
+	}
+	runs := fake.queryRuns()
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodPost, "/users", strings.NewReader(tc.body))
+		r.Header.Set("Content-Encoding", tc.encoding)
+		w := httptest.NewRecorder()
+		queryHandler(w, r)
+		if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), tc.wantErr) {
+			t.Errorf("Content-Encoding %s: response = %d %s, want 400 %s", tc.encoding, w.Code, w.Body.String(), tc.wantErr)
+		}
+	}
+	if got := fake.queryRuns(); got != runs {
+		t.Errorf("rejected bodies ran %d queries, want none", got-runs)
+	}
+}
+
+func TestQueryHandlerRepeatedTimestamp(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{
+		Name:       "events",
+		SQL:        "SELECT COUNT(*) AS n FROM events WHERE at IN UNNEST(@at)",
+		Parameters: map[string]Parameter{"at": {Type: "TIMESTAMP", Repeated: true, Required: true}},
+	})
+
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/events?at=2020-01-02T03:04:05Z&at=2020-01-02T03:04:05.5%2B01:00&at=2021-06-30T23:59:59-07:00", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	want := `[{"name":"at","parameterType":{"arrayType":{"type":"TIMESTAMP"},"type":"ARRAY"},"parameterValue":{"arrayValues":[` +
+		`{"value":"2020-01-02 03:04:05+00:00"},{"value":"2020-01-02 03:04:05.5+01:00"},{"value":"2021-06-30 23:59:59-07:00"}]}}]`
+	if params, _ := json.Marshal(fake.lastRequest()["queryParameters"]); string(params) != want {
+		t.Errorf("queryParameters = %s, want %s", params, want)
+	}
+
+	runs := fake.queryRuns()
+	w = httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/events?at=2020-01-02T03:04:05Z&at=yesterday&at=2021-06-30T23:59:59Z", nil))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), `\"yesterday\" is not an RFC 3339 timestamp`) {
+		t.Errorf("invalid element: response = %d %s, want 400 naming the value", w.Code, w.Body.String())
+	}
+	if got := fake.queryRuns(); got != runs {
+		t.Errorf("invalid element ran %d queries, want none", got-runs)
+	}
+}
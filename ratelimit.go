@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// globalLimiter limits the rate of queries across all queries, when --rate_limit is set.
+var globalLimiter *rate.Limiter
+
+// queryLimiters holds the rate limiter for each query with a rate_limit, created on first use.
+var (
+	limitersMu    sync.Mutex
+	queryLimiters = map[string]*rate.Limiter{}
+)
+
+// newLimiter returns a token bucket limiter allowing limit requests per second,
+// with a burst of at least one request.
+func newLimiter(limit float64, burst int) *rate.Limiter {
+	if burst < 1 {
+		burst = int(math.Max(1, math.Ceil(limit)))
+	}
+	return rate.NewLimiter(rate.Limit(limit), burst)
+}
+
+// queryLimiter returns the limiter for query, or nil if it has no rate limit.
+func queryLimiter(query SQLQuery) *rate.Limiter {
+	if query.RateLimit <= 0 {
+		return nil
+	}
+
+	limitersMu.Lock()
+	defer limitersMu.Unlock()
+
+	lim, ok := queryLimiters[query.Name]
+	// Replace the limiter if the query's limits changed when queries were reloaded.
+	if !ok || lim.Limit() != rate.Limit(query.RateLimit) || (query.RateBurst > 0 && lim.Burst() != query.RateBurst) {
+		lim = newLimiter(query.RateLimit, query.RateBurst)
+		queryLimiters[query.Name] = lim
+	}
+	return lim
+}
+
+// checkRateLimits takes a token from the global and per-query limiters.
+// If either is exhausted, no tokens are taken and it returns how long to wait before retrying.
+func checkRateLimits(query SQLQuery) (time.Duration, bool) {
+	now := time.Now()
+	reservations := []*rate.Reservation{}
+	for _, lim := range []*rate.Limiter{globalLimiter, queryLimiter(query)} {
+		if lim == nil {
+			continue
+		}
+		res := lim.ReserveN(now, 1)
+		if delay := res.DelayFrom(now); delay > 0 {
+			res.CancelAt(now)
+			for _, taken := range reservations {
+				taken.CancelAt(now)
+			}
+			return delay, false
+		}
+		reservations = append(reservations, res)
+	}
+	return 0, true
+}
+
+// querySlots limits the number of queries running at once, when --max_concurrency is set.
+var querySlots chan struct{}
+
+// acquireSlot waits up to --concurrency_wait for a query slot to become free.
+// If one does, it returns a function to release the slot once the query is done.
+func acquireSlot(ctx context.Context) (func(), bool) {
+	if querySlots == nil {
+		return func() {}, true
+	}
+	release := func() { <-querySlots }
+
+	select {
+	case querySlots <- struct{}{}:
+		return release, true
+	default:
+	}
+	if *concurrencyWait <= 0 {
+		return nil, false
+	}
+
+	timer := time.NewTimer(*concurrencyWait)
+	defer timer.Stop()
+	select {
+	case querySlots <- struct{}{}:
+		return release, true
+	case <-timer.C:
+		return nil, false
+	case <-ctx.Done():
+		return nil, false
+	}
+}
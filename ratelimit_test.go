@@ -0,0 +1,141 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// useLimiters gives the test no rate limiters, restoring the previous ones when it ends.
+func useLimiters(tb testing.TB) {
+	limitersMu.Lock()
+	prev, prevGlobal := queryLimiters, globalLimiter
+	queryLimiters, globalLimiter = map[string]*rate.Limiter{}, nil
+	limitersMu.Unlock()
+	tb.Cleanup(func() {
+		limitersMu.Lock()
+		queryLimiters, globalLimiter = prev, prevGlobal
+		limitersMu.Unlock()
+	})
+}
+
+func TestNewLimiterBurst(t *testing.T) {
+	tests := []struct {
+		limit float64
+		burst int
+		want  int
+	}{
+		{10, 5, 5},
+		// Without a burst, one second's worth of requests is allowed, and at least one.
+		{2.5, 0, 3},
+		{0.1, 0, 1},
+	}
+	for _, tc := range tests {
+		if got := newLimiter(tc.limit, tc.burst).Burst(); got != tc.want {
+			t.Errorf("newLimiter(%v, %d) burst = %d, want %d", tc.limit, tc.burst, got, tc.want)
+		}
+	}
+}
+
+func TestCheckRateLimits(t *testing.T) {
+	useLimiters(t)
+	query := SQLQuery{Name: "limited", RateLimit: 0.001, RateBurst: 2}
+	for i := 0; i < 2; i++ {
+		if _, ok := checkRateLimits(query); !ok {
+			t.Fatalf("request %d was limited, want it allowed by the burst", i+1)
+		}
+	}
+	if retry, ok := checkRateLimits(query); ok || retry <= 0 {
+		t.Errorf("checkRateLimits() = %v, %v, want a positive retry delay", retry, ok)
+	}
+
+	// A request refused by the global limit takes no token from the query's limit.
+	globalLimiter = newLimiter(0.001, 1)
+	other := SQLQuery{Name: "other", RateLimit: 0.001, RateBurst: 1}
+	if _, ok := checkRateLimits(SQLQuery{Name: "unlimited"}); !ok {
+		t.Fatal("first request was limited, want it allowed")
+	}
+	if _, ok := checkRateLimits(other); ok {
+		t.Fatal("request over the global limit was allowed")
+	}
+	globalLimiter = nil
+	if _, ok := checkRateLimits(other); !ok {
+		t.Error("request was limited by the query's limit, want its token returned")
+	}
+}
+
+func TestQueryHandlerRateLimit(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	useLimiters(t)
+	serveQueries(t, SQLQuery{Name: "once", SQL: "SELECT 1 AS n", RateLimit: 0.001, RateBurst: 1})
+
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/once", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("first response = %d %s, want 200", w.Code, w.Body.String())
+	}
+	w = httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/once", nil))
+	if w.Code != http.StatusTooManyRequests {
+		t.Errorf("second response = %d %s, want 429", w.Code, w.Body.String())
+	}
+	if retry, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retry < 1 {
+		t.Errorf("Retry-After = %q, want a number of seconds", w.Header().Get("Retry-After"))
+	}
+	if got := fake.queryRuns(); got != 1 {
+		t.Errorf("queries run = %d, want 1", got)
+	}
+}
+
+func TestQueryHandlerMaxConcurrency(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{Name: "slow", SQL: "SELECT 1 AS n"})
+	defer func(slots chan struct{}, wait time.Duration) { querySlots, *concurrencyWait = slots, wait }(querySlots, *concurrencyWait)
+	querySlots = make(chan struct{}, 1)
+
+	// Hold the only slot with a query which runs until its request is cancelled.
+	fake.setDelay(time.Hour)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	first := make(chan int, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/slow", nil).WithContext(ctx))
+		first <- w.Code
+	}()
+	for fake.queryRuns() == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	for _, wait := range []time.Duration{0, 20 * time.Millisecond} {
+		*concurrencyWait = wait
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/slow", nil))
+		if w.Code != http.StatusServiceUnavailable || w.Header().Get("Retry-After") != "1" {
+			t.Errorf("--concurrency_wait=%v: response = %d, Retry-After %q, want 503 with Retry-After 1", wait, w.Code, w.Header().Get("Retry-After"))
+		}
+	}
+	if got := fake.queryRuns(); got != 1 {
+		t.Errorf("queries run = %d, want only the first", got)
+	}
+
+	// Requests waiting for a slot run once it is released.
+	*concurrencyWait = time.Minute
+	queued := make(chan int, 1)
+	go func() {
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/slow", nil))
+		queued <- w.Code
+	}()
+	fake.setDelay(0)
+	cancel()
+	<-first
+	if code := <-queued; code != http.StatusOK {
+		t.Errorf("queued request status = %d, want 200", code)
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// reloadQueries reloads the queries file and directory and swaps in the new queries.
+// If any query is invalid, the existing queries are kept.
+func reloadQueries() error {
+	loaded, err := loadConfiguredQueries()
+	if err != nil {
+		slog.Error("Error reloading queries, keeping existing queries", "error", err)
+		return err
+	}
+	if err := createClients(context.Background(), loaded); err != nil {
+		slog.Error("Error connecting to BigQuery, keeping existing queries", "error", err)
+		return err
+	}
+
+	setQueries(loaded)
+
+	// Cached results may be for queries that have since changed.
+	results.clear()
+
+	slog.Info("Reloaded queries", "count", len(loaded), "file", *queries, "dir", *queriesDir)
+	return nil
+}
+
+// reloadOnSignal reloads the queries whenever the process receives SIGHUP.
+func reloadOnSignal() {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			reloadQueries()
+		}
+	}()
+}
+
+// reloadHandler reloads the queries in response to a POST request.
+func reloadHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeError(w, http.StatusMethodNotAllowed, "method not allowed", nil)
+		return
+	}
+	if err := reloadQueries(); err != nil {
+		writeError(w, http.StatusInternalServerError, "reloading queries failed", err)
+		return
+	}
+	writeStatusOK(w)
+}
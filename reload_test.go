@@ -0,0 +1,55 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestReloadHandler(t *testing.T) {
+	serveQueries(t)
+	useResultCache(t)
+	defer func(q, dir string) { *queries, *queriesDir = q, dir }(*queries, *queriesDir)
+	*queries, *queriesDir = filepath.Join(t.TempDir(), "queries.yaml"), ""
+	writeQueries := func(yaml string) {
+		if err := ioutil.WriteFile(*queries, []byte(yaml), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	writeQueries("- name: first\n  query: SELECT 1\n")
+	results.add("stale", testEntry(1))
+	w := httptest.NewRecorder()
+	reloadHandler(w, httptest.NewRequest(http.MethodPost, "/reload", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("response = %d %s, want 200", w.Code, w.Body.String())
+	}
+	if _, ok := lookupQuery("first"); !ok {
+		t.Error("query first was not loaded")
+	}
+	if got := cachedKeys(results, "stale"); len(got) != 0 {
+		t.Error("cached results were kept after reloading")
+	}
+
+	// Invalid queries are rejected, keeping the queries already loaded.
+	writeQueries("- name: second\n  query: SELECT @id\n")
+	w = httptest.NewRecorder()
+	reloadHandler(w, httptest.NewRequest(http.MethodPost, "/reload", nil))
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("response to invalid queries = %d %s, want 500", w.Code, w.Body.String())
+	}
+	if _, ok := lookupQuery("first"); !ok {
+		t.Error("query first was dropped by a failed reload")
+	}
+	if _, ok := lookupQuery("second"); ok {
+		t.Error("invalid query second was loaded")
+	}
+
+	w = httptest.NewRecorder()
+	reloadHandler(w, httptest.NewRequest(http.MethodGet, "/reload", nil))
+	if w.Code != http.StatusMethodNotAllowed || w.Header().Get("Allow") != http.MethodPost {
+		t.Errorf("response to GET = %d, Allow %q, want 405 allowing POST", w.Code, w.Header().Get("Allow"))
+	}
+}
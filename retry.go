@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// Bounds of the exponential backoff between retries of transient BigQuery errors.
+const (
+	retryInitialBackoff = 500 * time.Millisecond
+	retryMaxBackoff     = 10 * time.Second
+)
+
+// retryableReasons are BigQuery error reasons for failures which may succeed when retried.
+var retryableReasons = []string{"backendError", "internalError", "jobBackendError", "rateLimitExceeded"}
+
+// isRetryable reports whether err is a transient BigQuery error, as opposed to one like invalid SQL.
+func isRetryable(err error) bool {
+	for _, reason := range retryableReasons {
+		if hasErrorReason(err, reason) {
+			return true
+		}
+	}
+	var apiErr *googleapi.Error
+	if errors.As(err, &apiErr) {
+		switch apiErr.Code {
+		case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+	}
+	return false
+}
+
+// withRetry calls f, retrying up to --max_retries times with exponential backoff while it fails with a transient error.
+func withRetry(ctx context.Context, f func() error) error {
+	backoff := retryInitialBackoff
+	for attempt := 0; ; attempt++ {
+		err := f()
+		if err == nil || attempt >= *maxRetries || !isRetryable(err) {
+			return err
+		}
+
+		// Jitter spreads out retries from concurrent requests.
+		wait := backoff/2 + time.Duration(rand.Int63n(int64(backoff)))
+		slog.WarnContext(ctx, "Retrying transient BigQuery error", "attempt", attempt+1, "backoff", wait, "error", err)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return err
+		}
+		if backoff *= 2; backoff > retryMaxBackoff {
+			backoff = retryMaxBackoff
+		}
+	}
+}
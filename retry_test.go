@@ -0,0 +1,95 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&googleapi.Error{Code: 500, Errors: []googleapi.ErrorItem{{Reason: "backendError"}}}, true},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "rateLimitExceeded"}}}, true},
+		{fmt.Errorf("running query: %w", &googleapi.Error{Code: 503}), true},
+		{&googleapi.Error{Code: 429}, true},
+		{&googleapi.Error{Code: 400, Errors: []googleapi.ErrorItem{{Reason: "invalidQuery"}}}, false},
+		{&googleapi.Error{Code: 403, Errors: []googleapi.ErrorItem{{Reason: "accessDenied"}}}, false},
+		{&googleapi.Error{Code: 404}, false},
+		{errors.New("backendError"), false},
+	}
+	for _, tc := range tests {
+		if got := isRetryable(tc.err); got != tc.want {
+			t.Errorf("isRetryable(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestWithRetry(t *testing.T) {
+	defer func(v int) { *maxRetries = v }(*maxRetries)
+	transient := &googleapi.Error{Code: http.StatusServiceUnavailable}
+	invalid := &googleapi.Error{Code: http.StatusBadRequest}
+
+	tests := []struct {
+		maxRetries int
+		errs       []error
+		wantCalls  int
+		wantErr    error
+	}{
+		{1, []error{nil}, 1, nil},
+		{1, []error{transient, nil}, 2, nil},
+		{1, []error{transient, transient}, 2, transient},
+		{0, []error{transient}, 1, transient},
+		{1, []error{invalid}, 1, invalid},
+	}
+	for _, tc := range tests {
+		*maxRetries = tc.maxRetries
+		calls := 0
+		err := withRetry(context.Background(), func() error {
+			calls++
+			return tc.errs[calls-1]
+		})
+		if calls != tc.wantCalls || err != tc.wantErr {
+			t.Errorf("withRetry() of %v with --max_retries=%d = %d calls, error %v, want %d calls, error %v", tc.errs, tc.maxRetries, calls, err, tc.wantCalls, tc.wantErr)
+		}
+	}
+
+	// Cancelled requests stop retrying.
+	*maxRetries = 5
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	calls := 0
+	if err := withRetry(ctx, func() error { calls++; return transient }); calls != 1 || err != transient {
+		t.Errorf("withRetry() after cancellation = %d calls, error %v, want 1 call", calls, err)
+	}
+}
+
+func TestQueryHandlerRetry(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{Name: "numbers", SQL: "SELECT 1 AS n"})
+	defer func(v int) { *maxRetries = v }(*maxRetries)
+	*maxRetries = 1
+
+	// The BigQuery client doesn't retry quota errors itself.
+	fake.fail(1, fakeError{code: http.StatusTooManyRequests, reason: "quotaExceeded", message: "Quota exceeded"})
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/numbers", nil))
+	if w.Code != http.StatusOK || fake.queryRuns() != 2 {
+		t.Errorf("response = %d %s after %d queries, want 200 after a retry", w.Code, w.Body.String(), fake.queryRuns())
+	}
+
+	// Errors which won't succeed when retried fail straight away.
+	fake.fail(1, fakeError{code: http.StatusBadRequest, reason: "invalidQuery", message: "Syntax error"})
+	w = httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/numbers", nil))
+	if w.Code != http.StatusInternalServerError || fake.queryRuns() != 3 {
+		t.Errorf("response = %d %s after %d queries, want 500 without retrying", w.Code, w.Body.String(), fake.queryRuns()-2)
+	}
+}
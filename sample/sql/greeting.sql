@@ -0,0 +1,6 @@
+-- greeting returns a greeting for each of the given names.
+-- Run the proxy with --queries_dir=sample/sql and try it with a URL like /greeting?names=ann&names=bob
+-- @param names STRING repeated
+-- @param punctuation STRING nullable
+SELECT CONCAT('Hello, ', name, IFNULL(@punctuation, '!')) AS greeting
+FROM UNNEST(@names) AS name;
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// SchemaField declares a column of the results of a query.
+type SchemaField struct {
+	Name     string             `yaml:"name" json:"name"`
+	Type     bigquery.FieldType `yaml:"type" json:"type"`
+	Repeated bool               `yaml:"repeated" json:"repeated,omitempty"`
+}
+
+// fieldTypeAliases maps standard SQL type names to the field types BigQuery reports in result schemas.
+var fieldTypeAliases = map[string]bigquery.FieldType{
+	"INT64":   bigquery.IntegerFieldType,
+	"FLOAT64": bigquery.FloatFieldType,
+	"BOOL":    bigquery.BooleanFieldType,
+	"STRUCT":  bigquery.RecordFieldType,
+}
+
+// schemaFieldTypes are the types a schema field may be declared with, once fieldTypeAliases are applied.
+var schemaFieldTypes = map[bigquery.FieldType]bool{
+	bigquery.StringFieldType:     true,
+	bigquery.BytesFieldType:      true,
+	bigquery.IntegerFieldType:    true,
+	bigquery.FloatFieldType:      true,
+	bigquery.BooleanFieldType:    true,
+	bigquery.TimestampFieldType:  true,
+	bigquery.RecordFieldType:     true,
+	bigquery.DateFieldType:       true,
+	bigquery.TimeFieldType:       true,
+	bigquery.DateTimeFieldType:   true,
+	bigquery.NumericFieldType:    true,
+	bigquery.GeographyFieldType:  true,
+	bigquery.BigNumericFieldType: true,
+	bigquery.IntervalFieldType:   true,
+	bigquery.JSONFieldType:       true,
+	bigquery.RangeFieldType:      true,
+}
+
+// prepareSchema validates the declared schema of q and normalizes its type names.
+func prepareSchema(q *SQLQuery) error {
+	seen := map[string]bool{}
+	for i, field := range q.Schema {
+		if field.Name == "" {
+			return fmt.Errorf("schema field %d has no name", i+1)
+		}
+		if seen[strings.ToLower(field.Name)] {
+			return fmt.Errorf("schema field %q is declared more than once", field.Name)
+		}
+		seen[strings.ToLower(field.Name)] = true
+
+		fieldType := strings.ToUpper(string(field.Type))
+		if alias, ok := fieldTypeAliases[fieldType]; ok {
+			fieldType = string(alias)
+		}
+		if !schemaFieldTypes[bigquery.FieldType(fieldType)] {
+			return fmt.Errorf("schema field %q has unsupported type %q", field.Name, field.Type)
+		}
+		q.Schema[i].Type = bigquery.FieldType(fieldType)
+	}
+	return nil
+}
+
+// checkSchema reports differences between the declared schema of a query and the schema of its results.
+func checkSchema(declared []SchemaField, actual bigquery.Schema) error {
+	var problems []string
+	if len(declared) != len(actual) {
+		problems = append(problems, fmt.Sprintf("declared %d fields, got %d", len(declared), len(actual)))
+	}
+	for i := 0; i < len(declared) && i < len(actual); i++ {
+		want, got := declared[i], actual[i]
+		if !strings.EqualFold(want.Name, got.Name) {
+			problems = append(problems, fmt.Sprintf("field %d is %q, declared %q", i+1, got.Name, want.Name))
+			continue
+		}
+		if want.Type != got.Type || want.Repeated != got.Repeated {
+			problems = append(problems, fmt.Sprintf("field %q is %s, declared %s", got.Name, describeType(got.Type, got.Repeated), describeType(want.Type, want.Repeated)))
+		}
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	return fmt.Errorf("results do not match the declared schema: %s", strings.Join(problems, "; "))
+}
+
+func describeType(fieldType bigquery.FieldType, repeated bool) string {
+	if repeated {
+		return "repeated " + string(fieldType)
+	}
+	return string(fieldType)
+}
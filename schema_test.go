@@ -0,0 +1,53 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestPrepareSchema(t *testing.T) {
+	tests := []struct {
+		schema  []SchemaField
+		want    []SchemaField
+		wantErr string
+	}{
+		{
+			schema: []SchemaField{{Name: "id", Type: "int64"}, {Name: "tags", Type: "STRING", Repeated: true}, {Name: "loc", Type: "Geography"}},
+			want:   []SchemaField{{Name: "id", Type: "INTEGER"}, {Name: "tags", Type: "STRING", Repeated: true}, {Name: "loc", Type: "GEOGRAPHY"}},
+		},
+		{schema: []SchemaField{{Name: "id", Type: "INTEGR"}}, wantErr: `schema field "id" has unsupported type "INTEGR"`},
+		{schema: []SchemaField{{Name: "id"}}, wantErr: `schema field "id" has unsupported type ""`},
+		{schema: []SchemaField{{Type: "STRING"}}, wantErr: "schema field 1 has no name"},
+		{schema: []SchemaField{{Name: "id", Type: "STRING"}, {Name: "ID", Type: "STRING"}}, wantErr: `schema field "ID" is declared more than once`},
+	}
+	for _, tc := range tests {
+		q := SQLQuery{Schema: tc.schema}
+		if got := errString(prepareSchema(&q)); got != tc.wantErr {
+			t.Errorf("prepareSchema(%v) error = %q, want %q", tc.schema, got, tc.wantErr)
+			continue
+		}
+		if tc.wantErr == "" && !reflect.DeepEqual(q.Schema, tc.want) {
+			t.Errorf("prepareSchema() schema = %v, want %v", q.Schema, tc.want)
+		}
+	}
+}
+
+func TestCheckSchema(t *testing.T) {
+	declared := []SchemaField{{Name: "id", Type: bigquery.IntegerFieldType}, {Name: "tags", Type: bigquery.StringFieldType, Repeated: true}}
+	if err := checkSchema(declared, bigquery.Schema{
+		{Name: "ID", Type: bigquery.IntegerFieldType},
+		{Name: "tags", Type: bigquery.StringFieldType, Repeated: true},
+	}); err != nil {
+		t.Errorf("checkSchema() of a matching schema = %v, want nil", err)
+	}
+
+	err := checkSchema(declared, bigquery.Schema{{Name: "id", Type: bigquery.StringFieldType}})
+	for _, want := range []string{"declared 2 fields, got 1", `field "id" is STRING, declared INTEGER`} {
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("checkSchema() error = %v, want it to contain %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// tlsVersions maps the values accepted by --tls_min_version to TLS versions.
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// tlsConfig returns the TLS configuration for serving HTTPS with the given certificate
+// and key files, or nil to serve plain HTTP when neither is set.
+func tlsConfig(certFile, keyFile, minVersion string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("--tls_cert and --tls_key must be set together")
+	}
+	version, ok := tlsVersions[minVersion]
+	if !ok {
+		return nil, fmt.Errorf("invalid --tls_min_version %q, must be one of 1.0, 1.1, 1.2 or 1.3", minVersion)
+	}
+	return &tls.Config{MinVersion: version}, nil
+}
+
+// newServer returns the server for the handlers registered with http.HandleFunc, on --port
+// with the timeouts and header limit set by flags. It serves HTTPS if tlsConf isn't nil.
+func newServer(tlsConf *tls.Config) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", *port),
+		TLSConfig:         tlsConf,
+		ReadTimeout:       *readTimeout,
+		ReadHeaderTimeout: *headerTimeout,
+		WriteTimeout:      *writeTimeout,
+		IdleTimeout:       *idleTimeout,
+		MaxHeaderBytes:    *maxHeaderBytes,
+	}
+}
+
+// listen returns a listener on the Unix domain socket at socketPath if it is set, or the TCP address addr otherwise.
+func listen(addr, socketPath string) (net.Listener, error) {
+	if socketPath == "" {
+		return net.Listen("tcp", addr)
+	}
+	// A socket left behind by a process which didn't shut down cleanly would make the listen fail.
+	if fi, err := os.Lstat(socketPath); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(socketPath); err != nil {
+			return nil, err
+		}
+	}
+	// The socket file is removed when the listener is closed on shutdown.
+	return net.Listen("unix", socketPath)
+}
+
+// serve runs server until it receives SIGTERM or SIGINT, then shuts it down,
+// giving in-flight requests up to --shutdown_timeout to complete.
+// It serves HTTPS when server.TLSConfig is set, using --tls_cert and --tls_key.
+func serve(server *http.Server) error {
+	ln, err := listen(server.Addr, *unixSocket)
+	if err != nil {
+		return err
+	}
+	slog.Info("Serving", "address", ln.Addr().String())
+
+	errc := make(chan error, 1)
+	go func() {
+		if server.TLSConfig != nil {
+			errc <- server.ServeTLS(ln, *tlsCert, *tlsKey)
+			return
+		}
+		errc <- server.Serve(ln)
+	}()
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	select {
+	case err := <-errc:
+		return err
+	case sig := <-stop:
+		slog.Info("Shutting down", "signal", sig.String())
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownTimeout)
+	defer cancel()
+	return server.Shutdown(ctx)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestTLSConfig(t *testing.T) {
+	tests := []struct {
+		cert, key, minVersion string
+		want                  uint16
+		wantErr               string
+	}{
+		{"", "", "1.2", 0, ""},
+		{"cert.pem", "key.pem", "1.2", tls.VersionTLS12, ""},
+		{"cert.pem", "key.pem", "1.3", tls.VersionTLS13, ""},
+		{"cert.pem", "", "1.2", 0, "--tls_cert and --tls_key must be set together"},
+		{"", "key.pem", "1.2", 0, "--tls_cert and --tls_key must be set together"},
+		{"cert.pem", "key.pem", "1.4", 0, `invalid --tls_min_version "1.4", must be one of 1.0, 1.1, 1.2 or 1.3`},
+	}
+	for _, tc := range tests {
+		conf, err := tlsConfig(tc.cert, tc.key, tc.minVersion)
+		if got := errString(err); got != tc.wantErr {
+			t.Errorf("tlsConfig(%q, %q, %q) error = %q, want %q", tc.cert, tc.key, tc.minVersion, got, tc.wantErr)
+			continue
+		}
+		var got uint16
+		if conf != nil {
+			got = conf.MinVersion
+		}
+		if got != tc.want {
+			t.Errorf("tlsConfig(%q, %q, %q) MinVersion = %x, want %x", tc.cert, tc.key, tc.minVersion, got, tc.want)
+		}
+	}
+}
+
+// writeCertificate writes a self-signed certificate for localhost and its key to dir,
+// returning their paths and a pool trusting the certificate.
+func writeCertificate(t *testing.T, dir string) (certFile, keyFile string, pool *x509.CertPool) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		DNSNames:     []string{"localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool = x509.NewCertPool()
+	pool.AddCert(cert)
+	return certFile, keyFile, pool
+}
+
+func TestServeTLS(t *testing.T) {
+	dir := t.TempDir()
+	defer func(cert, key, path string) { *tlsCert, *tlsKey, *unixSocket = cert, key, path }(*tlsCert, *tlsKey, *unixSocket)
+	var pool *x509.CertPool
+	*tlsCert, *tlsKey, pool = writeCertificate(t, dir)
+	*unixSocket = filepath.Join(dir, "bqproxy.sock")
+	// The test receives SIGTERM too, so it isn't killed if serve hasn't registered for it yet.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	conf, err := tlsConfig(*tlsCert, *tlsKey, "1.3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newServer(conf)
+	server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(tls.VersionName(r.TLS.Version)))
+	})
+	served := make(chan error, 1)
+	go func() { served <- serve(server) }()
+
+	// client returns a client trusting the certificate, using at most TLS maxVersion.
+	client := func(maxVersion uint16) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{RootCAs: pool, MaxVersion: maxVersion},
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				for {
+					conn, err := d.DialContext(ctx, "unix", *unixSocket)
+					if err == nil || ctx.Err() != nil {
+						return conn, err
+					}
+					time.Sleep(10 * time.Millisecond)
+				}
+			},
+		}}
+	}
+
+	resp, err := client(tls.VersionTLS13).Get("https://localhost/")
+	if err != nil {
+		t.Fatalf("GET over TLS error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "TLS 1.3" {
+		t.Errorf("body = %q, want TLS 1.3", body)
+	}
+
+	// Clients which can't meet the minimum version are refused.
+	if resp, err := client(tls.VersionTLS12).Get("https://localhost/"); err == nil {
+		resp.Body.Close()
+		t.Error("GET over TLS 1.2 succeeded, want it refused by --tls_min_version 1.3")
+	}
+
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	if err := <-served; err != nil {
+		t.Errorf("serve() = %v, want nil after shutting down", err)
+	}
+}
+
+func TestNewServer(t *testing.T) {
+	s := newServer(nil)
+	if s.Addr != ":8080" || s.TLSConfig != nil || s.Handler != nil {
+		t.Errorf("newServer(nil) = address %q, TLS %v, handler %v, want :8080 without TLS on the default mux", s.Addr, s.TLSConfig, s.Handler)
+	}
+	// Each timeout has a default, so slow clients can't hold connections open indefinitely.
+	if s.ReadTimeout != time.Minute || s.ReadHeaderTimeout != 10*time.Second || s.WriteTimeout != 10*time.Minute || s.IdleTimeout != 2*time.Minute {
+		t.Errorf("default timeouts = read %v, header %v, write %v, idle %v, want 1m, 10s, 10m and 2m", s.ReadTimeout, s.ReadHeaderTimeout, s.WriteTimeout, s.IdleTimeout)
+	}
+	if s.MaxHeaderBytes != http.DefaultMaxHeaderBytes {
+		t.Errorf("default MaxHeaderBytes = %d, want %d", s.MaxHeaderBytes, http.DefaultMaxHeaderBytes)
+	}
+
+	defer func(p int, read, header, write, idle time.Duration, max int) {
+		*port, *readTimeout, *headerTimeout, *writeTimeout, *idleTimeout, *maxHeaderBytes = p, read, header, write, idle, max
+	}(*port, *readTimeout, *headerTimeout, *writeTimeout, *idleTimeout, *maxHeaderBytes)
+	*port, *readTimeout, *headerTimeout, *writeTimeout, *idleTimeout, *maxHeaderBytes = 9090, time.Second, 2*time.Second, 3*time.Second, 4*time.Second, 5000
+
+	conf := &tls.Config{MinVersion: tls.VersionTLS12}
+	s = newServer(conf)
+	if s.Addr != ":9090" || s.TLSConfig != conf {
+		t.Errorf("newServer() = address %q, TLS %v, want :9090 with the TLS configuration", s.Addr, s.TLSConfig)
+	}
+	if s.ReadTimeout != time.Second || s.ReadHeaderTimeout != 2*time.Second || s.WriteTimeout != 3*time.Second || s.IdleTimeout != 4*time.Second || s.MaxHeaderBytes != 5000 {
+		t.Errorf("newServer() = read %v, header %v, write %v, idle %v, max header bytes %d, want the flag values", s.ReadTimeout, s.ReadHeaderTimeout, s.WriteTimeout, s.IdleTimeout, s.MaxHeaderBytes)
+	}
+}
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bqproxy.sock")
+
+	// Leave a socket file behind, as a process killed without shutting down would.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("net.Listen() error: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen(":0", path)
+	if err != nil {
+		t.Fatalf("listen() with a stale socket error: %v", err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	})}
+	go server.Serve(ln)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	resp, err := client.Get("http://bqproxy/")
+	if err != nil {
+		t.Fatalf("GET over the socket error: %v", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "hello" {
+		t.Errorf("body = %q, want hello", body)
+	}
+
+	server.Close()
+	if _, err := os.Lstat(path); !os.IsNotExist(err) {
+		t.Errorf("socket file after shutdown: %v, want it removed", err)
+	}
+}
+
+func TestListenUnixSocketKeepsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queries.yaml")
+	if err := ioutil.WriteFile(path, []byte("queries"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := listen(":0", path); err == nil {
+		ln.Close()
+		t.Fatal("listen() on a regular file succeeded, want an error")
+	}
+	if b, err := ioutil.ReadFile(path); err != nil || string(b) != "queries" {
+		t.Errorf("file after listen() = %q, %v, want it untouched", b, err)
+	}
+}
+
+func TestServeGracefulShutdown(t *testing.T) {
+	defer func(path string) { *unixSocket = path }(*unixSocket)
+	*unixSocket = filepath.Join(t.TempDir(), "bqproxy.sock")
+	// The test receives SIGTERM too, so it isn't killed if serve hasn't registered for it yet.
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGTERM)
+	defer signal.Stop(sigs)
+
+	started, release := make(chan struct{}), make(chan struct{})
+	server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-release
+		w.Write([]byte("done"))
+	})}
+	served := make(chan error, 1)
+	go func() { served <- serve(server) }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			for {
+				conn, err := d.DialContext(ctx, "unix", *unixSocket)
+				if err == nil || ctx.Err() != nil {
+					return conn, err
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		},
+	}}
+	type response struct {
+		body string
+		err  error
+	}
+	responses := make(chan response, 1)
+	go func() {
+		resp, err := client.Get("http://bqproxy/")
+		if err != nil {
+			responses <- response{err: err}
+			return
+		}
+		defer resp.Body.Close()
+		body, err := ioutil.ReadAll(resp.Body)
+		responses <- response{string(body), err}
+	}()
+
+	<-started
+	syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	// The in-flight request holds up the shutdown until it completes.
+	select {
+	case err := <-served:
+		t.Fatalf("serve() returned %v while a request was in flight", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+
+	if resp := <-responses; resp.err != nil || resp.body != "done" {
+		t.Errorf("in-flight request = %q, %v, want it completed", resp.body, resp.err)
+	}
+	if err := <-served; err != nil {
+		t.Errorf("serve() = %v, want nil after a graceful shutdown", err)
+	}
+}
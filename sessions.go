@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+// sessionHeader carries the ID of a BigQuery session. It is returned when a query starts a session,
+// and sent by clients to run later queries in the same session.
+const sessionHeader = "X-BigQuery-Session-ID"
+
+// sessionIDPattern matches the URL-safe base64 session IDs BigQuery assigns.
+var sessionIDPattern = regexp.MustCompile(`^[A-Za-z0-9_=-]{1,1000}$`)
+
+// errSessionExpired is returned for requests whose session has expired or never existed.
+var errSessionExpired = errors.New("session expired or not found")
+
+// requestSession returns the ID of the session r asks to run in, if any.
+func requestSession(r *http.Request) (string, error) {
+	session := r.Header.Get(sessionHeader)
+	if session != "" && !sessionIDPattern.MatchString(session) {
+		return "", fmt.Errorf("invalid %s header", sessionHeader)
+	}
+	return session, nil
+}
+
+// setSession makes q run in the session, or start a new one if session is empty.
+func setSession(q *bigquery.Query, session string) {
+	if session == "" {
+		q.CreateSession = true
+		return
+	}
+	q.ConnectionProperties = append(q.ConnectionProperties, &bigquery.ConnectionProperty{
+		Key:   "session_id",
+		Value: session,
+	})
+}
+
+// useJobsInsert makes q run with jobs.insert if it has connection properties, such as a session_id,
+// as the client's faster jobs.query path silently drops them. Setting a job ID is what selects jobs.insert.
+func useJobsInsert(q *bigquery.Query) {
+	if len(q.ConnectionProperties) > 0 {
+		q.JobIDConfig = bigquery.JobIDConfig{JobID: "bqproxy", AddJobIDSuffix: true}
+	}
+}
+
+// connectionPropertyKeys are the connection properties queries can set.
+// The session_id property is set by requests to session queries instead.
+var connectionPropertyKeys = map[string]bool{
+	"dataset_project_id": true,
+	"query_label":        true,
+	"service_account":    true,
+	"time_zone":          true,
+}
+
+// checkConnectionProperties reports connection properties which are unknown or have no value.
+func checkConnectionProperties(props map[string]string) error {
+	for key, value := range props {
+		if key == "session_id" {
+			return errors.New("connection property session_id cannot be set, use session instead")
+		}
+		if !connectionPropertyKeys[key] {
+			return fmt.Errorf("unknown connection property %q, must be dataset_project_id, query_label, service_account or time_zone", key)
+		}
+		if value == "" {
+			return fmt.Errorf("connection property %q has no value", key)
+		}
+	}
+	return nil
+}
+
+// connectionProperties converts a query's connection properties for a bigquery.Query, sorted by key.
+func connectionProperties(props map[string]string) []*bigquery.ConnectionProperty {
+	keys := make([]string, 0, len(props))
+	for key := range props {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var result []*bigquery.ConnectionProperty
+	for _, key := range keys {
+		result = append(result, &bigquery.ConnectionProperty{Key: key, Value: props[key]})
+	}
+	return result
+}
+
+// sessionErrorPattern matches the messages BigQuery rejects an unknown, expired or terminated session with,
+// like "Session abc has expired" and "Session not found: abc".
+var sessionErrorPattern = regexp.MustCompile(`(?i)^session\b.*\b(has expired|not found|was terminated|has been terminated)\b|^cannot find session\b`)
+
+// isSessionError reports whether err is BigQuery rejecting the session a query was run in,
+// which happens once the session has expired or been terminated.
+func isSessionError(err error) bool {
+	var apiErr *googleapi.Error
+	if !errors.As(err, &apiErr) || (apiErr.Code != http.StatusBadRequest && apiErr.Code != http.StatusNotFound) {
+		return false
+	}
+	if sessionErrorPattern.MatchString(apiErr.Message) {
+		return true
+	}
+	for _, e := range apiErr.Errors {
+		if sessionErrorPattern.MatchString(e.Message) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+	"google.golang.org/api/googleapi"
+)
+
+func TestIsSessionError(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{&googleapi.Error{Code: 400, Message: "Session abc has expired"}, true},
+		{&googleapi.Error{Code: 404, Message: "Session not found: abc"}, true},
+		{&googleapi.Error{Code: 400, Message: "Session abc was terminated"}, true},
+		{&googleapi.Error{Code: 400, Message: "Cannot find session abc"}, true},
+		{&googleapi.Error{Code: 400, Errors: []googleapi.ErrorItem{{Reason: "invalidQuery", Message: "Session abc has expired."}}}, true},
+		{fmt.Errorf("running query: %w", &googleapi.Error{Code: 400, Message: "session abc has expired"}), true},
+		{&googleapi.Error{Code: 400, Message: "Unrecognized name: session_start at [1:8]"}, false},
+		{&googleapi.Error{Code: 400, Message: "Syntax error: Unexpected keyword SESSION"}, false},
+		{&googleapi.Error{Code: 403, Message: "Access Denied: session abc has expired"}, false},
+		{&googleapi.Error{Code: 500, Message: "Session abc has expired"}, false},
+		{errors.New("Session abc has expired"), false},
+		{nil, false},
+	}
+	for _, tc := range tests {
+		if got := isSessionError(tc.err); got != tc.want {
+			t.Errorf("isSessionError(%v) = %v, want %v", tc.err, got, tc.want)
+		}
+	}
+}
+
+func TestRequestSession(t *testing.T) {
+	tests := []struct {
+		header  string
+		want    string
+		wantErr bool
+	}{
+		{"", "", false},
+		{"CgwKCmJpZ3F1ZXJ5LTESJDY1", "CgwKCmJpZ3F1ZXJ5LTESJDY1", false},
+		{"abc_-=", "abc_-=", false},
+		{"abc/def", "", true},
+		{"abc def", "", true},
+		{strings.Repeat("a", 1001), "", true},
+	}
+	for _, tc := range tests {
+		r := httptest.NewRequest(http.MethodGet, "/", nil)
+		r.Header.Set(sessionHeader, tc.header)
+		got, err := requestSession(r)
+		if (err != nil) != tc.wantErr || got != tc.want {
+			t.Errorf("requestSession(%q) = %q, %v, want %q and error %v", tc.header, got, err, tc.want, tc.wantErr)
+		}
+	}
+}
+
+func TestSetSession(t *testing.T) {
+	q := &bigquery.Query{}
+	setSession(q, "")
+	if !q.CreateSession || len(q.ConnectionProperties) != 0 {
+		t.Errorf("setSession(\"\") = CreateSession %v, properties %v, want a new session", q.CreateSession, q.ConnectionProperties)
+	}
+
+	q = &bigquery.Query{}
+	setSession(q, "abc")
+	if q.CreateSession || len(q.ConnectionProperties) != 1 || q.ConnectionProperties[0].Key != "session_id" || q.ConnectionProperties[0].Value != "abc" {
+		t.Errorf("setSession(abc) = CreateSession %v, properties %v, want session_id abc", q.CreateSession, q.ConnectionProperties)
+	}
+}
+
+func TestQueryHandlerSession(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{Name: "temp", SQL: "SELECT COUNT(*) AS n FROM _SESSION.temp", Session: true})
+
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/temp", nil))
+	if req := fake.lastRequest(); w.Code != http.StatusOK || req["createSession"] != true || req["connectionProperties"] != nil {
+		t.Errorf("without a session: response = %d, request = %v, want 200 creating a session", w.Code, req)
+	}
+
+	r := httptest.NewRequest(http.MethodGet, "/temp", nil)
+	r.Header.Set(sessionHeader, "abc")
+	w = httptest.NewRecorder()
+	queryHandler(w, r)
+	want := `[{"key":"session_id","value":"abc"}]`
+	if got, _ := json.Marshal(fake.lastRequest()["connectionProperties"]); w.Code != http.StatusOK || string(got) != want {
+		t.Errorf("in session abc: response = %d, connectionProperties = %s, want 200 and %s", w.Code, got, want)
+	}
+
+	fake.fail(1, fakeError{code: http.StatusBadRequest, reason: "invalidQuery", message: "Session abc has expired"})
+	w = httptest.NewRecorder()
+	queryHandler(w, r)
+	if w.Code != http.StatusGone || !strings.Contains(w.Body.String(), errSessionExpired.Error()) {
+		t.Errorf("in expired session abc: response = %d %s, want 410 %s", w.Code, w.Body.String(), errSessionExpired)
+	}
+}
+
+func TestQueryHandlerConnectionProperties(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	serveQueries(t, SQLQuery{
+		Name:                 "local",
+		SQL:                  "SELECT EXTRACT(HOUR FROM CURRENT_DATETIME()) AS n",
+		ConnectionProperties: map[string]string{"time_zone": "America/New_York", "query_label": "team:data"},
+	})
+
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/local", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200: %s", w.Code, w.Body.String())
+	}
+	want := `[{"key":"query_label","value":"team:data"},{"key":"time_zone","value":"America/New_York"}]`
+	if got, _ := json.Marshal(fake.lastRequest()["connectionProperties"]); string(got) != want {
+		t.Errorf("connectionProperties = %s, want %s", got, want)
+	}
+
+	for _, props := range []map[string]string{
+		{"timezone": "UTC"},
+		{"time_zone": ""},
+		{"session_id": "abc"},
+	} {
+		q := SQLQuery{Name: "bad", SQL: "SELECT 1", ConnectionProperties: props}
+		if err := prepareQuery(&q); err == nil {
+			t.Errorf("prepareQuery() with connection properties %v succeeded, want an error", props)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// sqlParameters returns the names of the @named parameters referenced by sql.
+// String literals, quoted identifiers, comments and @@system variables are skipped.
+func sqlParameters(sql string) map[string]bool {
+	params := map[string]bool{}
+	for i := 0; i < len(sql); i++ {
+		switch c := sql[i]; {
+		case c == '#' || strings.HasPrefix(sql[i:], "--"):
+			i = skipPast(sql, i, "\n")
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skipPast(sql, i+2, "*/")
+		case c == '\'' || c == '"' || c == '`':
+			i = skipQuoted(sql, i)
+		case strings.HasPrefix(sql[i:], "@@"):
+			i = skipIdentifier(sql, i+2) - 1
+		case c == '@':
+			end := skipIdentifier(sql, i+1)
+			if end > i+1 {
+				params[sql[i+1:end]] = true
+			}
+			i = end - 1
+		}
+	}
+	return params
+}
+
+// skipPast returns the index of the last byte of the first occurrence of
+// terminator at or after start, or the end of sql if there is none.
+func skipPast(sql string, start int, terminator string) int {
+	end := strings.Index(sql[start:], terminator)
+	if end < 0 {
+		return len(sql)
+	}
+	return start + end + len(terminator) - 1
+}
+
+// skipQuoted returns the index of the closing quote of the string literal or
+// quoted identifier starting at start, including triple-quoted strings.
+func skipQuoted(sql string, start int) int {
+	quote := sql[start : start+1]
+	if triple := strings.Repeat(quote, 3); strings.HasPrefix(sql[start:], triple) {
+		return skipPast(sql, start+3, triple)
+	}
+	for i := start + 1; i < len(sql); i++ {
+		switch sql[i] {
+		case '\\':
+			i++
+		case quote[0]:
+			return i
+		}
+	}
+	return len(sql)
+}
+
+// skipIdentifier returns the index just past the identifier starting at start.
+func skipIdentifier(sql string, start int) int {
+	i := start
+	for i < len(sql) && isIdentifierByte(sql[i], i == start) {
+		i++
+	}
+	return i
+}
+
+func isIdentifierByte(c byte, first bool) bool {
+	switch {
+	case c == '_', 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z':
+		return true
+	case '0' <= c && c <= '9':
+		return !first
+	}
+	return false
+}
+
+// checkParameters reports parameters referenced by the SQL of q but not declared, and vice versa.
+func checkParameters(q *SQLQuery) error {
+	used := sqlParameters(q.SQL)
+
+	var undeclared, unused []string
+	for name := range used {
+		if _, ok := q.Parameters[name]; !ok {
+			undeclared = append(undeclared, name)
+		}
+	}
+	for name := range q.Parameters {
+		if !used[name] {
+			unused = append(unused, name)
+		}
+	}
+	if len(undeclared) == 0 && len(unused) == 0 {
+		return nil
+	}
+
+	sort.Strings(undeclared)
+	sort.Strings(unused)
+	var problems []string
+	if len(undeclared) > 0 {
+		problems = append(problems, "undeclared parameters: "+strings.Join(undeclared, ", "))
+	}
+	if len(unused) > 0 {
+		problems = append(problems, "parameters not used in SQL: "+strings.Join(unused, ", "))
+	}
+	return errors.New(strings.Join(problems, "; "))
+}
+
+// statementKeywords returns the first keyword of each statement in sql, in upper case.
+// Comments, string literals and opening parentheses are skipped.
+func statementKeywords(sql string) []string {
+	var keywords []string
+	expectKeyword := true
+	for i := 0; i < len(sql); i++ {
+		switch c := sql[i]; {
+		case c == '#' || strings.HasPrefix(sql[i:], "--"):
+			i = skipPast(sql, i, "\n")
+		case strings.HasPrefix(sql[i:], "/*"):
+			i = skipPast(sql, i+2, "*/")
+		case c == '\'' || c == '"' || c == '`':
+			i = skipQuoted(sql, i)
+			expectKeyword = false
+		case c == ';':
+			expectKeyword = true
+		case c == '(' || c == ' ' || c == '\t' || c == '\n' || c == '\r':
+		case expectKeyword:
+			end := skipIdentifier(sql, i)
+			if end == i {
+				end = i + 1
+			}
+			keywords = append(keywords, strings.ToUpper(sql[i:end]))
+			expectKeyword = false
+			i = end - 1
+		}
+	}
+	return keywords
+}
+
+// checkReadOnly reports SQL with statements other than queries, such as INSERT or DROP TABLE.
+func checkReadOnly(sql string) error {
+	for _, keyword := range statementKeywords(sql) {
+		if keyword != "SELECT" && keyword != "WITH" {
+			return fmt.Errorf("%s statements modify data and require allow_mutation", keyword)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSQLParameters(t *testing.T) {
+	tests := []struct {
+		sql  string
+		want []string
+	}{
+		{"SELECT 1", nil},
+		{"SELECT @id", []string{"id"}},
+		{"SELECT * FROM t WHERE a = @a AND b IN UNNEST(@b_list) AND c = @a", []string{"a", "b_list"}},
+		{"SELECT @x1, @_y", []string{"_y", "x1"}},
+		{"SELECT '@quoted', \"@double\", `@ident`, @real", []string{"real"}},
+		{"SELECT 'it\\'s @escaped', @real", []string{"real"}},
+		{"SELECT '''@triple ' quote''', @real", []string{"real"}},
+		{"SELECT @a -- @comment\n, @b", []string{"a", "b"}},
+		{"SELECT @a # @comment\n, @b", []string{"a", "b"}},
+		{"SELECT /* @block\n @comment */ @a", []string{"a"}},
+		{"SELECT @@session.time_zone, @@dataset_id, @a", []string{"a"}},
+		{"SELECT @", nil},
+		{"SELECT @1", nil},
+	}
+	for _, tc := range tests {
+		want := map[string]bool{}
+		for _, name := range tc.want {
+			want[name] = true
+		}
+		if got := sqlParameters(tc.sql); !reflect.DeepEqual(got, want) {
+			t.Errorf("sqlParameters(%q) = %v, want %v", tc.sql, got, want)
+		}
+	}
+}
+
+func TestCheckParameters(t *testing.T) {
+	tests := []struct {
+		sql     string
+		params  []string
+		wantErr string
+	}{
+		{"SELECT @a, @b", []string{"a", "b"}, ""},
+		{"SELECT 1", nil, ""},
+		{"SELECT @a, @c, @b", []string{"a"}, "undeclared parameters: b, c"},
+		{"SELECT @a", []string{"a", "z", "y"}, "parameters not used in SQL: y, z"},
+		{"SELECT @b", []string{"a"}, "undeclared parameters: b; parameters not used in SQL: a"},
+	}
+	for _, tc := range tests {
+		q := &SQLQuery{SQL: tc.sql, Parameters: map[string]Parameter{}}
+		for _, name := range tc.params {
+			q.Parameters[name] = Parameter{}
+		}
+		err := checkParameters(q)
+		if got := errString(err); got != tc.wantErr {
+			t.Errorf("checkParameters(%q, %v) = %q, want %q", tc.sql, tc.params, got, tc.wantErr)
+		}
+	}
+}
+
+func TestCheckReadOnly(t *testing.T) {
+	tests := []struct {
+		sql     string
+		wantErr string
+	}{
+		{"SELECT 1", ""},
+		{"select 1", ""},
+		{"WITH t AS (SELECT 1) SELECT * FROM t", ""},
+		{"(SELECT 1) UNION ALL (SELECT 2)", ""},
+		{"-- INSERT is only mentioned\nSELECT 'DELETE'", ""},
+		{"/* DROP TABLE t; */ SELECT 1;", ""},
+		{"SELECT 1; SELECT 2", ""},
+		{"INSERT INTO t VALUES (1)", "INSERT statements modify data and require allow_mutation"},
+		{"SELECT 1; DROP TABLE t", "DROP statements modify data and require allow_mutation"},
+		{"  delete FROM t WHERE true", "DELETE statements modify data and require allow_mutation"},
+		{"CREATE TEMP TABLE t AS SELECT 1", "CREATE statements modify data and require allow_mutation"},
+		{"DECLARE x INT64; SELECT x", "DECLARE statements modify data and require allow_mutation"},
+	}
+	for _, tc := range tests {
+		if got := errString(checkReadOnly(tc.sql)); got != tc.wantErr {
+			t.Errorf("checkReadOnly(%q) = %q, want %q", tc.sql, got, tc.wantErr)
+		}
+	}
+}
+
+// errString returns the message of err, or "" for a nil error.
+func errString(err error) string {
+	if err == nil {
+		return ""
+	}
+	return err.Error()
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// loadConfiguredQueries loads the queries from each of the comma-separated --queries files
+// and the .sql files in --queries_dir. Query names must be unique across all of them.
+func loadConfiguredQueries() (map[string]SQLQuery, error) {
+	var sources []string
+	for _, path := range strings.Split(*queries, ",") {
+		if path = strings.TrimSpace(path); path != "" {
+			sources = append(sources, path)
+		}
+	}
+	if *queriesDir != "" {
+		sources = append(sources, *queriesDir)
+	}
+
+	result := map[string]SQLQuery{}
+	sourceOf := map[string]string{}
+	for i, source := range sources {
+		var loaded map[string]SQLQuery
+		var err error
+		if *queriesDir != "" && i == len(sources)-1 {
+			// Errors already name the .sql file.
+			loaded, err = loadQueryFiles(source)
+		} else if loaded, err = loadQueries(source); err != nil {
+			err = fmt.Errorf("%s: %v", source, err)
+		}
+		if err != nil {
+			return nil, err
+		}
+		for name, q := range loaded {
+			if other, ok := sourceOf[name]; ok {
+				return nil, fmt.Errorf("query %q is defined in both %s and %s", name, other, source)
+			}
+			result[name] = q
+			sourceOf[name] = source
+		}
+	}
+	return result, nil
+}
+
+// loadQueryFiles loads a query from each .sql file in dir, named after the file.
+// Parameters are declared in comments at the top of the file, one per line, like:
+//
+//	-- @param id INTEGER
+//	-- @param name STRING required
+//	-- @param ids INTEGER repeated
+func loadQueryFiles(dir string) (map[string]SQLQuery, error) {
+	paths, err := filepath.Glob(filepath.Join(dir, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, len(paths))
+	for i, path := range paths {
+		names[i] = strings.TrimSuffix(filepath.Base(path), ".sql")
+	}
+	if err := checkQueryNames(names); err != nil {
+		return nil, fmt.Errorf("%s: %v", dir, err)
+	}
+
+	result := map[string]SQLQuery{}
+	for _, path := range paths {
+		dat, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		q := SQLQuery{
+			Name: strings.TrimSuffix(filepath.Base(path), ".sql"),
+			SQL:  string(dat),
+		}
+		if q.Parameters, err = parseParamComments(q.SQL); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if err := prepareQuery(&q); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		result[q.Name] = q
+	}
+	return result, nil
+}
+
+// parseParamComments parses the @param declarations in the comments leading sql.
+// Each is followed by the parameter name, its type and any of the options required, repeated and nullable.
+func parseParamComments(sql string) (map[string]Parameter, error) {
+	params := map[string]Parameter{}
+	for _, line := range strings.Split(sql, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		var comment string
+		switch {
+		case strings.HasPrefix(line, "--"):
+			comment = strings.TrimSpace(line[2:])
+		case strings.HasPrefix(line, "#"):
+			comment = strings.TrimSpace(line[1:])
+		default:
+			// The header ends at the first line of SQL.
+			return params, nil
+		}
+
+		fields := strings.Fields(comment)
+		if len(fields) == 0 || fields[0] != "@param" {
+			continue
+		}
+		if len(fields) < 3 {
+			return nil, fmt.Errorf("invalid declaration %q, want \"@param <name> <TYPE> [options]\"", comment)
+		}
+		name := fields[1]
+		if _, ok := params[name]; ok {
+			return nil, fmt.Errorf("parameter %q is declared more than once", name)
+		}
+		param := Parameter{Type: bigquery.FieldType(strings.ToUpper(fields[2]))}
+		for _, option := range fields[3:] {
+			switch option {
+			case "required":
+				param.Required = true
+			case "repeated":
+				param.Repeated = true
+			case "nullable":
+				param.Nullable = true
+			default:
+				return nil, fmt.Errorf("unknown option %q for parameter %q", option, name)
+			}
+		}
+		params[name] = param
+	}
+	return params, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestParseParamComments(t *testing.T) {
+	tests := []struct {
+		name    string
+		sql     string
+		want    map[string]Parameter
+		wantErr string
+	}{
+		{
+			name: "none",
+			sql:  "SELECT 1",
+			want: map[string]Parameter{},
+		},
+		{
+			name: "types and options",
+			sql: "-- @param id integer required\n" +
+				"# @param names STRING repeated\n" +
+				"-- a comment which is not a declaration\n" +
+				"\n" +
+				"-- @param at TIMESTAMP nullable\n" +
+				"SELECT @id, @names, @at",
+			want: map[string]Parameter{
+				"id":    {Type: "INTEGER", Required: true},
+				"names": {Type: "STRING", Repeated: true},
+				"at":    {Type: "TIMESTAMP", Nullable: true},
+			},
+		},
+		{
+			name: "declarations end at the first line of SQL",
+			sql:  "-- @param id INTEGER\nSELECT @id\n-- @param other STRING",
+			want: map[string]Parameter{"id": {Type: "INTEGER"}},
+		},
+		{
+			name:    "missing type",
+			sql:     "-- @param id\nSELECT @id",
+			wantErr: "invalid declaration",
+		},
+		{
+			name:    "duplicate",
+			sql:     "-- @param id INTEGER\n-- @param id STRING\nSELECT @id",
+			wantErr: "declared more than once",
+		},
+		{
+			name:    "unknown option",
+			sql:     "-- @param id INTEGER optional\nSELECT @id",
+			wantErr: "unknown option",
+		},
+	}
+	for _, tc := range tests {
+		got, err := parseParamComments(tc.sql)
+		if tc.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tc.wantErr) {
+				t.Errorf("%s: error = %v, want one containing %q", tc.name, err, tc.wantErr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tc.want) {
+			t.Errorf("%s: got %+v, want %+v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestLoadQueryFilesParamTypes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bqproxy")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	sql := "-- @param id INT64\nSELECT @id"
+	if err := ioutil.WriteFile(filepath.Join(dir, "byid.sql"), []byte(sql), 0644); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := loadQueryFiles(dir)
+	if err != nil {
+		t.Fatalf("loadQueryFiles() with a standard SQL type: unexpected error: %v", err)
+	}
+	if got := loaded["byid"].Parameters["id"].Type; got != bigquery.IntegerFieldType {
+		t.Errorf("parameter type = %q, want INTEGER", got)
+	}
+
+	sql = "-- @param id INTEGR\nSELECT @id"
+	if err := ioutil.WriteFile(filepath.Join(dir, "byid.sql"), []byte(sql), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := loadQueryFiles(dir); err == nil || !strings.Contains(err.Error(), `unsupported type "INTEGR"`) {
+		t.Errorf("loadQueryFiles() error = %v, want an unsupported type error", err)
+	}
+}
+
+func TestLoadConfiguredQueries(t *testing.T) {
+	defer func(files, dir string) { *queries, *queriesDir = files, dir }(*queries, *queriesDir)
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"team_a.yaml":   "- name: orders\n  query: SELECT 1\n",
+		"team_b.yaml":   "- name: users\n  query: SELECT 2\n",
+		"clash.yaml":    "- name: orders\n  query: SELECT 3\n",
+		"sql/count.sql": "SELECT 4",
+		"sql/users.sql": "SELECT 5",
+	} {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	a, b, clash := filepath.Join(dir, "team_a.yaml"), filepath.Join(dir, "team_b.yaml"), filepath.Join(dir, "clash.yaml")
+
+	*queries, *queriesDir = a+", "+b, ""
+	loaded, err := loadConfiguredQueries()
+	if err != nil {
+		t.Fatalf("loadConfiguredQueries() error: %v", err)
+	}
+	if len(loaded) != 2 || loaded["orders"].SQL != "SELECT 1" || loaded["users"].SQL != "SELECT 2" {
+		t.Errorf("loadConfiguredQueries() = %v, want orders and users from both files", loaded)
+	}
+
+	tests := []struct {
+		files, dir string
+		wantErr    string
+	}{
+		{a + "," + clash, "", fmt.Sprintf("query %q is defined in both %s and %s", "orders", a, clash)},
+		{b, filepath.Join(dir, "sql"), fmt.Sprintf("query %q is defined in both %s and %s", "users", b, filepath.Join(dir, "sql"))},
+	}
+	for _, tc := range tests {
+		*queries, *queriesDir = tc.files, tc.dir
+		if _, err := loadConfiguredQueries(); errString(err) != tc.wantErr {
+			t.Errorf("loadConfiguredQueries() of %s and %q error = %v, want %q", tc.files, tc.dir, err, tc.wantErr)
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQueryTimeout(t *testing.T) {
+	fake := newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}})
+	// Queries block until they are cancelled.
+	fake.setDelay(time.Minute)
+	defer func(d time.Duration) { *timeout = d }(*timeout)
+	serveQueries(t,
+		SQLQuery{Name: "default", SQL: "SELECT 1 AS n"},
+		SQLQuery{Name: "own", SQL: "SELECT 1 AS n", Timeout: 50 * time.Millisecond},
+	)
+
+	tests := []struct {
+		name      string
+		flagValue time.Duration
+	}{
+		{"default", 50 * time.Millisecond},
+		// The query's own timeout overrides --timeout.
+		{"own", time.Minute},
+	}
+	for _, tc := range tests {
+		*timeout = tc.flagValue
+		start := time.Now()
+		w := httptest.NewRecorder()
+		queryHandler(w, httptest.NewRequest(http.MethodGet, "/"+tc.name, nil))
+		if w.Code != http.StatusGatewayTimeout || !strings.Contains(w.Body.String(), "query timed out") {
+			t.Errorf("%s: response = %d %s, want 504 query timed out", tc.name, w.Code, w.Body.String())
+		}
+		if elapsed := time.Since(start); elapsed > 10*time.Second {
+			t.Errorf("%s: request took %v, want it cancelled after the timeout", tc.name, elapsed)
+		}
+	}
+
+	// Queries finishing within their timeout succeed.
+	fake.setDelay(0)
+	*timeout = time.Minute
+	w := httptest.NewRecorder()
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/default", nil))
+	if w.Code != http.StatusOK {
+		t.Errorf("response = %d %s, want 200", w.Code, w.Body.String())
+	}
+}
+
+// cancellingWriter cancels the request once the first row is written.
+type cancellingWriter struct {
+	*httptest.ResponseRecorder
+	cancel context.CancelFunc
+}
+
+func (w cancellingWriter) Write(b []byte) (int, error) {
+	w.cancel()
+	return w.ResponseRecorder.Write(b)
+}
+
+func TestQueryHandlerCancelled(t *testing.T) {
+	// Every row arrives in the first page, so only cancellation stops them all being written.
+	newFakeBigQuery(t, []map[string]string{{"name": "n", "type": "INTEGER"}}, [][]interface{}{{"1"}, {"2"}, {"3"}, {"4"}})
+	serveQueries(t, SQLQuery{Name: "numbers", SQL: "SELECT n"})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	w := cancellingWriter{httptest.NewRecorder(), cancel}
+	queryHandler(w, httptest.NewRequest(http.MethodGet, "/numbers?format=ndjson", nil).WithContext(ctx))
+	if got, want := w.Body.String(), "{\"n\":1}\n"; got != want {
+		t.Errorf("body = %q, want only the row written before the client went away: %q", got, want)
+	}
+}
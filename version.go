@@ -0,0 +1,55 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	runtimedebug "runtime/debug"
+)
+
+// Build information, set with -ldflags like:
+//
+//	go build -ldflags "-X main.version=v1.2.3 -X main.commit=$(git rev-parse HEAD) -X main.buildDate=$(date -u +%FT%TZ)"
+var (
+	version   = "dev"
+	commit    = ""
+	buildDate = ""
+)
+
+// buildInfo returns the version, commit and build date of the binary. Without -ldflags,
+// the commit and date are taken from the version control information embedded by go build.
+func buildInfo() (string, string, string) {
+	rev, date := commit, buildDate
+	if info, ok := runtimedebug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			switch {
+			case s.Key == "vcs.revision" && rev == "":
+				rev = s.Value
+			case s.Key == "vcs.time" && date == "":
+				date = s.Value
+			}
+		}
+	}
+	if rev == "" {
+		rev = "unknown"
+	}
+	if date == "" {
+		date = "unknown"
+	}
+	return version, rev, date
+}
+
+// versionString describes the build for --version.
+func versionString() string {
+	v, rev, date := buildInfo()
+	return fmt.Sprintf("bqproxy %s (commit %s, built %s)", v, rev, date)
+}
+
+// versionHandler adds the version to responses when --version_header is set.
+func versionHandler(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *versionHeader {
+			w.Header().Set("X-BQProxy-Version", version)
+		}
+		h(w, r)
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestVersionString(t *testing.T) {
+	// Without -ldflags, the version is dev. Test binaries carry no version control information.
+	if got, want := versionString(), "bqproxy dev (commit unknown, built unknown)"; got != want {
+		t.Errorf("versionString() = %q, want %q", got, want)
+	}
+
+	defer func(v, c, d string) { version, commit, buildDate = v, c, d }(version, commit, buildDate)
+	// As set by go build -ldflags "-X main.version=v1.2.3 -X main.commit=abc123 -X main.buildDate=2024-01-02T03:04:05Z".
+	version, commit, buildDate = "v1.2.3", "abc123", "2024-01-02T03:04:05Z"
+	if got, want := versionString(), "bqproxy v1.2.3 (commit abc123, built 2024-01-02T03:04:05Z)"; got != want {
+		t.Errorf("versionString() = %q, want %q", got, want)
+	}
+}
+
+func TestVersionHandler(t *testing.T) {
+	defer func(v bool) { *versionHeader = v }(*versionHeader)
+	h := versionHandler(func(w http.ResponseWriter, r *http.Request) {})
+
+	for _, enabled := range []bool{false, true} {
+		*versionHeader = enabled
+		w := httptest.NewRecorder()
+		h(w, httptest.NewRequest(http.MethodGet, "/", nil))
+		if got := w.Header().Get("X-BQProxy-Version"); (got == version) != enabled {
+			t.Errorf("--version_header=%v: X-BQProxy-Version = %q", enabled, got)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"net/http"
+
+	"cloud.google.com/go/bigquery"
+)
+
+// xsiNamespace is the XML Schema instance namespace, which defines the nil attribute marking nulls.
+const xsiNamespace = "http://www.w3.org/2001/XMLSchema-instance"
+
+// xmlWriter streams rows as XML, like:
+//
+//	<rows xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">
+//	  <row><field name="id">1</field><field name="name" xsi:nil="true"></field></row>
+//	</rows>
+//
+// Repeated fields hold a value element per element, and RECORD fields hold nested field elements.
+type xmlWriter struct {
+	w       http.ResponseWriter
+	enc     *xml.Encoder
+	out     byteCounter
+	started bool
+}
+
+// begin sends the response headers and opens the rows element, once.
+func (x *xmlWriter) begin() error {
+	if x.started {
+		return nil
+	}
+	x.started = true
+	x.w.Header().Set("Content-Type", "application/xml")
+	x.w.Header().Set("Trailer", resultTrailers)
+	x.w.WriteHeader(http.StatusOK)
+
+	x.out.w = x.w
+	x.enc = xml.NewEncoder(&x.out)
+	if err := x.enc.EncodeToken(xml.ProcInst{Target: "xml", Inst: []byte(`version="1.0" encoding="UTF-8"`)}); err != nil {
+		return err
+	}
+	return x.enc.EncodeToken(xml.StartElement{
+		Name: xml.Name{Local: "rows"},
+		Attr: []xml.Attr{{Name: xml.Name{Local: "xmlns:xsi"}, Value: xsiNamespace}},
+	})
+}
+
+func (x *xmlWriter) writeRow(schema bigquery.Schema, row map[string]interface{}) error {
+	if err := x.begin(); err != nil {
+		return err
+	}
+	if err := x.writeFields("row", schema, row); err != nil {
+		return err
+	}
+	if err := x.enc.Flush(); err != nil {
+		return err
+	}
+	if f, ok := x.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// writeFields writes an element named name holding a field element for each field of schema.
+func (x *xmlWriter) writeFields(name string, schema bigquery.Schema, record map[string]interface{}) error {
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	if err := x.enc.EncodeToken(start); err != nil {
+		return err
+	}
+	for _, field := range schema {
+		key := fieldKey(field.Name)
+		fieldStart := xml.StartElement{
+			Name: xml.Name{Local: "field"},
+			Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: key}},
+		}
+		if err := x.writeValue(fieldStart, field, record[key], field.Repeated); err != nil {
+			return err
+		}
+	}
+	return x.enc.EncodeToken(start.End())
+}
+
+// writeValue writes the element start holding v, which is a list of values if repeated.
+func (x *xmlWriter) writeValue(start xml.StartElement, field *bigquery.FieldSchema, v interface{}, repeated bool) error {
+	if v == nil {
+		start.Attr = append(start.Attr, xml.Attr{Name: xml.Name{Local: "xsi:nil"}, Value: "true"})
+		if err := x.enc.EncodeToken(start); err != nil {
+			return err
+		}
+		return x.enc.EncodeToken(start.End())
+	}
+
+	if err := x.enc.EncodeToken(start); err != nil {
+		return err
+	}
+	// convertValue keeps a repeated value which isn't a list as a single value, so it's written as one.
+	elems, isList := v.([]interface{})
+	record, isRecord := v.(map[string]interface{})
+	switch {
+	case repeated && isList:
+		for _, e := range elems {
+			if err := x.writeValue(xml.StartElement{Name: xml.Name{Local: "value"}}, field, e, false); err != nil {
+				return err
+			}
+		}
+	case field.Type == bigquery.RecordFieldType && isRecord:
+		for _, sub := range field.Schema {
+			key := fieldKey(sub.Name)
+			subStart := xml.StartElement{
+				Name: xml.Name{Local: "field"},
+				Attr: []xml.Attr{{Name: xml.Name{Local: "name"}, Value: key}},
+			}
+			if err := x.writeValue(subStart, sub, record[key], sub.Repeated); err != nil {
+				return err
+			}
+		}
+	default:
+		if err := x.enc.EncodeToken(xml.CharData(fmt.Sprint(v))); err != nil {
+			return err
+		}
+	}
+	return x.enc.EncodeToken(start.End())
+}
+
+func (x *xmlWriter) close(_ bigquery.Schema, info resultInfo) error {
+	if err := x.begin(); err != nil {
+		return err
+	}
+	if err := x.enc.EncodeToken(xml.EndElement{Name: xml.Name{Local: "rows"}}); err != nil {
+		return err
+	}
+	if err := x.enc.Flush(); err != nil {
+		return err
+	}
+	info.setHeaders(x.w.Header())
+	return nil
+}
+
+func (x *xmlWriter) streaming() bool { return x.started }
+
+func (x *xmlWriter) size() int64 { return x.out.n }
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"cloud.google.com/go/bigquery"
+)
+
+func TestXMLWriter(t *testing.T) {
+	schema := bigquery.Schema{
+		{Name: "id", Type: bigquery.IntegerFieldType},
+		{Name: "name", Type: bigquery.StringFieldType},
+		{Name: "tags", Type: bigquery.StringFieldType, Repeated: true},
+		{Name: "geo", Type: bigquery.RecordFieldType, Schema: bigquery.Schema{
+			{Name: "lat", Type: bigquery.FloatFieldType},
+		}},
+	}
+	w := httptest.NewRecorder()
+	xw := &xmlWriter{w: w}
+	for _, row := range []map[string]interface{}{
+		{"id": int64(1), "name": "a & b", "tags": []interface{}{"x", nil}, "geo": map[string]interface{}{"lat": 1.5}},
+		// convertValue keeps a repeated value which isn't a list as it is.
+		{"id": int64(2), "name": nil, "tags": "y", "geo": nil},
+	} {
+		if err := xw.writeRow(schema, row); err != nil {
+			t.Fatalf("writeRow() error: %v", err)
+		}
+	}
+	if err := xw.close(schema, resultInfo{}); err != nil {
+		t.Fatalf("close() error: %v", err)
+	}
+
+	if got := w.Header().Get("Content-Type"); got != "application/xml" {
+		t.Errorf("Content-Type = %q, want application/xml", got)
+	}
+	want := `<?xml version="1.0" encoding="UTF-8"?><rows xmlns:xsi="http://www.w3.org/2001/XMLSchema-instance">` +
+		`<row><field name="id">1</field><field name="name">a &amp; b</field>` +
+		`<field name="tags"><value>x</value><value xsi:nil="true"></value></field>` +
+		`<field name="geo"><field name="lat">1.5</field></field></row>` +
+		`<row><field name="id">2</field><field name="name" xsi:nil="true"></field>` +
+		`<field name="tags">y</field><field name="geo" xsi:nil="true"></field></row></rows>`
+	if got := w.Body.String(); got != want {
+		t.Errorf("body =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestQueryHandlerXML(t *testing.T) {
+	newFakeBigQuery(t, []map[string]string{{"name": "id", "type": "INTEGER"}, {"name": "name", "type": "STRING"}}, [][]interface{}{{"1", "<a>"}, {"2", nil}})
+	serveQueries(t, SQLQuery{Name: "people", SQL: "SELECT id, name"})
+
+	for _, r := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/people?format=xml", nil),
+		httptest.NewRequest(http.MethodGet, "/people", nil),
+	} {
+		if r.URL.RawQuery == "" {
+			r.Header.Set("Accept", "application/xml")
+		}
+		w := httptest.NewRecorder()
+		queryHandler(w, r)
+		if got := w.Header().Get("Content-Type"); w.Code != http.StatusOK || got != "application/xml" {
+			t.Errorf("%s: response = %d %s, want 200 application/xml", r.URL, w.Code, got)
+		}
+
+		var rows struct {
+			Rows []struct {
+				Fields []struct {
+					Name  string `xml:"name,attr"`
+					Nil   bool   `xml:"http://www.w3.org/2001/XMLSchema-instance nil,attr"`
+					Value string `xml:",chardata"`
+				} `xml:"field"`
+			} `xml:"row"`
+		}
+		if err := xml.Unmarshal(w.Body.Bytes(), &rows); err != nil {
+			t.Fatalf("%s: decoding %s: %v", r.URL, w.Body.String(), err)
+		}
+		if len(rows.Rows) != 2 || len(rows.Rows[0].Fields) != 2 || len(rows.Rows[1].Fields) != 2 {
+			t.Fatalf("%s: rows = %+v, want 2 rows of 2 fields", r.URL, rows.Rows)
+		}
+		if f := rows.Rows[0].Fields[1]; f.Name != "name" || f.Value != "<a>" || f.Nil {
+			t.Errorf("%s: first name = %+v, want <a>", r.URL, f)
+		}
+		if f := rows.Rows[1].Fields[1]; f.Name != "name" || !f.Nil {
+			t.Errorf("%s: second name = %+v, want nil", r.URL, f)
+		}
+	}
+}